@@ -10,7 +10,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -26,12 +25,8 @@ import (
 )
 
 var (
-	ErrNotAuthorized = errors.New("not authorized")
-)
-
-const (
-	ContextLogin    = 0
-	ContextDownload = 1
+	ErrNotAuthorized         = errors.New("not authorized")
+	ErrUnexpectedContentType = errors.New("unexpected content type")
 )
 
 type Agent struct {
@@ -40,17 +35,41 @@ type Agent struct {
 	Username string
 	Password string
 
-	ContextSwitch int
+	// Capture controls which network traffic is kept for WriteHAR.
+	Capture CapturePolicy
+
+	// RecordDir, if set, saves every request and response the agent makes
+	// into that directory. ReplayDir serves a previous recording back
+	// instead of using the network.
+	RecordDir string
+	ReplayDir string
+
+	// Fetcher, if set, replaces the browser session as the source of data
+	// for the dataset methods.
+	Fetcher Fetcher
+
+	// Output receives every file the dataset methods write. Defaults to
+	// the current directory.
+	Output Sink
+
+	// DownloadDir is where the browser saves downloads before they are
+	// read. Defaults to a new temporary directory, removed by Close.
+	DownloadDir string
+
+	// Blobs, if set, stores training and incident attachments once by
+	// content instead of copying them into every class and incident.
+	Blobs *BlobStore
 
-	reqMap  map[string]network.RequestID
-	urlMap  map[string]string
-	bodyMap map[string][]byte
 	attr    map[string]string
 	cookies []*network.Cookie
 	ctx     context.Context
 	cancel  context.CancelFunc
 	cfunc   []context.CancelFunc
-	done    chan string
+	tmpdirs []string
+
+	capture   *capture
+	cassette  *cassette
+	downloads *downloadManager
 
 	initialized bool
 	cancelled   bool
@@ -67,17 +86,43 @@ func (a *Agent) Init() error {
 	a.LoginUrl = "https://secure.emergencyreporting.com/"
 
 	// Initialize all maps to avoid NPE
-	a.reqMap = map[string]network.RequestID{}
-	a.urlMap = map[string]string{}
-	a.bodyMap = map[string][]byte{}
 	a.attr = map[string]string{}
 	a.cfunc = make([]context.CancelFunc, 0)
-	a.done = make(chan string, 1)
+
+	var err error
+	if a.DownloadDir == "" {
+		a.DownloadDir, err = os.MkdirTemp("", "er-downloads")
+		if err != nil {
+			return err
+		}
+		a.tmpdirs = append(a.tmpdirs, a.DownloadDir)
+	}
+	a.downloads = newDownloadManager(a.DownloadDir)
+
+	a.capture, err = newCapture(a.Capture)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case a.RecordDir != "" && a.ReplayDir != "":
+		return fmt.Errorf("cannot record and replay at the same time")
+	case a.RecordDir != "":
+		log.Printf("INFO: Recording all traffic to %s", a.RecordDir)
+		a.cassette, err = newCassette(a.RecordDir, cassetteRecord, a.Username, a.Password)
+	case a.ReplayDir != "":
+		log.Printf("INFO: Replaying recorded traffic from %s", a.ReplayDir)
+		a.cassette, err = newCassette(a.ReplayDir, cassetteReplay)
+	}
+	if err != nil {
+		return err
+	}
 
 	tmpdir, err := os.MkdirTemp("", "agent")
 	if err != nil {
 		return err
 	}
+	a.tmpdirs = append(a.tmpdirs, tmpdir)
 
 	opts := append(chromedp.DefaultExecAllocatorOptions[:],
 		chromedp.UserDataDir(tmpdir),
@@ -108,79 +153,39 @@ func (a *Agent) Init() error {
 		return err
 	}
 
-	// Listen to all network events and save content for whatever comes in
+	// Listen to all network events and save content for whatever the
+	// capture policy wants to keep
 	chromedp.ListenTarget(ctx, func(v interface{}) {
-		switch a.ContextSwitch {
-		case ContextLogin:
-
-			switch ev := v.(type) {
-			case *network.EventRequestWillBeSent:
-				//log.Printf("network.EventRequestWillBeSent")
-				if unwantedTraffic(ev.Request.URL) {
-					break
-				}
-				if a.Debug {
-					log.Printf("EventRequestWillBeSent: %v: %v", ev.RequestID, ev.Request.URL)
-				}
-				a.l.Lock()
-				a.reqMap[ev.Request.URL] = ev.RequestID
-				a.l.Unlock()
-			case *network.EventResponseReceived:
-				//log.Printf("network.EventResponseReceived")
-				if unwantedTraffic(ev.Response.URL) {
-					break
-				}
-
-				if a.Debug {
-					log.Printf("EventResponseReceived: %v: %v", ev.RequestID, ev.Response.URL)
-					log.Printf("EventResponseReceived: status = %d, headers = %#v", ev.Response.Status, ev.Response.Headers)
-				}
-				a.l.Lock()
-				a.urlMap[ev.RequestID.String()] = ev.Response.URL
-				a.l.Unlock()
-			case *network.EventLoadingFinished:
-				//log.Printf("network.EventLoadingFinished")
+		id, fetch := a.capture.handleEvent(v)
+		if !fetch {
+			return
+		}
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			c := chromedp.FromContext(ctx)
+			body, err := network.GetResponseBody(id).Do(cdp.WithExecutor(ctx, c.Target))
+			if err != nil {
 				if a.Debug {
-					log.Printf("EventLoadingFinished: %v", ev.RequestID)
-				}
-				a.wg.Add(1)
-				go func() {
-					c := chromedp.FromContext(ctx)
-					body, err := network.GetResponseBody(ev.RequestID).Do(cdp.WithExecutor(ctx, c.Target))
-					if err != nil {
-						defer a.wg.Done()
-						return
-					}
-
-					a.l.Lock()
-					url := a.urlMap[ev.RequestID.String()]
-					a.bodyMap[url] = body
-					a.l.Unlock()
-
-					if a.Debug {
-						log.Printf("%s: %s", url, string(body))
-					}
-
-					defer a.wg.Done()
-				}()
-			}
-			break
-		case ContextDownload:
-			if ev, ok := v.(*browser.EventDownloadProgress); ok {
-				completed := "(unknown)"
-				if ev.TotalBytes != 0 {
-					completed = fmt.Sprintf("%0.2f%%", ev.ReceivedBytes/ev.TotalBytes*100.0)
-				}
-				log.Printf("state: %s, completed: %s\n", ev.State.String(), completed)
-				if ev.State == browser.DownloadProgressStateCompleted {
-					a.done <- ev.GUID
-					close(a.done)
+					log.Printf("DEBUG: GetResponseBody(%s): %s", id, err.Error())
 				}
+				return
 			}
-			break
-		}
+			a.capture.body(id, body)
+		}()
 	})
 
+	if a.cassette != nil {
+		if err := a.cassette.attach(ctx); err != nil {
+			log.Printf("ERR: Attaching cassette: %s", err.Error())
+			return err
+		}
+	}
+
+	// Download events are tracked by GUID, so that they can never be missed
+	// or attributed to the wrong caller.
+	a.downloads.listen(ctx)
+
 	// Use a Chrome web browser to log in to the interface and obtain the
 	// appropriate authentication token from local storage.
 
@@ -346,7 +351,7 @@ func (a *Agent) Init() error {
 
 	if a.Debug {
 		log.Printf("attr : %#v", a.attr)
-		log.Printf("urlMap : %#v", a.urlMap)
+		log.Printf("captured : %d entries", len(a.capture.snapshot()))
 	}
 
 	if a.Debug {
@@ -379,6 +384,25 @@ func (a *Agent) Run() {
 	}()
 }
 
+// Close shuts down the browser and removes the temporary directories the
+// agent created, including any downloads left in them.
+func (a *Agent) Close() error {
+	a.cancelled = true
+	for i := len(a.cfunc) - 1; i >= 0; i-- {
+		a.cfunc[i]()
+	}
+	a.cfunc = nil
+
+	var err error
+	for _, dir := range a.tmpdirs {
+		if rerr := os.RemoveAll(dir); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	a.tmpdirs = nil
+	return err
+}
+
 func (a *Agent) Ping() error {
 	return nil // TODO: FIXME: XXX
 }
@@ -405,15 +429,54 @@ func (a *Agent) authorizedNativeGet(url string) ([]byte, error) {
 
 	log.Printf("authorizedNativeGet(%s)", url)
 
-	cl := http.Client{}
-
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		log.Printf("ERR: Parse: %s", err.Error())
 		return []byte{}, err
 	}
 
+	resp, err := a.authorizedNativeRequest(req)
+	if err != nil {
+		log.Printf("ERR: Get: %s", err.Error())
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+
+	out, err = io.ReadAll(resp.Body)
+
+	return out, err
+}
+
+// authorizedNativeOpen streams url over native HTTP with the session
+// cookies, so that a download can be read without touching the disk.
+func (a *Agent) authorizedNativeOpen(url string) (io.ReadCloser, error) {
+	log.Printf("authorizedNativeOpen(%s)", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.authorizedNativeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not get url %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// authorizedNativeRequest executes a native net/http request using the
+// cookies from the browser session. Any cookies the server hands back are
+// merged into the session so that long batches of native requests keep
+// the session fresh without bouncing through the browser.
+func (a *Agent) authorizedNativeRequest(req *http.Request) (*http.Response, error) {
+	cl := a.nativeClient()
+
 	// Load all cookies
+	a.l.Lock()
 	for _, i := range a.cookies {
 		o := &http.Cookie{
 			Name:    i.Name,
@@ -427,59 +490,98 @@ func (a *Agent) authorizedNativeGet(url string) ([]byte, error) {
 		}
 		req.AddCookie(o)
 	}
+	a.l.Unlock()
 
 	resp, err := cl.Do(req)
 	if err != nil {
-		log.Printf("ERR: Get: %s", err.Error())
-		return []byte{}, err
+		return nil, err
 	}
 
-	out, err = io.ReadAll(resp.Body)
+	a.mergeCookies(resp.Cookies())
 
-	return out, err
+	return resp, nil
 }
 
-func (a *Agent) authorizedJsonGet(url string) ([]byte, error) {
-	b, err := a.authorizedGet(url)
-	if err != nil {
-		return b, err
-	}
-	s := string(b)
-	s = strings.TrimPrefix(s, "<head></head><body>")
-	s = strings.TrimSuffix(s, "</body>")
-	for {
-		s = strings.TrimSuffix(s, "</span>")
-		s = strings.TrimSuffix(s, "</div>")
-		s = strings.TrimSuffix(s, "</a>")
-		if !strings.HasSuffix(s, "</span>") && !strings.HasSuffix(s, "</div>") && !strings.HasSuffix(s, "</a>") {
-			break
-		}
+// output returns the sink dataset methods write to.
+func (a *Agent) output() Sink {
+	if a.Output == nil {
+		a.Output = NewDirSink(".")
 	}
-	s = strings.TrimSuffix(s, "</a>")
+	return a.Output
+}
 
-	s = strings.ReplaceAll(s, `\"=""`, `\"=\"\"`)
-	s = strings.ReplaceAll(s, `\"=""`, `\"=\"\"`)
+// saveAttachment writes the attachment identified by key (its file GUID,
+// where known) to name in the output, through the blob store when there is
+// one, fetching it from url only when needed.
+func (a *Agent) saveAttachment(key, name, url string) (BlobRef, error) {
+	fetch := func() ([]byte, error) {
+		return a.fetcher().Get(url)
+	}
+	if a.Blobs != nil {
+		return a.Blobs.Save(key, name, fetch)
+	}
+	data, err := fetch()
+	if err != nil {
+		return BlobRef{}, err
+	}
+	ref := BlobRef{
+		SHA256:      sha256Hex(data),
+		Size:        int64(len(data)),
+		ContentType: detectContentType(name, data),
+		Blob:        name,
+	}
+	return ref, WriteFile(a.output(), name, data)
+}
 
-	b = []byte(s)
-	return b, err
+// nativeClient returns an HTTP client for native requests, whose traffic is
+// captured alongside the browser's according to the capture policy, and
+// recorded or replayed when a cassette is in use.
+func (a *Agent) nativeClient() *http.Client {
+	var rt http.RoundTripper = http.DefaultTransport
+	if a.cassette != nil {
+		rt = &cassetteTransport{next: rt, c: a.cassette}
+	}
+	return &http.Client{
+		Transport: &captureTransport{next: rt, c: a.capture},
+	}
 }
 
-func (a *Agent) authorizedJsonGet2(url string) ([]byte, error) {
-	var out string
+// authorizedJsonGet fetches one of the JSON web services (training/ws/*.php,
+// webservices/*.php) over native HTTP with the session cookies, returning
+// the raw response body. The response must be a 200 carrying JSON; a login
+// page or error page served in its place is reported as an error rather
+// than handed to the caller to unmarshal.
+func (a *Agent) authorizedJsonGet(url string) ([]byte, error) {
+	log.Printf("authorizedJsonGet(%s)", url)
 
-	log.Printf("authorizedJsonGet2(%s)", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	req.Header.Set("Accept", "application/json, text/javascript, */*; q=0.01")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
 
-	if err := chromedp.Run(a.ctx, chromedp.Navigate(url),
-		chromedp.Tasks{
-			// Refresh cookies, keep 'em fresh so we don't die out during
-			// enormous batches.
-			chromedp.ActionFunc(a.saveCookies),
-			// Extract actual text
-			chromedp.Text(`//*`, &out),
-		}); err != nil {
-		return nil, fmt.Errorf("could not get url %s: %s", url, err.Error())
+	resp, err := a.authorizedNativeRequest(req)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not get url %s: %s", url, err.Error())
 	}
-	return []byte(out), nil
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return out, fmt.Errorf("could not read url %s: %s", url, err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return out, fmt.Errorf("could not get url %s: %s", url, resp.Status)
+	}
+
+	err = checkJsonContentType(resp.Header.Get("Content-Type"), out)
+	if err != nil {
+		return out, fmt.Errorf("url %s: %w", url, err)
+	}
+
+	return out, nil
 }
 
 // authorizedApiGetCall accesses the api.emergencyreporting.com API, which
@@ -505,7 +607,7 @@ func (a *Agent) authorizedApiGetCall(hostPage, apiUrl string) ([]byte, error) {
 		return []byte{}, err
 	}
 	req.Header.Set("Authorization", accessToken)
-	client := &http.Client{}
+	client := a.nativeClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return []byte{}, err
@@ -547,34 +649,50 @@ func (a *Agent) authorizedDownload(url string) (string, error) {
 // authorizedDownload uses the current authentication mechanism to download a file.
 // Returns the temporary file name.
 func (a *Agent) authorizedDownloadContext(ctx context.Context, url string) (string, error) {
-	var out string
+	res, err := a.authorizedDownloadResult(ctx, url)
+	return res.Path, err
+}
 
+// authorizedDownloadResult downloads a file through the browser and waits
+// for that specific download to finish, returning its details including
+// the filename suggested by the server. It is safe to call concurrently
+// from separate browser contexts.
+func (a *Agent) authorizedDownloadResult(ctx context.Context, url string) (DownloadResult, error) {
 	log.Printf("authorizedDownload(%s)", url)
 
-	a.done = make(chan string, 1)
-	a.ContextSwitch = ContextDownload
-
-	wd := shims.SingleValueDiscardError(os.Getwd())
+	frame := ""
+	if c := chromedp.FromContext(ctx); c != nil && c.Target != nil {
+		// A page's main frame shares its target's ID
+		frame = string(c.Target.TargetID)
+	}
+	d := a.downloads.expect(url, frame)
 
 	if err := chromedp.Run(ctx,
 		browser.
 			SetDownloadBehavior(browser.SetDownloadBehaviorBehaviorAllowAndName).
-			WithDownloadPath(wd).
+			WithDownloadPath(a.downloads.dir).
 			WithEventsEnabled(true),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			a.downloads.listen(ctx)
+			return nil
+		}),
 		chromedp.Navigate(url),
 	); err != nil && !strings.Contains(err.Error(), "net::ERR_ABORTED") {
 		log.Printf("authorizedDownload: ERR: %s", err.Error())
-		return "", err
+		a.downloads.forget(d)
+		return DownloadResult{}, err
 	}
 
-	guid := <-a.done
+	res, err := d.wait(ctx)
+	if err != nil {
+		log.Printf("authorizedDownload: ERR: %s: %s", url, err.Error())
+		a.downloads.forget(d)
+		return res, err
+	}
 
-	// We can predict the exact file location and name here because of how we
-	// configured SetDownloadBehavior and WithDownloadPath
-	out = filepath.Join(wd, guid)
-	log.Printf("authorizedDownload: INFO: wrote %s", out)
+	log.Printf("authorizedDownload: INFO: wrote %s", res.Path)
 
-	return out, nil
+	return res, nil
 }
 
 func (a *Agent) waitForLoadEvent(ctx context.Context) chromedp.Action {
@@ -599,27 +717,14 @@ func (a *Agent) waitForLoadEvent(ctx context.Context) chromedp.Action {
 }
 
 func (a *Agent) getCsvUrl(csvurl string) ([][]string, error) {
-	return a.getCsvUrlContext(a.ctx, csvurl)
-}
-
-func (a *Agent) getCsvUrlContext(ctx context.Context, csvurl string) ([][]string, error) {
 	out := [][]string{}
 
-	a.ContextSwitch = ContextDownload
-
 	log.Printf("INFO: Load CSV from %s", csvurl)
-	csvOut, err := a.authorizedDownload(csvurl)
-	if err != nil {
-		return out, err
-	}
-
-	log.Printf("INFO: CSV temporary file: %s", csvOut)
-	defer os.Remove(csvOut)
-
-	fp, err := os.Open(csvOut)
+	fp, err := a.fetcher().Open(csvurl)
 	if err != nil {
 		return out, err
 	}
+	defer fp.Close()
 
 	reader := csv.NewReader(fp)
 
@@ -627,12 +732,14 @@ func (a *Agent) getCsvUrlContext(ctx context.Context, csvurl string) ([][]string
 }
 
 func (a *Agent) saveCookies(ctx context.Context) error {
-	var err error
-	a.cookies, err = network.GetCookies().Do(ctx)
+	cookies, err := network.GetCookies().Do(ctx)
 	if err != nil {
 		return err
 	}
-	for i, cookie := range a.cookies {
+	a.l.Lock()
+	a.cookies = cookies
+	a.l.Unlock()
+	for i, cookie := range cookies {
 		if a.Debug {
 			log.Printf("DEBUG: chrome cookie %d: %+v", i, cookie.Name)
 		}
@@ -640,6 +747,34 @@ func (a *Agent) saveCookies(ctx context.Context) error {
 	return nil
 }
 
+// mergeCookies folds cookies set by a native HTTP response back into the
+// session cookie list, replacing any existing cookie of the same name.
+func (a *Agent) mergeCookies(cookies []*http.Cookie) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	for _, c := range cookies {
+		found := false
+		for _, v := range a.cookies {
+			if v.Name == c.Name {
+				v.Value = c.Value
+				found = true
+			}
+		}
+		if !found {
+			a.cookies = append(a.cookies, &network.Cookie{
+				Name:   c.Name,
+				Value:  c.Value,
+				Domain: c.Domain,
+				Path:   c.Path,
+			})
+		}
+		if a.Debug {
+			log.Printf("DEBUG: merged cookie %s", c.Name)
+		}
+	}
+}
+
 type Timestamp struct {
 	time.Time
 }
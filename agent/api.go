@@ -9,151 +9,197 @@ import (
 	"io"
 	"log"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/chromedp/chromedp"
 	"github.com/jbuchbinder/shims"
 )
 
+const (
+	trainingFilesSidecar = "files.json"
+	calendarPageURL      = "https://secure.emergencyreporting.com/calendar/"
+)
+
 func (a *Agent) IsAuthorized() error {
 	return nil
 }
 
 // GetAllTrainingClassIDs returns a list of all training class records in the system
 func (a *Agent) GetAllTrainingClassIDs() ([]int, [][]string, error) {
-	out := make([]int, 0)
-	fullout := [][]string{}
+	ix, err := a.GetTrainingClassIndex()
+	return ix.IDs(), ix.Rows, err
+}
 
-	a.ContextSwitch = ContextDownload
+// GetAllTrainingClassIDsFromCSV returns the class IDs and rows of a class
+// list CSV, without its header row.
+func (a *Agent) GetAllTrainingClassIDsFromCSV(csvdata []byte) ([]int, [][]string, error) {
+	ix, err := ParseTrainingClassIndex(csvdata)
+	return ix.IDs(), ix.Rows, err
+}
 
+// GetTrainingClassIndex returns the training class list, with its header.
+func (a *Agent) GetTrainingClassIndex() (TrainingIndex, error) {
 	csvurl := "https://secure.emergencyreporting.com/training/ws/classes.php?_function=list_csv&_csvtype=info"
 
 	log.Printf("INFO: Load class list WS")
-	classesOut, err := a.authorizedApiGetCall("https://secure.emergencyreporting.com/", csvurl)
-	//classesOut, err := a.authorizedJsonGet2(csvurl)
+	classesOut, err := a.fetcher().APIGet("https://secure.emergencyreporting.com/", csvurl)
 	if err != nil {
-		return out, fullout, err
+		return TrainingIndex{Header: TrainingClassColumns, Rows: [][]string{}}, err
 	}
 
-	return a.GetAllTrainingClassIDsFromCSV(classesOut)
+	return ParseTrainingClassIndex(classesOut)
 }
 
-func (a *Agent) GetAllTrainingClassIDsFromCSV(csvdata []byte) ([]int, [][]string, error) {
-	out := make([]int, 0)
-	fullout := [][]string{}
+// ParseTrainingClassIndex parses the class list CSV. A leading row whose
+// first column is not a class ID is taken as the header; without one, the
+// known TrainingClassColumns are assumed. Rows may carry more columns than
+// the header names, which are kept as "Column N".
+func ParseTrainingClassIndex(csvdata []byte) (TrainingIndex, error) {
+	ix := TrainingIndex{Rows: [][]string{}}
 
 	reader := csv.NewReader(bytes.NewReader(csvdata))
+	reader.FieldsPerRecord = -1
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return out, fullout, err
+			ix.Header = trainingIndexHeader(ix.Header, ix.Rows)
+			return ix, err
+		}
+		if ix.Header == nil && len(ix.Rows) == 0 && !isClassID(record[0]) {
+			ix.Header = record
+			continue
 		}
-		fullout = append(fullout, record)
-		out = append(out, shims.SingleValueDiscardError(strconv.Atoi(record[0])))
+		ix.Rows = append(ix.Rows, record)
 	}
 
-	return out, fullout, nil
+	ix.Header = trainingIndexHeader(ix.Header, ix.Rows)
+	return ix, nil
 }
 
-func (a *Agent) DownloadTrainingAttendance(classId int, destFile string) error {
+func isClassID(s string) bool {
+	_, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(s, "\ufeff")))
+	return err == nil
+}
+
+// trainingIndexHeader completes a header so that it names every column of
+// rows, uniquely.
+func trainingIndexHeader(header []string, rows [][]string) []string {
+	if header == nil {
+		header = TrainingClassColumns
+	}
+	width := len(header)
+	for _, r := range rows {
+		width = max(width, len(r))
+	}
+
+	out := make([]string, width)
+	used := map[string]bool{}
+	for i := range out {
+		name := ""
+		if i < len(header) {
+			name = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+		}
+		if name == "" || used[name] {
+			name = fmt.Sprintf("Column %d", i+1)
+		}
+		used[name] = true
+		out[i] = name
+	}
+	return out
+}
+
+// GetTrainingAttendance returns the raw attendance list for a class.
+func (a *Agent) GetTrainingAttendance(classId int) ([]byte, error) {
 	u := fmt.Sprintf("https://secure.emergencyreporting.com/training/ws/class_people.php?classid=%d&_function=list_json", classId)
-	a.ContextSwitch = ContextDownload
 
 	log.Printf("INFO: Load class attendance list WS")
-	attendance, err := a.authorizedJsonGet2(u)
+	return a.fetcher().GetJSON(u)
+}
+
+func (a *Agent) DownloadTrainingAttendance(classId int, destFile string) error {
+	attendance, err := a.GetTrainingAttendance(classId)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(destFile, attendance, 0644)
+	return WriteFile(a.output(), destFile, attendance)
 }
 
-func (a *Agent) DownloadTrainingNarrative(classId int, destFile string) error {
+// GetTrainingNarrative returns the raw narrative for a class.
+func (a *Agent) GetTrainingNarrative(classId int) ([]byte, error) {
 	u := fmt.Sprintf("https://secure.emergencyreporting.com/training/ws/class_narrative.php?classid=%d&_function=read", classId)
-	a.ContextSwitch = ContextDownload
 
 	log.Printf("INFO: Load class narrative WS")
-	narrative, err := a.authorizedJsonGet2(u)
+	return a.fetcher().GetJSON(u)
+}
+
+func (a *Agent) DownloadTrainingNarrative(classId int, destFile string) error {
+	narrative, err := a.GetTrainingNarrative(classId)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(destFile, narrative, 0644)
+	err = WriteFile(a.output(), destFile, narrative)
 	if err != nil {
 		log.Printf("DownloadTrainingNarrative(): ERR: destfile = %s: %s", destFile, err.Error())
 	}
 	return err
 }
 
-// DownloadTrainingAssets downloads training files, with appropriate names,
-// to the specified destination path for the given class ID
-func (a *Agent) DownloadTrainingAssets(classId int, destPath string) error {
+// GetTrainingFiles returns the files attached to a class, with the detail
+// of each. Files whose detail cannot be loaded are skipped.
+func (a *Agent) GetTrainingFiles(classId int) ([]TrainingFile, error) {
+	out := make([]TrainingFile, 0)
+
 	//u := fmt.Sprintf("https://secure.emergencyreporting.com/training/class.php?id=%d&recurrence_mode=Single", classId)
 	//u := fmt.Sprintf("https://secure.emergencyreporting.com/training/class_files.php?id=%d&recurrence_mode=Single", classId)
 	u := fmt.Sprintf("https://secure.emergencyreporting.com/training/ws/class_files.php?classid=%d&_function=list_json", classId)
-	var err error
-
-	a.ContextSwitch = ContextDownload
 
 	log.Printf("INFO: Find files for class %d (url = %s)", classId, u)
 
 	log.Printf("INFO: Load class file list WS")
-	classfile, err := a.authorizedJsonGet2(u)
+	classfile, err := a.fetcher().GetJSON(u)
 	if err != nil {
-		return err
+		return out, err
 	}
 
-	fileMap := map[string]string{}
-	fileGuidMap := map[string]string{}
-
-	{
-		type classResponse struct {
-			Rows []struct {
-				Id   string   `json:"id"`
-				Cell []string `json:"cell"`
-			} `json:"rows"`
-		}
+	type classResponse struct {
+		Rows []struct {
+			Id   string   `json:"id"`
+			Cell []string `json:"cell"`
+		} `json:"rows"`
+	}
 
-		var cr classResponse
-		err = json.Unmarshal(classfile, &cr)
-		if err != nil {
-			return err
-		}
+	var cr classResponse
+	err = json.Unmarshal(classfile, &cr)
+	if err != nil {
+		return out, err
+	}
 
-		for _, r := range cr.Rows {
-			if len(r.Cell) < 3 {
-				continue
-			}
-			fileMap[r.Cell[0]] = r.Id
+	for _, r := range cr.Rows {
+		if len(r.Cell) < 3 {
+			continue
 		}
 
-		log.Printf("filemap = %#v", fileMap)
-	}
-
-	for fn, id := range fileMap {
-		classFileInfo, err := a.authorizedJsonGet2(
+		classFileInfo, err := a.fetcher().GetJSON(
 			fmt.Sprintf(
 				"https://secure.emergencyreporting.com/training/ws/class_files.php?classid=%d&id=%s&_function=detail",
-				classId, id,
+				classId, r.Id,
 			))
-
 		if err != nil {
 			log.Printf("ERR: %s", err.Error())
 			continue
 		}
 
-		/*
-			cfi := string(classFileInfo)
-			cfi = strings.TrimPrefix(cfi, "<head></head><body>")
-			cfi = strings.TrimSuffix(cfi, "</body>")
-			cfi = strings.TrimSuffix(cfi, "</span>")
-		*/
+		if a.Debug {
+			log.Printf("DEBUG: CFI = %s", string(classFileInfo))
+		}
 
 		type classFileInfoType struct {
 			Accesslevel string `json:"accesslevel"`
@@ -163,10 +209,6 @@ func (a *Agent) DownloadTrainingAssets(classId int, destPath string) error {
 			Url         string `json:"url"`
 		}
 
-		if a.Debug {
-			log.Printf("DEBUG: CFI = %s", string(classFileInfo))
-		}
-
 		var cfiOut classFileInfoType
 		err = json.Unmarshal(classFileInfo, &cfiOut)
 		if err != nil {
@@ -175,61 +217,196 @@ func (a *Agent) DownloadTrainingAssets(classId int, destPath string) error {
 		}
 
 		if a.Debug {
-			log.Printf("DEBUG: CFI = %v, fn = %s", cfiOut, fn)
+			log.Printf("DEBUG: CFI = %v, fn = %s", cfiOut, r.Cell[0])
 		}
 
-		fileGuidMap[fn] = cfiOut.Fileguid
+		out = append(out, TrainingFile{
+			ID:           r.Id,
+			ClassID:      classId,
+			Title:        r.Cell[0],
+			OriginalName: r.Cell[0],
+			Name:         cfiOut.Name,
+			Description:  cfiOut.Description,
+			AccessLevel:  cfiOut.Accesslevel,
+			GUID:         cfiOut.Fileguid,
+			URL:          cfiOut.Url,
+		})
 	}
 
-	log.Printf("INFO: fileguidmap = %#v", fileGuidMap)
+	return out, nil
+}
+
+// GetTrainingReference returns the rows of a training reference table, one
+// of TrainingReferenceTables, from its list web service, with each row's
+// detail where the source has a detail service.
+func (a *Agent) GetTrainingReference(table string, src TrainingReferenceSource) ([]TrainingReference, error) {
+	out := make([]TrainingReference, 0)
+
+	log.Printf("INFO: Load training %s WS", table)
+	data, err := a.fetcher().GetJSON(src.List)
+	if err != nil {
+		return out, err
+	}
+
+	var list struct {
+		Rows []struct {
+			Id   string   `json:"id"`
+			Cell []string `json:"cell"`
+		} `json:"rows"`
+	}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return out, err
+	}
+
+	for _, r := range list.Rows {
+		ref := TrainingReference{Table: table, ID: r.Id, Cells: r.Cell}
+		if src.Detail != "" {
+			detail, err := a.fetcher().GetJSON(strings.ReplaceAll(src.Detail, "{id}", url.QueryEscape(r.Id)))
+			if err != nil {
+				log.Printf("ERR: Training %s %s: %s", table, r.Id, err.Error())
+			} else {
+				ref.Detail = detail
+			}
+		}
+		out = append(out, ref)
+	}
+	return out, nil
+}
+
+// DownloadTrainingReference saves every training reference table with a
+// source as <table>.json under destPath, continuing past tables which
+// cannot be loaded and returning the first error.
+func (a *Agent) DownloadTrainingReference(destPath string, sources TrainingReferenceSources) error {
+	if err := sources.Validate(); err != nil {
+		return err
+	}
+
+	var first error
+	for _, table := range TrainingReferenceTables {
+		src, ok := sources[table]
+		if !ok {
+			log.Printf("WARN: Training %s: no source given, skipping", table)
+			continue
+		}
+		refs, err := a.GetTrainingReference(table, src)
+		if err == nil {
+			var b []byte
+			b, err = json.MarshalIndent(refs, "", "  ")
+			if err == nil {
+				err = WriteFile(a.output(), sinkPath(destPath, table+".json"), b)
+			}
+		}
+		if err != nil {
+			log.Printf("ERR: Training %s: %s", table, err.Error())
+			if first == nil {
+				first = fmt.Errorf("training %s: %w", table, err)
+			}
+		}
+	}
+	return first
+}
+
+// DownloadTrainingAssets downloads training files, with appropriate names,
+// to the specified destination path in the output sink for the given class ID
+func (a *Agent) DownloadTrainingAssets(classId int, destPath string) error {
+	_, err := a.DownloadTrainingFiles(classId, destPath)
+	return err
+}
+
+// DownloadTrainingFiles downloads training files like DownloadTrainingAssets
+// and returns them, with the outcome of each download filled in. The file
+// list, with each file's original name, description, access level and
+// download result, is saved as files.json alongside them so that access
+// restrictions and descriptions can be restored elsewhere.
+func (a *Agent) DownloadTrainingFiles(classId int, destPath string) ([]TrainingFile, error) {
+	files, err := a.GetTrainingFiles(classId)
+	if err != nil {
+		return files, err
+	}
+	return a.SaveTrainingFiles(destPath, files, nil)
+}
+
+// SaveTrainingFiles downloads files listed by GetTrainingFiles to destPath
+// like DownloadTrainingFiles. Files whose GUID is in saved, such as those
+// shared by a class series, are not downloaded again but recorded in
+// files.json as stored at their existing path.
+func (a *Agent) SaveTrainingFiles(destPath string, files []TrainingFile, saved map[string]TrainingFile) ([]TrainingFile, error) {
+	// Titles come straight from the server, so they are made safe and
+	// unique within the class, with files.json recording the originals.
+	used := map[string]bool{trainingFilesSidecar: true}
+
+	for i := range files {
+		f := &files[i]
+		f.FileName = uniqueFilename(used, SafeFilename(f.Title), f.GUID)
+
+		if prev, ok := saved[f.GUID]; ok && f.GUID != "" && prev.Path != "" {
+			f.FileName, f.Path = prev.FileName, prev.Path
+			f.SHA256, f.Size, f.ContentType = prev.SHA256, prev.Size, prev.ContentType
+			f.Status = TrainingFileInSeries
+			continue
+		}
 
-	for fn, guid := range fileGuidMap {
 		/*
 			var out string
 			out, err = a.authorizedDownload(fmt.Sprintf(
 				"https://secure.emergencyreporting.com/filedownload.php?fileguid=%s&contentdisposition=attachment",
-				guid,
+				f.GUID,
 			))
 			if err != nil {
 				log.Printf("ERR: %s", err.Error())
 				continue
 			}
-			log.Printf("INFO: title = %s, temp file = %s", fn, out)
-			err = os.Rename(out, destPath+string(os.PathSeparator)+fn)
+			log.Printf("INFO: title = %s, temp file = %s", f.Title, out)
+			err = os.Rename(out, destPath+string(os.PathSeparator)+f.FileName)
 			if err != nil {
-				log.Printf("ERR: renaming file %s to %s: %s", out, destPath+string(os.PathSeparator)+fn, err.Error())
+				log.Printf("ERR: renaming file %s to %s: %s", out, destPath+string(os.PathSeparator)+f.FileName, err.Error())
 			}
 		*/
 
-		out, err := a.authorizedNativeGet(fmt.Sprintf(
+		f.Path = sinkPath(destPath, f.FileName)
+		f.Status = TrainingFileDownloaded
+		if a.Blobs != nil {
+			if _, ok := a.Blobs.Lookup(f.GUID); ok {
+				f.Status = TrainingFileAlreadyStored
+			}
+		}
+		ref, err := a.saveAttachment(f.GUID, f.Path, fmt.Sprintf(
 			"https://secure.emergencyreporting.com/filedownload.php?fileguid=%s&contentdisposition=attachment",
-			guid,
+			f.GUID,
 		))
 		if err != nil {
 			log.Printf("ERR: %s", err.Error())
+			f.Path = ""
+			f.Status = TrainingFileFailed
+			f.Error = err.Error()
 			continue
 		}
-		err = os.WriteFile(destPath+string(os.PathSeparator)+fn, out, 0644)
-		if err != nil {
-			log.Printf("ERR: %s", err.Error())
-			continue
-		}
+		f.SHA256 = ref.SHA256
+		f.Size = ref.Size
+		f.ContentType = ref.ContentType
 
 		//log.Printf("DEBUG: Wait 2 seconds")
 		//time.Sleep(2 * time.Second)
 	}
 
-	return err
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	b, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return files, err
+	}
+	return files, WriteFile(a.output(), sinkPath(destPath, trainingFilesSidecar), b)
 }
 
 func (a *Agent) GetUsers() (map[string]any, error) {
 	out := make(map[string]any, 0)
 	u := "https://secure.emergencyreporting.com/webservices/admin/users.php?_function=list_json&_search=false&rows=500&page=1&sidx=name&sord=asc"
 
-	a.ContextSwitch = ContextDownload
-
 	log.Printf("INFO: Load user list WS")
-	users, err := a.authorizedJsonGet2(u)
+	users, err := a.fetcher().GetJSON(u)
 	if err != nil {
 		log.Printf("ERR: %s: %s", err.Error(), string(users))
 		return out, err
@@ -246,10 +423,8 @@ func (a *Agent) GetUserCertifications(userId int) (map[string]any, error) {
 	out := make(map[string]any, 0)
 	u := fmt.Sprintf("https://api.emergencyreporting.com/V1/users/%d/certifications?limit=1000", userId)
 
-	a.ContextSwitch = ContextDownload
-
 	log.Printf("INFO: Load user certifications WS")
-	data, err := a.authorizedApiGetCall(
+	data, err := a.fetcher().APIGet(
 		fmt.Sprintf("https://secure.emergencyreporting.com/admin_user/users/Certifications.php?userid=%d", userId),
 		u,
 	)
@@ -271,8 +446,15 @@ func (a *Agent) GetHydrants() ([][]string, error) {
 	return a.getCsvUrl("https://secure.emergencyreporting.com/webservices/hydrants/hydrants.php?_type=hydrants&_function=list_csv")
 }
 
-// GetIncidentIDs returns an array of all incident data
-func (a *Agent) GetIncidentIDs() ([]string, error) {
+// searchAllIncidents runs an all time incident search in the browser, which
+// the NFIRS result pages and CSV export are served from. Without a browser
+// session, as with a replayed or in-memory Fetcher, the search is assumed
+// to have been run already.
+func (a *Agent) searchAllIncidents() error {
+	if a.ctx == nil {
+		return nil
+	}
+
 	var target any // temporary holding spot -- we just discard this
 	if err := chromedp.Run(a.ctx,
 		chromedp.Navigate("https://secure.emergencyreporting.com/nfirs/main.asp"),
@@ -297,6 +479,15 @@ func (a *Agent) GetIncidentIDs() ([]string, error) {
 		}),
 		chromedp.Evaluate(`top.frames[1].document.querySelector('input[id="Submit2"]').click();`, &target),
 	); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetIncidentIDs returns an array of all incident data
+func (a *Agent) GetIncidentIDs() ([]string, error) {
+	if err := a.searchAllIncidents(); err != nil {
 		return []string{}, err
 	}
 
@@ -306,7 +497,7 @@ func (a *Agent) GetIncidentIDs() ([]string, error) {
 	page := 1
 	// Enter loop
 	for {
-		pRaw, err := a.authorizedNativeGet(fmt.Sprintf("https://secure.emergencyreporting.com/nfirs/main_results.asp?pagenumber=%d", page))
+		pRaw, err := a.fetcher().Get(fmt.Sprintf("https://secure.emergencyreporting.com/nfirs/main_results.asp?pagenumber=%d", page))
 		if err != nil {
 			log.Printf("ERR: %s", err.Error())
 			break
@@ -344,14 +535,16 @@ func (a *Agent) GetIncidentIDs() ([]string, error) {
 
 		page++
 
+		// Keep this page's incidents before stopping, since the last page
+		// has them too
+		allids = append(allids, shims.Values(pageIdMap)...)
+
+		log.Printf("INFO: Collected %d ids", len(allids))
+
 		if !next {
 			log.Printf("INFO: No next page, breaking out of loop")
 			break
 		}
-
-		allids = append(allids, shims.Values(pageIdMap)...)
-
-		log.Printf("INFO: Collected %d ids", len(allids))
 	}
 
 	return allids, nil
@@ -359,30 +552,7 @@ func (a *Agent) GetIncidentIDs() ([]string, error) {
 
 // GetIncidentsCsv returns an array of all incident data
 func (a *Agent) GetIncidentsCSV() ([][]string, error) {
-	var target any // temporary holding spot -- we just discard this
-	if err := chromedp.Run(a.ctx,
-		chromedp.Navigate("https://secure.emergencyreporting.com/nfirs/main.asp"),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			log.Printf("INFO: Waiting for header frame to be visible")
-			return nil
-		}),
-		chromedp.WaitVisible("//frameset/frame[@src='searchoptions.asp']"),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			log.Printf("INFO: Setting multioption")
-			return nil
-		}),
-		chromedp.Evaluate(`top.frames[1].document.querySelector('input[id="Radio1"]').checked = true;`, &target),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			log.Printf("INFO: Setting search range")
-			return nil
-		}),
-		chromedp.Evaluate(`top.frames[1].document.querySelector('select[name="searchDateRange"]').value = 'AllTime';`, &target),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			log.Printf("INFO: Submitting form")
-			return nil
-		}),
-		chromedp.Evaluate(`top.frames[1].document.querySelector('input[id="Submit2"]').click();`, &target),
-	); err != nil {
+	if err := a.searchAllIncidents(); err != nil {
 		return [][]string{}, err
 	}
 
@@ -396,7 +566,7 @@ func (a *Agent) DownloadIncident(path string, eid string) error {
 	/*
 		// TODO: This needs detection logic for patients
 		{
-			pdialog, err := a.authorizedNativeGet(fmt.Sprintf("https://secure.emergencyreporting.com/nfirs/print_form.asp?eid=%s&pid=&cid=&fromSummary=TRUE", eid))
+			pdialog, err := a.fetcher().Get(fmt.Sprintf("https://secure.emergencyreporting.com/nfirs/print_form.asp?eid=%s&pid=&cid=&fromSummary=TRUE", eid))
 			if err != nil {
 				return err
 			}
@@ -409,15 +579,13 @@ func (a *Agent) DownloadIncident(path string, eid string) error {
 		}
 	*/
 
-	os.MkdirAll(path, 0755) // silently ignore errors if already exists
-
 	{
-		phtml, err := a.authorizedNativeGet(fmt.Sprintf("https://secure.emergencyreporting.com/nfirs/print.asp?printtype=2&printtype=3&printtype=4&printtype=5&printtyperadio=5a&eid=%s&printtype=&printOption=&fromsummary=TRUE&cid=&patientcount=&notpayroll=TRUE", eid))
+		phtml, err := a.fetcher().Get(incidentPrintURL(eid))
 		if err != nil {
 			return err
 		}
 
-		err = os.WriteFile(path+string(os.PathSeparator)+"incident.html", phtml, 0644)
+		err = WriteFile(a.output(), sinkPath(path, "incident.html"), phtml)
 		if err != nil {
 			log.Printf("ERR: Was not able to write incident data: %s", err.Error())
 			return nil
@@ -434,18 +602,12 @@ func (a *Agent) DownloadIncident(path string, eid string) error {
 			if !exists {
 				return
 			}
-			data, err := a.authorizedNativeGet("https://secure.emergencyreporting.com" + href)
-			if err != nil {
-				log.Printf("ERR: Was not able to fetch attachment %s: %s", href, err.Error())
-				return
-			}
-
-			// TODO: IMPLEMENT: XXX: Extract the GUID and name the file that
+			// TODO: IMPLEMENT: XXX: Name the file after the attachment
 			// TODO: IMPLEMENT: XXX: Type detection for files?
 
-			err = os.WriteFile(path+string(os.PathSeparator)+fmt.Sprintf("attachment-%03d", aCount), data, 0644)
+			_, err := a.saveAttachment(attachmentKey(href), sinkPath(path, fmt.Sprintf("attachment-%03d", aCount)), "https://secure.emergencyreporting.com"+href)
 			if err != nil {
-				log.Printf("ERR: Was not able to write attachment %s: %s", href, err.Error())
+				log.Printf("ERR: Was not able to save attachment %s: %s", href, err.Error())
 				return
 			}
 			aCount++
@@ -457,33 +619,210 @@ func (a *Agent) DownloadIncident(path string, eid string) error {
 	return nil
 }
 
+// incidentPrintURL is the printable view of an incident, with all of its
+// modules.
+func incidentPrintURL(eid string) string {
+	return fmt.Sprintf("https://secure.emergencyreporting.com/nfirs/print.asp?printtype=2&printtype=3&printtype=4&printtype=5&printtyperadio=5a&eid=%s&printtype=&printOption=&fromsummary=TRUE&cid=&patientcount=&notpayroll=TRUE", eid)
+}
+
+// GetIncidentDetail returns the labelled fields of an incident's printable
+// view, as read by ParseIncidentDetail.
+func (a *Agent) GetIncidentDetail(eid string) (map[string]string, error) {
+	page, err := a.fetcher().Get(incidentPrintURL(eid))
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return ParseIncidentDetail(page)
+}
+
+// ParseIncidentDetail reads the fields of an incident's printable view,
+// where each value sits in the table cell after its label, a cell ending
+// in a colon. A label seen again is numbered, as "Label 2", so that the
+// rows of repeated sections such as units are all kept.
+func ParseIncidentDetail(page []byte) (map[string]string, error) {
+	out := map[string]string{}
+
+	gq, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return out, err
+	}
+
+	gq.Find("tr").Each(func(_ int, tr *goquery.Selection) {
+		cells := tr.ChildrenFiltered("td, th")
+		for i := 0; i+1 < cells.Length(); i++ {
+			label := strings.Join(strings.Fields(cells.Eq(i).Text()), " ")
+			if !strings.HasSuffix(label, ":") || len(label) == 1 {
+				continue
+			}
+			label = strings.TrimSpace(strings.TrimSuffix(label, ":"))
+			value := strings.Join(strings.Fields(cells.Eq(i+1).Text()), " ")
+			if strings.HasSuffix(value, ":") {
+				// An empty field, followed by the next label
+				continue
+			}
+
+			name := label
+			for n := 2; ; n++ {
+				if _, ok := out[name]; !ok {
+					break
+				}
+				name = fmt.Sprintf("%s %d", label, n)
+			}
+			out[name] = value
+			i++
+		}
+	})
+	return out, nil
+}
+
 // exposureform
 // POST https://secure.emergencyreporting.com/nfirs/includes/top_main.asp?csrt=1772698412475071612
 // hidden iid
 // hidden eredirectto
 // hidden eid
 
+// ExportCalendar exports the whole calendar as iCalendar data.
 func (a *Agent) ExportCalendar() ([]byte, error) {
-	v := url.Values{}
-	v.Set("exportType", "ics")
-	v.Set("StartDate", "01/01/2005")
-	v.Set("EndDate", "01/01/2025")
-	v.Set("EntryTypes", "")
+	return a.ExportCalendarRange(DefaultCalendarFrom, time.Time{}, CalendarChunkYear)
+}
 
-	u := "https://secure.emergencyreporting.com/calendar/includes/backends/calendar_export.php?" + v.Encode()
+// ExportCalendarRange exports the calendar entries between from and to as
+// a single iCalendar document. The range is requested a year or a month at
+// a time, so that no single request is large enough to be truncated by the
+// server, and the chunks are merged with events which straddle chunks
+// appearing once. A zero to exports through the end of next year.
+func (a *Agent) ExportCalendarRange(from, to time.Time, chunk CalendarChunk) ([]byte, error) {
+	return a.exportCalendarRange(from, to, chunk, "")
+}
 
-	a.ContextSwitch = ContextDownload
+// ExportCalendarEntryType exports the calendar entries of a single entry
+// type, as listed by GetCalendarEntryTypes, with each event tagged with the
+// type's name.
+func (a *Agent) ExportCalendarEntryType(from, to time.Time, chunk CalendarChunk, t CalendarEntryType) ([]byte, error) {
+	cal, err := a.exportCalendarRange(from, to, chunk, t.ID)
+	if err != nil {
+		return cal, err
+	}
+	return TagCalendar(cal, t.Name), nil
+}
+
+func (a *Agent) exportCalendarRange(from, to time.Time, chunk CalendarChunk, entryTypes string) ([]byte, error) {
+	if to.IsZero() {
+		to = DefaultCalendarTo()
+	}
+	if !to.After(from) {
+		return []byte{}, fmt.Errorf("calendar range %s to %s is empty", from.Format(calendarDateFormat), to.Format(calendarDateFormat))
+	}
+
+	chunks := make([][]byte, 0)
+	for _, r := range chunk.split(from, to) {
+		log.Printf("INFO: Load calendar WS for %s to %s", r[0].Format(calendarDateFormat), r[1].Format(calendarDateFormat))
+		data, err := a.downloadFile(CalendarExportURL(r[0], r[1], entryTypes))
+		if err != nil {
+			return []byte{}, err
+		}
+		chunks = append(chunks, data)
+	}
 
-	log.Printf("INFO: Load calendar WS")
-	oFile, err := a.authorizedDownload(u)
+	return MergeCalendars(chunks...), nil
+}
 
+// downloadFile downloads the file served at u, such as an export which ER
+// only offers as a download, and returns its contents.
+func (a *Agent) downloadFile(u string) ([]byte, error) {
+	fp, err := a.fetcher().Open(u)
 	if err != nil {
-		log.Printf("ERR: %s: %s", err.Error(), oFile)
+		log.Printf("ERR: %s: %s", err.Error(), u)
 		return []byte{}, err
 	}
+	defer fp.Close()
 
-	log.Printf("INFO: temporary file: %s", oFile)
-	defer os.Remove(oFile)
+	return io.ReadAll(fp)
+}
+
+// GetCalendarEntryTypes returns the department's calendar entry types, such
+// as meetings, drills and shifts, from the entry type filter of the
+// calendar page.
+func (a *Agent) GetCalendarEntryTypes() ([]CalendarEntryType, error) {
+	log.Printf("INFO: Load calendar entry types")
+	page, err := a.fetcher().Get(calendarPageURL)
+	if err != nil {
+		return []CalendarEntryType{}, err
+	}
+	return parseCalendarEntryTypes(page)
+}
+
+// parseCalendarEntryTypes reads the entry types from the calendar page,
+// offered as either checkboxes or a select named after EntryTypes.
+func parseCalendarEntryTypes(page []byte) ([]CalendarEntryType, error) {
+	out := make([]CalendarEntryType, 0)
+
+	gq, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return out, err
+	}
+
+	seen := map[string]bool{}
+	add := func(id, name string) {
+		id, name = strings.TrimSpace(id), strings.Join(strings.Fields(name), " ")
+		if id == "" || seen[id] {
+			return
+		}
+		if name == "" {
+			name = id
+		}
+		seen[id] = true
+		out = append(out, CalendarEntryType{ID: id, Name: name})
+	}
+
+	gq.Find("input[type=checkbox]").Each(func(_ int, s *goquery.Selection) {
+		if !isEntryTypeField(s) {
+			return
+		}
+		id, _ := s.Attr("value")
+		name := s.AttrOr("data-name", "")
+		if name == "" {
+			if elID, ok := s.Attr("id"); ok {
+				name = gq.Find("label[for='" + elID + "']").Text()
+			}
+		}
+		if name == "" {
+			name = s.Closest("label").Text()
+		}
+		add(id, name)
+	})
+	gq.Find("select").Each(func(_ int, s *goquery.Selection) {
+		if !isEntryTypeField(s) {
+			return
+		}
+		s.Find("option").Each(func(_ int, o *goquery.Selection) {
+			add(o.AttrOr("value", ""), o.Text())
+		})
+	})
+
+	if len(out) == 0 {
+		return out, fmt.Errorf("no calendar entry types found")
+	}
+	return out, nil
+}
+
+func isEntryTypeField(s *goquery.Selection) bool {
+	for _, attr := range []string{"name", "id"} {
+		if v, ok := s.Attr(attr); ok && strings.Contains(strings.ToLower(v), "entrytype") {
+			return true
+		}
+	}
+	return false
+}
+
+// CalendarExportURL returns the URL of ER's iCalendar export for a range of
+// dates and a comma separated list of entry types (empty for all).
+func CalendarExportURL(from, to time.Time, entryTypes string) string {
+	v := url.Values{}
+	v.Set("exportType", "ics")
+	v.Set("StartDate", from.Format(calendarDateFormat))
+	v.Set("EndDate", to.Format(calendarDateFormat))
+	v.Set("EntryTypes", entryTypes)
 
-	return os.ReadFile(oFile)
+	return "https://secure.emergencyreporting.com/calendar/includes/backends/calendar_export.php?" + v.Encode()
 }
@@ -1,10 +1,10 @@
 package agent
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
-
-	"github.com/jbuchbinder/shims"
 )
 
 func Test_GetAllTrainingClassIDs(t *testing.T) {
@@ -26,7 +26,7 @@ func Test_DownloadTrainingAssets(t *testing.T) {
 		t.Fatalf("ERR: %s", err.Error())
 	}
 
-	err = a.DownloadTrainingAssets(7988356, shims.SingleValueDiscardError(os.Getwd())) // 7983393)
+	err = a.DownloadTrainingAssets(7988356, ".") // 7983393)
 	if err != nil {
 		t.Fatalf("ERR: %s", err.Error())
 	}
@@ -38,7 +38,7 @@ func Test_DownloadTrainingNarrative(t *testing.T) {
 		t.Fatalf("ERR: %s", err.Error())
 	}
 
-	err = a.DownloadTrainingNarrative(5897010, shims.SingleValueDiscardError(os.Getwd())+"/narrative.txt")
+	err = a.DownloadTrainingNarrative(5897010, "narrative.txt")
 	if err != nil {
 		t.Fatalf("ERR: %s", err.Error())
 	}
@@ -50,7 +50,7 @@ func Test_DownloadTrainingAttendance(t *testing.T) {
 		t.Fatalf("ERR: %s", err.Error())
 	}
 
-	err = a.DownloadTrainingAttendance(5897010, shims.SingleValueDiscardError(os.Getwd())+"/attendance.txt")
+	err = a.DownloadTrainingAttendance(5897010, "attendance.txt")
 	if err != nil {
 		t.Fatalf("ERR: %s", err.Error())
 	}
@@ -148,3 +148,56 @@ func Test_ExportCalendar(t *testing.T) {
 
 	t.Logf("INFO: %s", string(data))
 }
+
+func Test_MemoryFetcher_DownloadTrainingReference(t *testing.T) {
+	a, f, dest := testMemoryAgent(t)
+	// Made up sources, as ER's have not been recorded
+	sources, err := ParseTrainingReferenceSources([]byte(`{
+		"categories": {"list": "https://er.example/categories"},
+		"codes": {"list": "https://er.example/codes", "detail": "https://er.example/codes?id={id}"},
+		"resources": {"list": "https://er.example/resources"}
+	}`))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	f.Responses["https://er.example/categories"] = []byte(
+		`{"rows":[{"id":"3","cell":["Company"]},{"id":"4","cell":["Officer"]}]}`)
+	f.Responses["https://er.example/codes"] = []byte(
+		`{"rows":[{"id":"21","cell":["FF1-HOSE","Hose handling","2.0"]},{"id":"22","cell":["FF1-LAD","Ladders","1.0"]}]}`)
+	f.Responses["https://er.example/codes?id=21"] = []byte(
+		`{"code":"FF1-HOSE","description":"Hose handling"}`)
+
+	err = a.DownloadTrainingReference(TrainingReferencePath, sources)
+	if err == nil {
+		t.Fatalf("ERR: expected an error for the missing resources table")
+	}
+
+	b, err := os.ReadFile(filepath.Join(dest, "training", "reference", "codes.json"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	var codes []TrainingReference
+	err = json.Unmarshal(b, &codes)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(codes) != 2 || codes[0].Table != TrainingCodes || len(codes[0].Detail) == 0 || len(codes[1].Detail) != 0 {
+		t.Fatalf("ERR: unexpected codes %#v", codes)
+	}
+
+	if _, err = os.Stat(filepath.Join(dest, "training", "reference", TrainingCategories+".json")); err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	for _, table := range []string{TrainingTemplates, TrainingResources} {
+		if _, err = os.Stat(filepath.Join(dest, "training", "reference", table+".json")); err == nil {
+			t.Fatalf("ERR: %s saved without a source or a response", table)
+		}
+	}
+
+	for _, bad := range []string{`{}`, `{"classes": {"list": "https://er.example/classes"}}`,
+		`{"codes": {"list": "codes.php"}}`, `{"codes": {"list": "https://er.example/codes", "detail": "https://er.example/code"}}`} {
+		if _, err = ParseTrainingReferenceSources([]byte(bad)); err == nil {
+			t.Fatalf("ERR: expected an error for sources %s", bad)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	blobDir        = "blobs"
+	blobIndex      = "blobs/index.json"
+	blobRefSuffix  = ".blob.json"
+	blobPrefixSize = 2
+)
+
+// BlobRef identifies the stored copy of an attachment.
+type BlobRef struct {
+	SHA256      string `json:"sha256"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	// Blob is the name of the stored copy within the export, including the
+	// ".age" suffix when the export is encrypted.
+	Blob string `json:"blob"`
+}
+
+// BlobStore keeps a single copy of each attachment under blobs/, named by
+// its SHA-256, so that a file attached to hundreds of recurring classes or
+// incidents is only stored once. Where the attachment belongs, a hardlink
+// to the blob is made when exporting to a plain directory, and a JSON
+// pointer (the name with ".blob.json" appended) everywhere else.
+//
+// The store also remembers which file GUIDs it has already fetched, and
+// saves that index as blobs/index.json when closed, so they are not
+// downloaded again in this or, for sinks that can be read back (see
+// SinkReader), a later run.
+type BlobStore struct {
+	sink   Sink
+	root   string
+	suffix string
+	guids  map[string]BlobRef
+	stored map[string]bool
+	l      sync.Mutex
+}
+
+// NewBlobStore creates a blob store within an output sink, picking up the
+// index left by a previous export into the same place.
+func NewBlobStore(s Sink) (*BlobStore, error) {
+	b := &BlobStore{
+		sink:   s,
+		guids:  map[string]BlobRef{},
+		stored: map[string]bool{},
+	}
+
+	if ds, ok := s.(*DirSink); ok {
+		b.root = ds.Root
+	}
+	if _, ok := s.(*EncryptingSink); ok {
+		b.suffix = EncryptedSuffix
+	}
+
+	sr, ok := s.(SinkReader)
+	if !ok {
+		return b, nil
+	}
+	data, err := ReadFile(sr, blobIndex)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		// An encrypted index can't be read without an identity; the
+		// blobs are simply fetched again.
+		log.Printf("WARN: Reading %s: %s, starting a new index", blobIndex, err.Error())
+		return b, nil
+	}
+	var index map[string]BlobRef
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return b, fmt.Errorf("%s: %w", blobIndex, err)
+	}
+	for guid, ref := range index {
+		// Only trust entries whose blob survived
+		ok, err := sr.Exists(blobName(ref.SHA256))
+		if err != nil {
+			return b, err
+		}
+		if ok {
+			ref.Blob = blobName(ref.SHA256) + b.suffix
+			b.guids[guid] = ref
+			b.stored[ref.SHA256] = true
+		}
+	}
+	log.Printf("INFO: Loaded %d previously fetched files from %s", len(b.guids), blobIndex)
+	return b, nil
+}
+
+// Lookup returns the blob already stored for a file GUID.
+func (b *BlobStore) Lookup(guid string) (BlobRef, bool) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	ref, ok := b.guids[guid]
+	return ref, ok
+}
+
+// Put stores data as a blob, unless an identical blob is already stored.
+// The name the data is known by helps to determine its content type.
+func (b *BlobStore) Put(name string, data []byte) (BlobRef, error) {
+	sum := sha256Hex(data)
+	ref := BlobRef{
+		SHA256:      sum,
+		Size:        int64(len(data)),
+		ContentType: detectContentType(name, data),
+		Blob:        blobName(sum) + b.suffix,
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.stored[sum] {
+		return ref, nil
+	}
+	err := WriteFile(b.sink, blobName(sum), data)
+	if err != nil {
+		return ref, err
+	}
+	b.stored[sum] = true
+	return ref, nil
+}
+
+// Link makes a blob appear at name.
+func (b *BlobStore) Link(name string, ref BlobRef) error {
+	name, err := cleanSinkName(name)
+	if err != nil {
+		return err
+	}
+
+	if b.root != "" {
+		dst := b.localPath(name)
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		err = os.Link(b.localPath(ref.Blob), dst)
+		if err == nil {
+			return nil
+		}
+		log.Printf("WARN: Hardlinking %s: %s, writing a pointer instead", name, err.Error())
+	}
+
+	data, err := json.MarshalIndent(ref, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(b.sink, name+blobRefSuffix, data)
+}
+
+// Save places the file with the given GUID at name, calling fetch for its
+// contents only if the GUID has not been stored before.
+func (b *BlobStore) Save(guid, name string, fetch func() ([]byte, error)) (BlobRef, error) {
+	ref, ok := b.Lookup(guid)
+	if ok {
+		log.Printf("INFO: %s already stored as %s, skipping download", guid, ref.Blob)
+	} else {
+		data, err := fetch()
+		if err != nil {
+			return ref, err
+		}
+		ref, err = b.Put(name, data)
+		if err != nil {
+			return ref, err
+		}
+		b.l.Lock()
+		b.guids[guid] = ref
+		b.l.Unlock()
+	}
+	return ref, b.Link(name, ref)
+}
+
+// Close writes out the index of fetched GUIDs. It does not close the
+// underlying sink.
+func (b *BlobStore) Close() error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	data, err := json.MarshalIndent(b.guids, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(b.sink, blobIndex, data)
+}
+
+// blobName gives the name a blob is written under, before any encryption
+// suffix.
+func blobName(sum string) string {
+	return sinkPath(blobDir, sum[:blobPrefixSize], sum)
+}
+
+func (b *BlobStore) localPath(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func Test_BlobStore(t *testing.T) {
+	f := NewMemoryFetcher()
+	for _, class := range []string{"42", "43"} {
+		f.Responses["https://secure.emergencyreporting.com/training/ws/class_files.php?classid="+class+"&_function=list_json"] = []byte(`{
+			"rows": [{"id": "7", "cell": ["Hose Lays.pptx", "Slides", "Members"]}]}`)
+		f.Responses["https://secure.emergencyreporting.com/training/ws/class_files.php?classid="+class+"&id=7&_function=detail"] = []byte(
+			`{"accesslevel":"1","description":"Slides","fileguid":"AAA","name":"Hose Lays.pptx","url":""}`)
+	}
+	download := "https://secure.emergencyreporting.com/filedownload.php?fileguid=AAA&contentdisposition=attachment"
+	f.Responses[download] = []byte("pptx data")
+
+	dest := t.TempDir()
+	sink := NewDirSink(dest)
+	blobs, err := NewBlobStore(sink)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	a := &Agent{Fetcher: f, Output: sink, Blobs: blobs}
+	for _, class := range []int{42, 43} {
+		err = a.DownloadTrainingAssets(class, fmt.Sprintf("training/%d", class))
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+	}
+	err = blobs.Close()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	fetched := 0
+	for _, u := range f.Requests {
+		if u == download {
+			fetched++
+		}
+	}
+	if fetched != 1 {
+		t.Fatalf("ERR: expected one download, got %d", fetched)
+	}
+
+	st1, err := os.Stat(filepath.Join(dest, "training", "42", "Hose Lays.pptx"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	st2, err := os.Stat(filepath.Join(dest, "training", "43", "Hose Lays.pptx"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if !os.SameFile(st1, st2) {
+		t.Fatalf("ERR: expected both classes to link the same blob")
+	}
+
+	// A later run into the same directory does not fetch the file again
+	again, err := NewBlobStore(sink)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	ref, ok := again.Lookup("AAA")
+	if !ok || ref.SHA256 != sha256Hex([]byte("pptx data")) {
+		t.Fatalf("ERR: index not loaded: %#v", ref)
+	}
+}
+
+// wrappedSink hides a DirSink from the blob store, as any other sink would.
+type wrappedSink struct {
+	Sink
+}
+
+func Test_BlobStorePointer(t *testing.T) {
+	dest := t.TempDir()
+	b, err := NewBlobStore(wrappedSink{NewDirSink(dest)})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	for _, name := range []string{"incident/1/attachment-000", "incident/2/attachment-000"} {
+		_, err = b.Save("BBB", name, func() ([]byte, error) { return []byte("scan"), nil })
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dest, "incident", "2", "attachment-000"+blobRefSuffix))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	var ref BlobRef
+	err = json.Unmarshal(data, &ref)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	blob, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(ref.Blob)))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if string(blob) != "scan" || ref.Size != 4 {
+		t.Fatalf("ERR: unexpected blob %#v = %q", ref, string(blob))
+	}
+}
+
+func Test_BlobStoreS3Reload(t *testing.T) {
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case "GET", "HEAD":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewS3Sink(srv.URL, "minio", "minio123", false, "retention", "er-export")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	b, err := NewBlobStore(s)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	_, err = b.Save("CCC", "incident/1/attachment-000", func() ([]byte, error) { return []byte("scan"), nil })
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	again, err := NewBlobStore(s)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	_, err = again.Save("CCC", "incident/2/attachment-000", func() ([]byte, error) {
+		return nil, fmt.Errorf("fetched again")
+	})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+}
+
+func Test_BlobStoreEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	dest := t.TempDir()
+	s := NewEncryptingSink(NewDirSink(dest), id.Recipient())
+	b, err := NewBlobStore(s)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	ref, err := b.Save("DDD", "incident/1/attachment-000", func() ([]byte, error) { return []byte("scan"), nil })
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	// The pointer names the file actually written
+	if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(ref.Blob))); err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	s.Identities = []age.Identity{id}
+	again, err := NewBlobStore(s)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if got, ok := again.Lookup("DDD"); !ok || got.Blob != ref.Blob {
+		t.Fatalf("ERR: index not loaded: %#v", got)
+	}
+}
@@ -0,0 +1,366 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	caldavProdID = "-//dayvillefire//er-scraper//EN"
+	// caldavHashProp marks the objects we manage, with a hash of their
+	// content. Servers are free to reformat what they store, so comparing
+	// the hash rather than the data keeps unchanged events from being
+	// rewritten on every run. DTSTAMP is left out of the hash, as exports
+	// stamp it afresh each time.
+	caldavHashProp = "X-ER-SCRAPER-HASH"
+)
+
+// CalDAVClient keeps a CalDAV calendar collection in step with the events
+// exported from ER.
+type CalDAVClient struct {
+	// URL is the calendar collection, such as
+	// https://dav.example.com/user/calendar/
+	URL      string
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// CalDAVSyncResult counts what a sync changed.
+type CalDAVSyncResult struct {
+	Created   int
+	Updated   int
+	Deleted   int
+	Unchanged int
+}
+
+func NewCalDAVClient(collection, username, password string) *CalDAVClient {
+	if !strings.HasSuffix(collection, "/") {
+		collection += "/"
+	}
+	return &CalDAVClient{
+		URL:      collection,
+		Username: username,
+		Password: password,
+		Client:   &http.Client{},
+	}
+}
+
+// caldavObject is a calendar object resource in the collection.
+type caldavObject struct {
+	href string
+	etag string
+	uid  string
+	hash string
+	// start is the DTSTART of the object's event (of the series rather
+	// than an exception), or zero when it cannot be read.
+	start time.Time
+}
+
+// Sync makes the collection hold the events of cal, one object per UID
+// (with its recurrence exceptions), creating and updating objects as
+// needed. cal covers the events starting from from until to (zero for no
+// end), so only objects of earlier syncs starting within that range are
+// deleted when their UIDs are no longer exported; nothing is deleted when
+// cal has no events at all, which is more likely a failed export than an
+// empty calendar. Objects which were not created by a sync are left alone.
+func (c *CalDAVClient) Sync(cal []byte, from, to time.Time) (CalDAVSyncResult, error) {
+	var res CalDAVSyncResult
+
+	objects := calendarObjects(cal)
+
+	existing, err := c.list()
+	if err != nil {
+		return res, err
+	}
+	byUID := map[string]caldavObject{}
+	for _, o := range existing {
+		if o.hash != "" {
+			byUID[o.uid] = o
+		}
+	}
+
+	uids := make([]string, 0, len(objects))
+	for uid := range objects {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	for _, uid := range uids {
+		data := objects[uid]
+		hash := caldavHash(data)
+		body := caldavStamp(data, hash)
+
+		cur, ok := byUID[uid]
+		delete(byUID, uid)
+		switch {
+		case !ok:
+			err = c.put(c.URL+url.PathEscape(SafeFilename(uid))+".ics", body, "")
+			res.Created++
+		case cur.hash != hash:
+			err = c.put(cur.href, body, cur.etag)
+			res.Updated++
+		default:
+			res.Unchanged++
+		}
+		if err != nil {
+			return res, fmt.Errorf("event %s: %w", uid, err)
+		}
+	}
+
+	if len(objects) == 0 && len(byUID) > 0 {
+		log.Printf("WARN: CalDAV sync: the export has no events, not deleting the %d already synced", len(byUID))
+		byUID = nil
+	}
+	for _, o := range byUID {
+		if o.start.IsZero() || o.start.Before(from) || (!to.IsZero() && !o.start.Before(to)) {
+			// Outside the exported range, so its absence means nothing
+			continue
+		}
+		err = c.delete(o.href, o.etag)
+		if err != nil {
+			return res, fmt.Errorf("event %s: %w", o.uid, err)
+		}
+		res.Deleted++
+	}
+
+	log.Printf("INFO: CalDAV sync: %d created, %d updated, %d deleted, %d unchanged",
+		res.Created, res.Updated, res.Deleted, res.Unchanged)
+	return res, nil
+}
+
+// calendarObjects splits a calendar into one calendar per UID, each with
+// the time zones its events use.
+func calendarObjects(cal []byte) map[string][]byte {
+	_, comps := splitCalendar(cal)
+
+	zones := map[string]calendarComponent{}
+	events := map[string][]calendarComponent{}
+	for _, c := range comps {
+		switch c.kind {
+		case "VTIMEZONE":
+			for _, line := range c.lines {
+				if name, _, value := splitCalendarLine(line); name == "TZID" {
+					zones[value] = c
+				}
+			}
+		case "VEVENT":
+			uid := ""
+			for _, line := range c.lines {
+				if name, _, value := splitCalendarLine(line); name == "UID" {
+					uid = value
+					break
+				}
+			}
+			if uid != "" {
+				events[uid] = append(events[uid], c)
+			}
+		}
+	}
+
+	out := map[string][]byte{}
+	for uid, evs := range events {
+		used := map[string]bool{}
+		for _, e := range evs {
+			for _, line := range e.lines {
+				if _, params, _ := splitCalendarLine(line); params["TZID"] != "" {
+					used[params["TZID"]] = true
+				}
+			}
+		}
+		tzids := make([]string, 0, len(used))
+		for tzid := range used {
+			tzids = append(tzids, tzid)
+		}
+		sort.Strings(tzids)
+
+		var b bytes.Buffer
+		writeCalendarLine(&b, "BEGIN:VCALENDAR")
+		writeCalendarLine(&b, "VERSION:2.0")
+		writeCalendarLine(&b, "PRODID:"+caldavProdID)
+		for _, tzid := range tzids {
+			if z, ok := zones[tzid]; ok {
+				for _, line := range z.lines {
+					writeCalendarLine(&b, line)
+				}
+			}
+		}
+		for _, e := range evs {
+			for _, line := range e.lines {
+				writeCalendarLine(&b, line)
+			}
+		}
+		writeCalendarLine(&b, "END:VCALENDAR")
+		out[uid] = b.Bytes()
+	}
+	return out
+}
+
+// caldavHash hashes a calendar object, leaving out its DTSTAMPs.
+func caldavHash(data []byte) string {
+	var b bytes.Buffer
+	for _, line := range unfoldCalendarLines(data) {
+		if name, _, _ := splitCalendarLine(line); name == "DTSTAMP" {
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	return sha256Hex(b.Bytes())
+}
+
+// caldavStamp adds the content hash to a calendar object, right after its
+// PRODID.
+func caldavStamp(data []byte, hash string) []byte {
+	prod := "PRODID:" + caldavProdID + "\r\n"
+	return bytes.Replace(data, []byte(prod), []byte(prod+caldavHashProp+":"+hash+"\r\n"), 1)
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ETag         string `xml:"getetag"`
+				CalendarData string `xml:"calendar-data"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const caldavQuery = `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <D:getetag/>
+    <C:calendar-data/>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT"/>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+
+// list returns the event objects in the collection.
+func (c *CalDAVClient) list() ([]caldavObject, error) {
+	req, err := http.NewRequest("REPORT", c.URL, strings.NewReader(caldavQuery))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	body, err := c.do(req, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms davMultistatus
+	err = xml.Unmarshal(body, &ms)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CalDAV REPORT response: %w", err)
+	}
+
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]caldavObject, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := base.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		o := caldavObject{href: href.String()}
+		for _, ps := range r.Propstat {
+			if ps.Status != "" && !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ETag != "" {
+				o.etag = ps.Prop.ETag
+			}
+			if evs, err := ParseCalendar([]byte(ps.Prop.CalendarData)); err == nil {
+				for i, ev := range evs {
+					// The series itself rather than an exception to it
+					if i == 0 || ev.RecurrenceID == nil {
+						o.start = ev.Start
+					}
+					if ev.RecurrenceID == nil {
+						break
+					}
+				}
+			}
+			for _, line := range unfoldCalendarLines([]byte(ps.Prop.CalendarData)) {
+				name, _, value := splitCalendarLine(line)
+				switch {
+				case name == "UID" && o.uid == "":
+					o.uid = value
+				case name == caldavHashProp:
+					o.hash = value
+				}
+			}
+		}
+		if o.uid != "" {
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+
+func (c *CalDAVClient) put(href string, data []byte, etag string) error {
+	req, err := http.NewRequest("PUT", href, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/calendar; charset=utf-8")
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	_, err = c.do(req, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+func (c *CalDAVClient) delete(href, etag string) error {
+	req, err := http.NewRequest("DELETE", href, nil)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	_, err = c.do(req, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	return err
+}
+
+func (c *CalDAVClient) do(req *http.Request, ok ...int) ([]byte, error) {
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return body, nil
+		}
+	}
+	return body, fmt.Errorf("CalDAV %s %s: %s", req.Method, req.URL, resp.Status)
+}
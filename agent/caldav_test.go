@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// caldavStandIn is just enough of a CalDAV server to sync against.
+type caldavStandIn struct {
+	mu      sync.Mutex
+	objects map[string]string
+	etags   map[string]string
+	n       int
+}
+
+func (s *caldavStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := r.URL.Path
+	switch r.Method {
+	case "REPORT":
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">`)
+		for href, data := range s.objects {
+			b.WriteString("<D:response><D:href>" + href + "</D:href><D:propstat><D:prop><D:getetag>" +
+				s.etags[href] + "</D:getetag><C:calendar-data>")
+			xml.EscapeText(&b, []byte(data))
+			b.WriteString("</C:calendar-data></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+		}
+		b.WriteString("</D:multistatus>")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(b.String()))
+	case "PUT":
+		_, exists := s.objects[p]
+		if (r.Header.Get("If-None-Match") == "*" && exists) ||
+			(r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != s.etags[p]) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		s.n++
+		s.objects[p] = string(data)
+		s.etags[p] = fmt.Sprintf(`"%d"`, s.n)
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "DELETE":
+		if _, ok := s.objects[p]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.objects, p)
+		delete(s.etags, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func Test_CalDAVSync(t *testing.T) {
+	dav := &caldavStandIn{
+		objects: map[string]string{
+			"/cal/personal.ics": "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:personal\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+		},
+		etags: map[string]string{"/cal/personal.ics": `"0"`},
+	}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+
+	tz := "BEGIN:VTIMEZONE\r\nTZID:America/New_York\r\nEND:VTIMEZONE\r\n"
+	cal := func(events ...string) []byte {
+		return []byte("BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" + tz + strings.Join(events, "") + "END:VCALENDAR\r\n")
+	}
+	drill := "BEGIN:VEVENT\r\nUID:a@er\r\nDTSTART;TZID=America/New_York:20240105T190000\r\nRRULE:FREQ=WEEKLY\r\nEND:VEVENT\r\n"
+	moved := "BEGIN:VEVENT\r\nUID:a@er\r\nRECURRENCE-ID;TZID=America/New_York:20240112T190000\r\nDTSTART;TZID=America/New_York:20240113T190000\r\nEND:VEVENT\r\n"
+	pump := "BEGIN:VEVENT\r\nUID:b@er\r\nDTSTAMP:20240101T000000Z\r\nDTSTART:20240301T230000Z\r\nSUMMARY:Pump test\r\nEND:VEVENT\r\n"
+	meeting := "BEGIN:VEVENT\r\nUID:c@er\r\nDTSTART:20240201T230000Z\r\nSUMMARY:Meeting\r\nEND:VEVENT\r\n"
+	old := "BEGIN:VEVENT\r\nUID:d@er\r\nDTSTART:20230201T230000Z\r\nSUMMARY:Old meeting\r\nEND:VEVENT\r\n"
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCalDAVClient(srv.URL+"/cal", "", "")
+
+	res, err := c.Sync(cal(old), time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), from)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	res, err = c.Sync(cal(drill, moved, pump, meeting), from, to)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if res != (CalDAVSyncResult{Created: 3}) {
+		t.Fatalf("ERR: unexpected first sync %+v", res)
+	}
+	obj := dav.objects["/cal/a@er.ics"]
+	if strings.Count(obj, "BEGIN:VEVENT") != 2 || !strings.Contains(obj, "TZID:America/New_York\r\n") {
+		t.Fatalf("ERR: unexpected object %q", obj)
+	}
+	if strings.Contains(dav.objects["/cal/b@er.ics"], "VTIMEZONE") {
+		t.Fatalf("ERR: unused time zone in %q", dav.objects["/cal/b@er.ics"])
+	}
+
+	// A fresh DTSTAMP alone is no change
+	pump = strings.Replace(pump, "DTSTAMP:20240101T000000Z", "DTSTAMP:20240601T000000Z", 1)
+	res, err = c.Sync(cal(drill, moved, pump, meeting), from, to)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if res != (CalDAVSyncResult{Unchanged: 3}) {
+		t.Fatalf("ERR: unexpected repeated sync %+v", res)
+	}
+
+	pump = strings.Replace(pump, "Pump test", "Pump test (annual)", 1)
+	res, err = c.Sync(cal(drill, moved, pump), from, to)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if res != (CalDAVSyncResult{Updated: 1, Deleted: 1, Unchanged: 1}) {
+		t.Fatalf("ERR: unexpected changed sync %+v", res)
+	}
+	if _, ok := dav.objects["/cal/c@er.ics"]; ok {
+		t.Fatalf("ERR: removed event was not deleted")
+	}
+	if !strings.Contains(dav.objects["/cal/b@er.ics"], "Pump test (annual)") {
+		t.Fatalf("ERR: event was not updated")
+	}
+	if _, ok := dav.objects["/cal/personal.ics"]; !ok {
+		t.Fatalf("ERR: event not created by a sync was deleted")
+	}
+	if _, ok := dav.objects["/cal/d@er.ics"]; !ok {
+		t.Fatalf("ERR: event outside the synced range was deleted")
+	}
+
+	// An empty export deletes nothing
+	res, err = c.Sync(cal(), from, to)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if res != (CalDAVSyncResult{}) || len(dav.objects) != 4 {
+		t.Fatalf("ERR: unexpected empty sync %+v, %d objects left", res, len(dav.objects))
+	}
+}
@@ -0,0 +1,535 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	calendarDateFormat = "01/02/2006"
+	calendarLineLength = 75
+	// calendarEntryTypeProp carries an event's ER entry type, which ER's
+	// export itself does not include.
+	calendarEntryTypeProp = "X-ER-ENTRY-TYPE"
+)
+
+// CalendarEntryType is a kind of calendar entry, such as a meeting or a
+// drill, which the calendar can be filtered by.
+type CalendarEntryType struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CalendarChunk is how much of the calendar is requested at a time.
+type CalendarChunk int
+
+const (
+	CalendarChunkYear CalendarChunk = iota
+	CalendarChunkMonth
+)
+
+// DefaultCalendarFrom is where calendar exports start when not told
+// otherwise, before any department's data in ER.
+var DefaultCalendarFrom = time.Date(2005, 1, 1, 0, 0, 0, 0, time.Local)
+
+// DefaultCalendarTo is the end of next year, to take in events which have
+// already been scheduled.
+func DefaultCalendarTo() time.Time {
+	return time.Date(time.Now().Year()+2, 1, 1, 0, 0, 0, 0, time.Local)
+}
+
+// ParseCalendarChunk parses a chunk size name, "year" or "month".
+func ParseCalendarChunk(s string) (CalendarChunk, error) {
+	switch strings.ToLower(s) {
+	case "", "year":
+		return CalendarChunkYear, nil
+	case "month":
+		return CalendarChunkMonth, nil
+	}
+	return CalendarChunkYear, fmt.Errorf("unknown calendar chunk %q, expected year or month", s)
+}
+
+// split divides [from, to) into consecutive ranges aligned to calendar
+// years or months.
+func (c CalendarChunk) split(from, to time.Time) [][2]time.Time {
+	out := make([][2]time.Time, 0)
+	for start := from; start.Before(to); {
+		var next time.Time
+		if c == CalendarChunkMonth {
+			next = time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, start.Location())
+		} else {
+			next = time.Date(start.Year()+1, 1, 1, 0, 0, 0, 0, start.Location())
+		}
+		if next.After(to) {
+			next = to
+		}
+		out = append(out, [2]time.Time{start, next})
+		start = next
+	}
+	return out
+}
+
+// CalendarEvent is a single VEVENT from a calendar export.
+type CalendarEvent struct {
+	UID         string   `json:"uid"`
+	Summary     string   `json:"summary"`
+	Description string   `json:"description,omitempty"`
+	Location    string   `json:"location,omitempty"`
+	Categories  []string `json:"categories,omitempty"`
+	// EntryType is the ER calendar entry type, for events exported by type.
+	EntryType string `json:"entry_type,omitempty"`
+	// Start and End are in the event's own time zone, named by TimeZone
+	// ("UTC" for UTC times, empty for floating times and dates).
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	TimeZone string    `json:"time_zone,omitempty"`
+	AllDay   bool      `json:"all_day,omitempty"`
+
+	// RRule and ExDates describe a recurring event. RecurrenceID marks one
+	// occurrence of a recurring event, either an exception to the series
+	// or an occurrence produced by ExpandEvents.
+	RRule        string      `json:"rrule,omitempty"`
+	ExDates      []time.Time `json:"exdates,omitempty"`
+	RecurrenceID *time.Time  `json:"recurrence_id,omitempty"`
+
+	// Props holds every property of the event as found, by name.
+	Props map[string][]string `json:"-"`
+}
+
+// ParseCalendar extracts the events from an iCalendar (or vCalendar)
+// document, such as the one returned by ExportCalendar.
+func ParseCalendar(data []byte) ([]CalendarEvent, error) {
+	out := make([]CalendarEvent, 0)
+	zones := newCalendarZones(data)
+
+	var ev *CalendarEvent
+	var duration string
+	var tzErr error
+	depth := 0
+	for _, line := range unfoldCalendarLines(data) {
+		name, params, value := splitCalendarLine(line)
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			ev = &CalendarEvent{Props: map[string][]string{}}
+			duration = ""
+			tzErr = nil
+			depth = 0
+			continue
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			if ev != nil {
+				if tzErr != nil {
+					log.Printf("ERR: Event %s (%s): %s, times read as UTC", ev.UID, ev.Summary, tzErr.Error())
+				}
+				if ev.End.IsZero() {
+					ev.End = calendarEventEnd(ev.Start, ev.AllDay, duration)
+				}
+				out = append(out, *ev)
+			}
+			ev = nil
+			continue
+		case ev == nil:
+			continue
+		case name == "BEGIN":
+			// Skip nested components such as VALARM
+			depth++
+			continue
+		case name == "END":
+			depth--
+			continue
+		case depth > 0:
+			continue
+		}
+
+		ev.Props[name] = append(ev.Props[name], value)
+
+		var err error
+		switch name {
+		case "UID":
+			ev.UID = value
+		case "SUMMARY":
+			ev.Summary = unescapeCalendarText(value)
+		case "DESCRIPTION":
+			ev.Description = unescapeCalendarText(value)
+		case "LOCATION":
+			ev.Location = unescapeCalendarText(value)
+		case "CATEGORIES":
+			for _, c := range splitCalendarList(value) {
+				if c != "" {
+					ev.Categories = append(ev.Categories, c)
+				}
+			}
+		case "DTSTART":
+			ev.Start, ev.AllDay, err = parseCalendarTime(value, params, zones)
+			ev.TimeZone = calendarTimeZone(value, params)
+		case "DTEND":
+			ev.End, _, err = parseCalendarTime(value, params, zones)
+		case "DURATION":
+			duration = value
+		case "RRULE":
+			ev.RRule = value
+		case "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				var t time.Time
+				t, _, err = parseCalendarTime(v, params, zones)
+				if !t.IsZero() {
+					ev.ExDates = append(ev.ExDates, t)
+				}
+			}
+		case "RECURRENCE-ID":
+			var t time.Time
+			t, _, err = parseCalendarTime(value, params, zones)
+			ev.RecurrenceID = &t
+		case calendarEntryTypeProp:
+			ev.EntryType = unescapeCalendarText(value)
+		}
+		if err != nil && tzErr == nil {
+			tzErr = err
+		}
+	}
+
+	return out, nil
+}
+
+// calendarEventEnd works out the end of an event without a DTEND, from its
+// DURATION or, failing that, the defaults of RFC 5545: a day for dates and
+// no time at all for times.
+func calendarEventEnd(start time.Time, allDay bool, duration string) time.Time {
+	if d, ok := parseCalendarDuration(duration); ok {
+		return start.Add(d)
+	}
+	if allDay {
+		return start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+// parseCalendarDuration parses an RFC 5545 duration such as "PT1H30M",
+// "P1D" or "-P1W".
+func parseCalendarDuration(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	sign := time.Duration(1)
+	switch s[0] {
+	case '-':
+		sign = -1
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") {
+		return 0, false
+	}
+
+	var d time.Duration
+	n := 0
+	inTime := false
+	for _, c := range s[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + int(c-'0')
+			continue
+		case c == 'T':
+			inTime = true
+		case c == 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, false
+		}
+		n = 0
+	}
+	return sign * d, true
+}
+
+// unfoldCalendarLines joins continuation lines, which start with a space or
+// tab, onto the line before them.
+func unfoldCalendarLines(data []byte) []string {
+	out := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(out) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			out[len(out)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// splitCalendarLine splits "NAME;PARAM=VALUE:value" into its parts, with
+// the name and parameter names upper cased.
+func splitCalendarLine(line string) (string, map[string]string, string) {
+	params := map[string]string{}
+
+	// The value starts at the first colon outside a quoted parameter
+	quoted := false
+	idx := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c == ':' && !quoted {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return strings.ToUpper(line), params, ""
+	}
+
+	parts := strings.Split(line[:idx], ";")
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return strings.ToUpper(parts[0]), params, line[idx+1:]
+}
+
+func unescapeCalendarText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+func escapeCalendarText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(s)
+}
+
+// splitCalendarList splits a comma separated value, honoring escaped commas.
+func splitCalendarList(s string) []string {
+	out := make([]string, 0)
+	var cur strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			cur.WriteByte('\\')
+			cur.WriteByte(s[i+1])
+			i++
+		case s[i] == ',':
+			out = append(out, unescapeCalendarText(strings.TrimSpace(cur.String())))
+			cur.Reset()
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+	return append(out, unescapeCalendarText(strings.TrimSpace(cur.String())))
+}
+
+// calendarTimeZone names the time zone of a DATE-TIME value.
+func calendarTimeZone(value string, params map[string]string) string {
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == 8:
+		return ""
+	case strings.HasSuffix(value, "Z"):
+		return "UTC"
+	}
+	return params["TZID"]
+}
+
+// parseCalendarTime parses a DATE or DATE-TIME value, returning whether it
+// was a plain date. Floating times are taken as local time. A TZID that
+// neither the zone database nor the calendar's VTIMEZONEs define is an
+// error, with the time read as UTC.
+func parseCalendarTime(value string, params map[string]string, zones *calendarZones) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, time.Local)
+		if err != nil {
+			return time.Time{}, true, nil
+		}
+		return t, true, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, _ := time.Parse("20060102T150405Z", value)
+		return t, false, nil
+	}
+
+	loc := time.Local
+	var err error
+	if tzid := params["TZID"]; tzid != "" {
+		loc, err = zones.location(tzid)
+		if err != nil {
+			loc = time.UTC
+		}
+	}
+	t, _ := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// calendarComponent is a top level component of a calendar, such as a
+// VEVENT or VTIMEZONE, as its unfolded lines from BEGIN to END.
+type calendarComponent struct {
+	kind  string
+	lines []string
+}
+
+// key identifies a component across documents, or is empty when the
+// component cannot be identified and must always be kept.
+func (c calendarComponent) key() string {
+	var uid, rid, tzid string
+	depth := 0
+	for _, line := range c.lines {
+		name, _, value := splitCalendarLine(line)
+		switch {
+		case name == "BEGIN":
+			depth++
+		case name == "END":
+			depth--
+		case depth != 1:
+		case name == "UID":
+			uid = value
+		case name == "RECURRENCE-ID":
+			rid = value
+		case name == "TZID":
+			tzid = value
+		}
+	}
+	switch {
+	case c.kind == "VTIMEZONE" && tzid != "":
+		return c.kind + " " + tzid
+	case uid != "":
+		return c.kind + " " + uid + " " + rid
+	}
+	return ""
+}
+
+// splitCalendar returns the properties of the VCALENDAR itself and its
+// components.
+func splitCalendar(data []byte) ([]string, []calendarComponent) {
+	props := make([]string, 0)
+	comps := make([]calendarComponent, 0)
+
+	depth := 0
+	var cur *calendarComponent
+	for _, line := range unfoldCalendarLines(data) {
+		name, _, value := splitCalendarLine(line)
+		switch name {
+		case "BEGIN":
+			depth++
+			if depth == 2 {
+				cur = &calendarComponent{kind: strings.ToUpper(value)}
+			}
+		case "END":
+			depth--
+		}
+
+		switch {
+		case cur != nil:
+			cur.lines = append(cur.lines, line)
+			if depth == 1 {
+				comps = append(comps, *cur)
+				cur = nil
+			}
+		case depth == 1 && name != "BEGIN":
+			props = append(props, line)
+		}
+	}
+	return props, comps
+}
+
+// MergeCalendars merges iCalendar documents into one, keeping the calendar
+// properties of the first and a single copy of each event (by UID and
+// RECURRENCE-ID) and time zone (by TZID).
+func MergeCalendars(cals ...[]byte) []byte {
+	var props []string
+	comps := make([]calendarComponent, 0)
+	seen := map[string]bool{}
+
+	for _, cal := range cals {
+		p, cs := splitCalendar(cal)
+		if props == nil && len(p) > 0 {
+			props = p
+		}
+		for _, c := range cs {
+			if k := c.key(); k != "" {
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+			}
+			comps = append(comps, c)
+		}
+	}
+	if props == nil {
+		props = []string{"VERSION:2.0", "PRODID:-//dayvillefire//er-scraper//EN"}
+	}
+
+	// Time zones must be defined before the events which use them
+	var b bytes.Buffer
+	writeCalendarLine(&b, "BEGIN:VCALENDAR")
+	for _, line := range props {
+		writeCalendarLine(&b, line)
+	}
+	for _, pass := range []bool{true, false} {
+		for _, c := range comps {
+			if (c.kind == "VTIMEZONE") != pass {
+				continue
+			}
+			for _, line := range c.lines {
+				writeCalendarLine(&b, line)
+			}
+		}
+	}
+	writeCalendarLine(&b, "END:VCALENDAR")
+	return b.Bytes()
+}
+
+// TagCalendar marks every event of a calendar as being of an entry type,
+// replacing any earlier tag.
+func TagCalendar(cal []byte, entryType string) []byte {
+	var b bytes.Buffer
+	depth := 0
+	for _, line := range unfoldCalendarLines(cal) {
+		name, _, value := splitCalendarLine(line)
+		switch name {
+		case "BEGIN":
+			depth++
+		case "END":
+			depth--
+		case calendarEntryTypeProp:
+			if depth == 2 {
+				continue
+			}
+		}
+		writeCalendarLine(&b, line)
+		if name == "BEGIN" && depth == 2 && strings.EqualFold(value, "VEVENT") {
+			writeCalendarLine(&b, calendarEntryTypeProp+":"+escapeCalendarText(entryType))
+		}
+	}
+	return b.Bytes()
+}
+
+// writeCalendarLine writes a content line, folded at 75 octets without
+// splitting UTF-8 sequences.
+func writeCalendarLine(b *bytes.Buffer, line string) {
+	limit := calendarLineLength
+	for len(line) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		b.WriteString(line[:n])
+		b.WriteString("\r\n ")
+		line = line[n:]
+		// Continuation lines carry the leading space
+		limit = calendarLineLength - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// CalendarCSVColumns are the columns of WriteEventsCSV. The leading ones
+// follow the layout most calendar tools accept for bulk imports.
+var CalendarCSVColumns = []string{
+	"Subject", "Start Date", "Start Time", "End Date", "End Time",
+	"All Day Event", "Description", "Location",
+	"UID", "Time Zone", "Categories", "Recurrence Rule", "Recurrence ID",
+	"Entry Type",
+}
+
+// WriteEventsJSON writes events as a JSON array.
+func WriteEventsJSON(w io.Writer, evs []CalendarEvent) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(evs)
+}
+
+// WriteEventsCSV writes events as CSV, one row per event, with times in
+// each event's own time zone.
+func WriteEventsCSV(w io.Writer, evs []CalendarEvent) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(CalendarCSVColumns)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range evs {
+		end := e.End
+		if e.AllDay && end.After(e.Start) {
+			// iCalendar all day ends are exclusive, spreadsheets' inclusive
+			end = end.AddDate(0, 0, -1)
+		}
+
+		allDay := "False"
+		startTime, endTime := csvTime(e.Start), csvTime(end)
+		if e.AllDay {
+			allDay = "True"
+			startTime, endTime = "", ""
+		}
+
+		rid := ""
+		if e.RecurrenceID != nil {
+			rid = e.RecurrenceID.Format(time.RFC3339)
+		}
+
+		err = cw.Write([]string{
+			e.Summary, csvDate(e.Start), startTime, csvDate(end), endTime,
+			allDay, e.Description, e.Location,
+			e.UID, e.TimeZone, strings.Join(e.Categories, ","), e.RRule, rid,
+			e.EntryType,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("01/02/2006")
+}
+
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("03:04 PM")
+}
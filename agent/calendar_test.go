@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseCalendar(t *testing.T) {
+	data := []byte("BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:evt-1@emergencyreporting.com\r\n" +
+		"SUMMARY:Hose drill\\, station 1\r\n" +
+		"DESCRIPTION:Bring gear.\\nMeet at the \r\n" +
+		" bay.\r\n" +
+		"CATEGORIES:Training,Drill\r\n" +
+		"DTSTART;TZID=America/New_York:20240105T190000\r\n" +
+		"DTEND;TZID=America/New_York:20240105T210000\r\n" +
+		"RRULE:FREQ=WEEKLY;COUNT=4\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:evt-2\r\n" +
+		"SUMMARY:Holiday\r\n" +
+		"DTSTART;VALUE=DATE:20241225\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n")
+
+	evs, err := ParseCalendar(data)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(evs) != 2 {
+		t.Fatalf("ERR: expected 2 events, got %d", len(evs))
+	}
+
+	e := evs[0]
+	if e.Summary != "Hose drill, station 1" || e.Description != "Bring gear.\nMeet at the bay." {
+		t.Fatalf("ERR: unexpected text %q / %q", e.Summary, e.Description)
+	}
+	if len(e.Categories) != 2 || e.Categories[1] != "Drill" || e.RRule != "FREQ=WEEKLY;COUNT=4" {
+		t.Fatalf("ERR: unexpected event %#v", e)
+	}
+	if !e.Start.Equal(time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)) || e.End.Sub(e.Start) != 2*time.Hour {
+		t.Fatalf("ERR: unexpected times %s - %s", e.Start, e.End)
+	}
+	if !evs[1].AllDay || evs[1].Start.Day() != 25 {
+		t.Fatalf("ERR: unexpected all day event %#v", evs[1])
+	}
+}
+
+func Test_CalendarChunks(t *testing.T) {
+	from := time.Date(2023, 11, 15, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	years := CalendarChunkYear.split(from, to)
+	if len(years) != 3 || !years[0][1].Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) || !years[2][1].Equal(to) {
+		t.Fatalf("ERR: unexpected year chunks %v", years)
+	}
+	months := CalendarChunkMonth.split(from, to)
+	if len(months) != 15 || !months[0][0].Equal(from) || !months[1][0].Equal(time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("ERR: unexpected month chunks %v", months)
+	}
+}
+
+func Test_ExportCalendarRange(t *testing.T) {
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)
+	mid := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+
+	tz := "BEGIN:VTIMEZONE\r\nTZID:America/New_York\r\nEND:VTIMEZONE\r\n"
+	long := "DESCRIPTION:" + strings.Repeat("Ladder operations ", 10) + "\r\n"
+	a, f, _ := testMemoryAgent(t)
+	f.Responses[CalendarExportURL(from, mid, "")] = []byte("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//ER//EN\r\n" + tz +
+		"BEGIN:VEVENT\r\nUID:a\r\nSUMMARY:New Year drill\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:b\r\n" + long + "END:VEVENT\r\nEND:VCALENDAR\r\n")
+	f.Responses[CalendarExportURL(mid, to, "")] = []byte("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//ER//EN\r\n" + tz +
+		"BEGIN:VEVENT\r\nUID:b\r\n" + long + "END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:c\r\nSUMMARY:Pump test\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+
+	cal, err := a.ExportCalendarRange(from, to, CalendarChunkYear)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	if n := strings.Count(string(cal), "BEGIN:VTIMEZONE"); n != 1 {
+		t.Fatalf("ERR: expected one time zone, got %d", n)
+	}
+	for _, line := range strings.Split(string(cal), "\r\n") {
+		if len(line) > 75 {
+			t.Fatalf("ERR: line not folded: %q", line)
+		}
+	}
+	evs, err := ParseCalendar(cal)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(evs) != 3 || evs[0].UID != "a" || evs[1].UID != "b" || evs[2].UID != "c" {
+		t.Fatalf("ERR: unexpected events %#v", evs)
+	}
+	if evs[1].Description != strings.Repeat("Ladder operations ", 10) {
+		t.Fatalf("ERR: folding changed the description: %q", evs[1].Description)
+	}
+}
+
+func Test_WriteEventsCSV(t *testing.T) {
+	evs, err := ParseCalendar([]byte("BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Hose drill\r\nLOCATION:Station 1\r\nCATEGORIES:Training\r\n" +
+		"DTSTART;TZID=America/New_York:20240105T190000\r\nDTEND;TZID=America/New_York:20240105T210000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:2\r\nSUMMARY:Holiday\r\nDTSTART;VALUE=DATE:20241225\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	var b strings.Builder
+	err = WriteEventsCSV(&b, evs)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("ERR: expected 3 lines, got %q", b.String())
+	}
+	if lines[1] != "Hose drill,01/05/2024,07:00 PM,01/05/2024,09:00 PM,False,,Station 1,1,America/New_York,Training,,," {
+		t.Fatalf("ERR: unexpected row %q", lines[1])
+	}
+	if lines[2] != "Holiday,12/25/2024,,12/25/2024,,True,,,2,,,,," {
+		t.Fatalf("ERR: unexpected row %q", lines[2])
+	}
+}
+
+func Test_CalendarEntryTypes(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+
+	a, f, _ := testMemoryAgent(t)
+	f.Responses[calendarPageURL] = []byte(`<html><body><form id="export">
+<label><input type="checkbox" name="EntryTypes[]" value="3"> Meetings</label>
+<input type="checkbox" name="EntryTypes[]" value="7" id="et7"><label for="et7">Drills, Station 1</label>
+<input type="checkbox" name="showWeekends" value="1">
+<select name="entryTypeFilter"><option value="">All</option><option value="3">Meetings</option><option value="9">Shifts</option></select>
+</form></body></html>`)
+
+	drills := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\nUID:d1\r\nSUMMARY:Hose drill\r\nX-ER-ENTRY-TYPE:Old\r\nBEGIN:VALARM\r\nACTION:DISPLAY\r\nEND:VALARM\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	f.Responses[CalendarExportURL(from, to, "7")] = []byte(drills)
+
+	types, err := a.GetCalendarEntryTypes()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	expected := []CalendarEntryType{{ID: "3", Name: "Meetings"}, {ID: "7", Name: "Drills, Station 1"}, {ID: "9", Name: "Shifts"}}
+	if len(types) != len(expected) {
+		t.Fatalf("ERR: unexpected entry types %#v", types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("ERR: unexpected entry types %#v", types)
+		}
+	}
+
+	cal, err := a.ExportCalendarEntryType(from, to, CalendarChunkYear, types[1])
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	evs, err := ParseCalendar(cal)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(evs) != 1 || evs[0].EntryType != "Drills, Station 1" || len(evs[0].Props["X-ER-ENTRY-TYPE"]) != 1 {
+		t.Fatalf("ERR: unexpected events %#v", evs)
+	}
+	if !strings.Contains(string(cal), "BEGIN:VALARM\r\nACTION:DISPLAY\r\n") {
+		t.Fatalf("ERR: tagging changed nested components: %q", cal)
+	}
+}
+
+func Test_ParseCalendar_VTimezone(t *testing.T) {
+	evs, err := ParseCalendar([]byte("BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VTIMEZONE\r\nTZID:Eastern Standard Time\r\n" +
+		"BEGIN:STANDARD\r\nDTSTART:16011104T020000\r\nRRULE:FREQ=YEARLY;BYDAY=1SU;BYMONTH=11\r\nTZOFFSETFROM:-0400\r\nTZOFFSETTO:-0500\r\nEND:STANDARD\r\n" +
+		"BEGIN:DAYLIGHT\r\nDTSTART:16010311T020000\r\nRRULE:FREQ=YEARLY;BYDAY=2SU;BYMONTH=3\r\nTZOFFSETFROM:-0500\r\nTZOFFSETTO:-0400\r\nEND:DAYLIGHT\r\n" +
+		"END:VTIMEZONE\r\n" +
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART;TZID=Eastern Standard Time:20240105T190000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:2\r\nDTSTART;TZID=\"Eastern Standard Time\":20240705T190000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:3\r\nDTSTART;TZID=Nowhere Standard Time:20240705T190000\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(evs) != 3 {
+		t.Fatalf("ERR: expected 3 events, got %d", len(evs))
+	}
+	for i, expected := range []string{"2024-01-06T00:00:00Z", "2024-07-05T23:00:00Z"} {
+		if got := evs[i].Start.UTC().Format(time.RFC3339); got != expected {
+			t.Fatalf("ERR: event %s: expected %s, got %s", evs[i].UID, expected, got)
+		}
+	}
+
+	if _, err := newCalendarZones(nil).location("Nowhere Standard Time"); err == nil {
+		t.Fatalf("ERR: unknown time zone resolved")
+	}
+}
@@ -0,0 +1,355 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+const (
+	defaultCaptureMaxBodySize = 1 << 20
+	defaultCaptureMaxEntries  = 500
+)
+
+var (
+	// defaultCaptureExclude mirrors what we have always skipped: static
+	// assets which never contain data worth keeping.
+	defaultCaptureExclude = []string{`\.css$`, `\.js$`, `\.svg$`, `\.woff2$`}
+)
+
+// CapturePolicy controls which network traffic the agent keeps in memory
+// for later inspection or export as a HAR file. The zero value captures
+// everything except static assets, keeping the most recent 500 exchanges
+// with bodies of up to 1 MiB.
+type CapturePolicy struct {
+	// Disabled turns off capture entirely.
+	Disabled bool
+	// Include is a list of URL regular expressions; when non-empty, only
+	// matching URLs are captured.
+	Include []string
+	// Exclude is a list of URL regular expressions which are never
+	// captured. Defaults to static assets (css, js, svg, woff2) if nil.
+	Exclude []string
+	// MaxBodySize is the largest response body kept, in bytes. Larger
+	// bodies are truncated. Negative values disable body capture.
+	MaxBodySize int
+	// MaxEntries is the size of the capture ring buffer. Once full, the
+	// oldest exchange is dropped for every new one.
+	MaxEntries int
+	// KeepCredentials retains cookie and authorization headers, and the
+	// password, username and token fields of form and JSON request and
+	// response bodies, which are redacted by default so a capture can be
+	// handed to someone else. Other bodies are left out unless it is set.
+	KeepCredentials bool
+}
+
+// captureEntry is a single captured request / response exchange.
+type captureEntry struct {
+	id string
+
+	Started         time.Time
+	Responded       time.Time
+	Finished        time.Time
+	Method          string
+	URL             string
+	RequestHeaders  map[string]string
+	RequestBody     []byte
+	Status          int
+	StatusText      string
+	Protocol        string
+	ResponseHeaders map[string]string
+	MimeType        string
+	Body            []byte
+	BodySize        int64
+	BodyTruncated   bool
+	Error           string
+}
+
+// capture is a bounded ring buffer of network exchanges, fed by both the
+// Chrome network listener and the native HTTP transport.
+type capture struct {
+	policy  CapturePolicy
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+
+	entries []*captureEntry
+	byID    map[string]*captureEntry
+	l       sync.Mutex
+}
+
+func newCapture(p CapturePolicy) (*capture, error) {
+	c := &capture{
+		policy:  p,
+		entries: make([]*captureEntry, 0),
+		byID:    map[string]*captureEntry{},
+	}
+	if c.policy.MaxBodySize == 0 {
+		c.policy.MaxBodySize = defaultCaptureMaxBodySize
+	}
+	if c.policy.MaxEntries <= 0 {
+		c.policy.MaxEntries = defaultCaptureMaxEntries
+	}
+	exclude := p.Exclude
+	if exclude == nil {
+		exclude = defaultCaptureExclude
+	}
+
+	var err error
+	c.include, err = compilePatterns(p.Include)
+	if err != nil {
+		return nil, err
+	}
+	c.exclude, err = compilePatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	out := make([]*regexp.Regexp, 0)
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return out, fmt.Errorf("bad capture pattern %q: %w", p, err)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+// wanted determines if a URL should be stored in memory or not
+func (c *capture) wanted(url string) bool {
+	if c == nil || c.policy.Disabled || !strings.HasPrefix(url, "http") {
+		return false
+	}
+	for _, re := range c.exclude {
+		if re.MatchString(url) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends an entry to the ring buffer, evicting the oldest entry if
+// the buffer is full. Must be called with the lock held.
+func (c *capture) add(e *captureEntry) {
+	if old, ok := c.byID[e.id]; ok && old == e {
+		return
+	}
+	c.entries = append(c.entries, e)
+	if e.id != "" {
+		c.byID[e.id] = e
+	}
+	for len(c.entries) > c.policy.MaxEntries {
+		if c.byID[c.entries[0].id] == c.entries[0] {
+			delete(c.byID, c.entries[0].id)
+		}
+		c.entries[0] = nil
+		c.entries = c.entries[1:]
+	}
+}
+
+// setBody stores a response body, honoring the size cap. Must be called
+// with the lock held.
+func (c *capture) setBody(e *captureEntry, body []byte) {
+	e.BodySize = int64(len(body))
+	if c.policy.MaxBodySize < 0 {
+		e.BodyTruncated = len(body) > 0
+		return
+	}
+	if len(body) > c.policy.MaxBodySize {
+		body = body[:c.policy.MaxBodySize]
+		e.BodyTruncated = true
+	}
+	e.Body = append([]byte{}, body...)
+}
+
+// snapshot returns a copy of the currently captured entries, oldest first.
+func (c *capture) snapshot() []captureEntry {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	out := make([]captureEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		out = append(out, *e)
+	}
+	return out
+}
+
+// handleEvent feeds Chrome network events into the capture. It returns
+// true if the response body for a finished request should be fetched and
+// passed to body.
+func (c *capture) handleEvent(v interface{}) (network.RequestID, bool) {
+	switch ev := v.(type) {
+	case *network.EventRequestWillBeSent:
+		c.l.Lock()
+		defer c.l.Unlock()
+
+		// A redirect reuses the request ID; close out the previous hop.
+		if prev, ok := c.byID[ev.RequestID.String()]; ok && ev.RedirectResponse != nil {
+			c.setResponse(prev, ev.RedirectResponse)
+			prev.Finished = time.Now()
+			delete(c.byID, prev.id)
+		}
+
+		if !c.wanted(ev.Request.URL) {
+			return "", false
+		}
+
+		e := &captureEntry{
+			id:             ev.RequestID.String(),
+			Started:        time.Now(),
+			Method:         ev.Request.Method,
+			URL:            ev.Request.URL,
+			RequestHeaders: flattenHeaders(ev.Request.Headers),
+		}
+		if ev.WallTime != nil {
+			e.Started = ev.WallTime.Time()
+		}
+		for _, pd := range ev.Request.PostDataEntries {
+			b, err := base64.StdEncoding.DecodeString(pd.Bytes)
+			if err == nil {
+				e.RequestBody = append(e.RequestBody, b...)
+			}
+		}
+		c.add(e)
+
+	case *network.EventResponseReceived:
+		c.l.Lock()
+		defer c.l.Unlock()
+
+		if e, ok := c.byID[ev.RequestID.String()]; ok {
+			c.setResponse(e, ev.Response)
+		}
+
+	case *network.EventLoadingFinished:
+		c.l.Lock()
+		defer c.l.Unlock()
+
+		if e, ok := c.byID[ev.RequestID.String()]; ok {
+			e.Finished = time.Now()
+			return ev.RequestID, c.policy.MaxBodySize >= 0
+		}
+
+	case *network.EventLoadingFailed:
+		c.l.Lock()
+		defer c.l.Unlock()
+
+		if e, ok := c.byID[ev.RequestID.String()]; ok {
+			e.Finished = time.Now()
+			e.Error = ev.ErrorText
+			delete(c.byID, e.id)
+		}
+	}
+	return "", false
+}
+
+// body attaches a fetched response body to a finished browser request.
+func (c *capture) body(id network.RequestID, body []byte) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if e, ok := c.byID[id.String()]; ok {
+		c.setBody(e, body)
+		delete(c.byID, e.id)
+	}
+}
+
+func (c *capture) setResponse(e *captureEntry, r *network.Response) {
+	e.Responded = time.Now()
+	e.Status = int(r.Status)
+	e.StatusText = r.StatusText
+	e.Protocol = r.Protocol
+	e.ResponseHeaders = flattenHeaders(r.Headers)
+	e.MimeType = r.MimeType
+}
+
+func flattenHeaders(h network.Headers) map[string]string {
+	out := map[string]string{}
+	for k, v := range h {
+		out[k] = fmt.Sprint(v)
+	}
+	return out
+}
+
+// captureTransport records native HTTP exchanges into the same capture as
+// the browser traffic.
+type captureTransport struct {
+	next http.RoundTripper
+	c    *capture
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.c.wanted(req.URL.String()) {
+		return t.next.RoundTrip(req)
+	}
+
+	e := &captureEntry{
+		Started:        time.Now(),
+		Method:         req.Method,
+		URL:            req.URL.String(),
+		RequestHeaders: map[string]string{},
+	}
+	for k := range req.Header {
+		e.RequestHeaders[k] = req.Header.Get(k)
+	}
+	if req.Body != nil && req.GetBody != nil {
+		if rb, err := req.GetBody(); err == nil {
+			e.RequestBody, _ = io.ReadAll(rb)
+			rb.Close()
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		e.Finished = time.Now()
+		e.Error = err.Error()
+		t.c.l.Lock()
+		t.c.add(e)
+		t.c.l.Unlock()
+		return resp, err
+	}
+
+	e.Responded = time.Now()
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		log.Printf("WARN: capture: reading %s: %s", e.URL, err.Error())
+	}
+
+	e.Finished = time.Now()
+	e.Status = resp.StatusCode
+	e.StatusText = http.StatusText(resp.StatusCode)
+	e.Protocol = resp.Proto
+	e.MimeType = resp.Header.Get("Content-Type")
+	e.ResponseHeaders = map[string]string{}
+	for k := range resp.Header {
+		e.ResponseHeaders[k] = strings.Join(resp.Header.Values(k), "\n")
+	}
+
+	t.c.l.Lock()
+	t.c.setBody(e, body)
+	t.c.add(e)
+	t.c.l.Unlock()
+
+	return resp, err
+}
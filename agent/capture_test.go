@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+func testCaptureExchange(c *capture, id, url string, body []byte) {
+	rid := network.RequestID(id)
+	c.handleEvent(&network.EventRequestWillBeSent{
+		RequestID: rid,
+		Request: &network.Request{
+			URL:     url,
+			Method:  "GET",
+			Headers: network.Headers{"Cookie": "PHPSESSID=secret"},
+		},
+	})
+	c.handleEvent(&network.EventResponseReceived{
+		RequestID: rid,
+		Response: &network.Response{
+			URL:      url,
+			Status:   200,
+			MimeType: "application/json",
+			Headers:  network.Headers{"Content-Type": "application/json"},
+		},
+	})
+	if id, fetch := c.handleEvent(&network.EventLoadingFinished{RequestID: rid}); fetch {
+		c.body(id, body)
+	}
+}
+
+func Test_capturePolicy(t *testing.T) {
+	c, err := newCapture(CapturePolicy{
+		Include:     []string{`/training/ws/`},
+		MaxBodySize: 4,
+		MaxEntries:  2,
+	})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	testCaptureExchange(c, "1", "https://secure.emergencyreporting.com/training/ws/a.php", []byte(`{"a":1}`))
+	testCaptureExchange(c, "2", "https://secure.emergencyreporting.com/nfirs/main.asp", []byte(`<html>`))
+	testCaptureExchange(c, "3", "https://secure.emergencyreporting.com/training/ws/b.php", []byte(`{}`))
+	testCaptureExchange(c, "4", "https://secure.emergencyreporting.com/training/ws/app.js", []byte(`x`))
+	testCaptureExchange(c, "5", "https://secure.emergencyreporting.com/training/ws/c.php", []byte(`[]`))
+
+	entries := c.snapshot()
+	if len(entries) != 2 {
+		t.Fatalf("ERR: expected 2 entries in ring buffer, got %d", len(entries))
+	}
+	if entries[0].URL != "https://secure.emergencyreporting.com/training/ws/b.php" ||
+		entries[1].URL != "https://secure.emergencyreporting.com/training/ws/c.php" {
+		t.Fatalf("ERR: unexpected entries %#v", entries)
+	}
+	if len(c.byID) != 0 {
+		t.Fatalf("ERR: %d in-flight entries left over", len(c.byID))
+	}
+
+	testCaptureExchange(c, "6", "https://secure.emergencyreporting.com/training/ws/d.php", []byte(`{"long":true}`))
+	entries = c.snapshot()
+	if !entries[1].BodyTruncated || len(entries[1].Body) != 4 || entries[1].BodySize != 13 {
+		t.Fatalf("ERR: body not truncated: %#v", entries[1])
+	}
+}
+
+func Test_WriteHAR(t *testing.T) {
+	c, err := newCapture(CapturePolicy{})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		testCaptureExchange(c, fmt.Sprint(i), fmt.Sprintf("https://secure.emergencyreporting.com/ws.php?page=%d", i), []byte(`{"ok":true}`))
+	}
+
+	a := &Agent{capture: c}
+	var buf bytes.Buffer
+	err = a.WriteHAR(&buf)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	var h harLog
+	err = json.Unmarshal(buf.Bytes(), &h)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if h.Log.Version != "1.2" || len(h.Log.Entries) != 3 {
+		t.Fatalf("ERR: unexpected HAR %s", buf.String())
+	}
+	e := h.Log.Entries[2]
+	if e.Request.QueryString[0].Value != "2" || e.Response.Content.Text != `{"ok":true}` {
+		t.Fatalf("ERR: unexpected entry %#v", e)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Fatalf("ERR: credentials were not redacted")
+	}
+}
+
+func Test_WriteHAR_LoginPost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	c, err := newCapture(CapturePolicy{})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	client := &http.Client{Transport: &captureTransport{next: http.DefaultTransport, c: c}}
+	resp, err := client.PostForm(srv.URL+"/login.php", url.Values{"username": {"jo"}, "Password": {"hunter2"}, "remember": {"1"}})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	resp.Body.Close()
+	resp, err = client.Post(srv.URL+"/api", "application/json", strings.NewReader(`{"grant":{"access_token":"tok123"},"page":2}`))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	resp.Body.Close()
+	resp, err = client.Post(srv.URL+"/upload", "text/plain", strings.NewReader("hunter2"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	a := &Agent{capture: c}
+	var buf bytes.Buffer
+	err = a.WriteHAR(&buf)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	for _, secret := range []string{"hunter2", "tok123", "=jo"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("ERR: %s was not redacted from %s", secret, buf.String())
+		}
+	}
+	var h harLog
+	json.Unmarshal(buf.Bytes(), &h)
+	if h.Log.Entries[0].Request.PostData.Text != "Password=REDACTED&remember=1&username=REDACTED" {
+		t.Fatalf("ERR: unexpected form %q", h.Log.Entries[0].Request.PostData.Text)
+	}
+	if !strings.Contains(h.Log.Entries[1].Request.PostData.Text, `"page":2`) {
+		t.Fatalf("ERR: unexpected JSON %q", h.Log.Entries[1].Request.PostData.Text)
+	}
+
+	// Unless credentials are kept
+	c.policy.KeepCredentials = true
+	buf.Reset()
+	a.WriteHAR(&buf)
+	if !strings.Contains(buf.String(), "hunter2") {
+		t.Fatalf("ERR: credentials were not kept")
+	}
+}
+
+func Test_captureEntryHAR_Response(t *testing.T) {
+	e := captureEntry{
+		URL:             "https://secure.emergencyreporting.com/login.php",
+		Status:          302,
+		MimeType:        "application/json; charset=utf-8",
+		ResponseHeaders: map[string]string{"location": "/main.asp"},
+		Body:            []byte(`{"access_token":"tok123","rows":[1]}`),
+	}
+	h := e.har(false)
+	if h.Response.RedirectURL != "/main.asp" {
+		t.Fatalf("ERR: unexpected redirect %q", h.Response.RedirectURL)
+	}
+	if h.Response.Content.Text != `{"access_token":"REDACTED","rows":[1]}` {
+		t.Fatalf("ERR: unexpected body %q", h.Response.Content.Text)
+	}
+
+	e.MimeType = "text/html"
+	e.Body = []byte(`<script>location.hash = "#accessToken=tok123"</script>`)
+	if h = e.har(false); h.Response.Content.Text != "REDACTED" {
+		t.Fatalf("ERR: unexpected body %q", h.Response.Content.Text)
+	}
+	if h = e.har(true); !strings.Contains(h.Response.Content.Text, "tok123") {
+		t.Fatalf("ERR: body was not kept %q", h.Response.Content.Text)
+	}
+}
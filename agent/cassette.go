@@ -0,0 +1,381 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	ErrNotRecorded = errors.New("no recorded response")
+)
+
+const (
+	cassetteRecord = iota
+	cassetteReplay
+)
+
+const (
+	cassetteSourceBrowser = "browser"
+	cassetteSourceNative  = "native"
+	cassetteRedacted      = "REDACTED"
+)
+
+// interaction is a single recorded request and response, stored as one
+// JSON file in the cassette directory.
+type interaction struct {
+	Seq         int                 `json:"seq"`
+	Source      string              `json:"source"`
+	Method      string              `json:"method"`
+	URL         string              `json:"url"`
+	RequestBody string              `json:"request_body,omitempty"`
+	Status      int                 `json:"status"`
+	Headers     map[string][]string `json:"headers"`
+	Body        []byte              `json:"body"`
+
+	// requestType is the request's content type, which decides how its
+	// body is scrubbed.
+	requestType string
+}
+
+func (i *interaction) key() string {
+	return i.Method + " " + i.URL
+}
+
+// cassette records every request and response the agent makes, through
+// the browser or natively, into a directory, and can serve them back later
+// without touching the network. Repeated requests for the same method and
+// URL are served in recorded order, with the last response repeating once
+// the recording runs out.
+type cassette struct {
+	dir     string
+	mode    int
+	secrets []string
+
+	seq          int
+	interactions map[string][]*interaction
+	served       map[string]int
+	l            sync.Mutex
+}
+
+func newCassette(dir string, mode int, secrets ...string) (*cassette, error) {
+	c := &cassette{
+		dir:          dir,
+		mode:         mode,
+		interactions: map[string][]*interaction{},
+		served:       map[string]int{},
+	}
+	for _, s := range secrets {
+		if s == "" {
+			continue
+		}
+		// Login forms post credentials URL encoded, and pages and web
+		// services may echo them back escaped
+		js, _ := json.Marshal(s)
+		c.secrets = append(c.secrets, s, url.QueryEscape(s), string(js[1:len(js)-1]), html.EscapeString(s))
+	}
+
+	if mode == cassetteRecord {
+		// Recordings hold department data, so only the user may read them
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return c, err
+		}
+		return c, os.Chmod(dir, 0700)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return c, err
+	}
+	if len(files) == 0 {
+		return c, fmt.Errorf("no recordings found in %s", dir)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return c, err
+		}
+		var i interaction
+		err = json.Unmarshal(b, &i)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", f, err)
+		}
+		c.interactions[i.key()] = append(c.interactions[i.key()], &i)
+	}
+	log.Printf("INFO: Loaded %d recorded requests from %s", len(files), dir)
+	return c, nil
+}
+
+// record scrubs credentials from an interaction and writes it out. The
+// login credentials are replaced wherever they appear, then the fields
+// redactedFields names are masked in form and JSON bodies, and in the
+// inputs of pages, such as the one holding the API access token. Request
+// bodies of other types are dropped, as in HAR output; response bodies of
+// other types are kept, since replay needs them.
+func (c *cassette) record(i *interaction) error {
+	for _, s := range c.secrets {
+		i.RequestBody = strings.ReplaceAll(i.RequestBody, s, cassetteRedacted)
+		i.Body = bytes.ReplaceAll(i.Body, []byte(s), []byte(cassetteRedacted))
+	}
+	if i.RequestBody != "" {
+		i.RequestBody = redactBody(i.requestType, []byte(i.RequestBody))
+	}
+	responseType := ""
+	for k, vs := range i.Headers {
+		if strings.EqualFold(k, "Content-Type") && len(vs) > 0 {
+			responseType = vs[0]
+		}
+	}
+	if b, ok := redactFields(responseType, i.Body); ok {
+		i.Body = b
+	} else {
+		i.Body = redactInputs(i.Body)
+	}
+
+	for k := range i.Headers {
+		switch strings.ToLower(k) {
+		case "content-encoding", "content-length", "transfer-encoding":
+			// Bodies are stored decoded, so these no longer apply
+			delete(i.Headers, k)
+		default:
+			if redactedHeaders[strings.ToLower(k)] {
+				i.Headers[k] = []string{cassetteRedacted}
+			}
+		}
+	}
+
+	c.l.Lock()
+	c.seq++
+	i.Seq = c.seq
+	c.l.Unlock()
+
+	b, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(c.dir, fmt.Sprintf("%06d.json", i.Seq)), b, 0600)
+}
+
+// htmlInput matches an HTML input element, inputName its name or ID
+// and inputValue its value.
+var (
+	htmlInput  = regexp.MustCompile(`(?is)<input\b[^>]*>`)
+	inputName  = regexp.MustCompile(`(?i)\b(?:name|id)\s*=\s*["']?([^"'\s>]+)`)
+	inputValue = regexp.MustCompile(`(?i)\bvalue\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+// redactInputs masks the values of inputs on a page whose name or ID
+// redactedFields matches, such as #accessToken or a CSRF token.
+func redactInputs(body []byte) []byte {
+	return htmlInput.ReplaceAllFunc(body, func(tag []byte) []byte {
+		masked := false
+		for _, m := range inputName.FindAllSubmatch(tag, -1) {
+			if redactedFields.Match(m[1]) {
+				masked = true
+			}
+		}
+		if !masked {
+			return tag
+		}
+		return inputValue.ReplaceAll(tag, []byte(`value="`+cassetteRedacted+`"`))
+	})
+}
+
+// lookup returns the next recorded response for a request.
+func (c *cassette) lookup(method, u string) (*interaction, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	key := method + " " + u
+	list := c.interactions[key]
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNotRecorded, key)
+	}
+	n := c.served[key]
+	if n >= len(list) {
+		n = len(list) - 1
+	}
+	c.served[key] = n + 1
+	return list[n], nil
+}
+
+// cassetteTransport records or replays native HTTP requests.
+type cassetteTransport struct {
+	next http.RoundTripper
+	c    *cassette
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.c.mode == cassetteReplay {
+		i, err := t.c.lookup(req.Method, req.URL.String())
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", i.Status, http.StatusText(i.Status)),
+			StatusCode:    i.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header(i.Headers).Clone(),
+			Body:          io.NopCloser(bytes.NewReader(i.Body)),
+			ContentLength: int64(len(i.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	i := &interaction{
+		Source: cassetteSourceNative,
+		Method: req.Method,
+		URL:    req.URL.String(),
+	}
+	if req.Body != nil && req.GetBody != nil {
+		if rb, err := req.GetBody(); err == nil {
+			b, _ := io.ReadAll(rb)
+			rb.Close()
+			i.RequestBody = string(b)
+		}
+		i.requestType = req.Header.Get("Content-Type")
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	i.Body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(i.Body))
+	if err != nil {
+		return resp, err
+	}
+	i.Status = resp.StatusCode
+	i.Headers = resp.Header.Clone()
+
+	if err := t.c.record(i); err != nil {
+		log.Printf("ERR: Recording %s: %s", i.URL, err.Error())
+	}
+	return resp, nil
+}
+
+// attach enables request interception in the browser behind ctx, so that
+// browser traffic is recorded at the response stage or fulfilled from the
+// recording at the request stage.
+func (c *cassette) attach(ctx context.Context) error {
+	stage := fetch.RequestStageResponse
+	if c.mode == cassetteReplay {
+		stage = fetch.RequestStageRequest
+	}
+
+	chromedp.ListenTarget(ctx, func(v interface{}) {
+		ev, ok := v.(*fetch.EventRequestPaused)
+		if !ok {
+			return
+		}
+		go func() {
+			ch := chromedp.FromContext(ctx)
+			ectx := cdp.WithExecutor(ctx, ch.Target)
+
+			var err error
+			if c.mode == cassetteReplay {
+				err = c.fulfill(ectx, ev)
+			} else {
+				err = c.recordPaused(ectx, ev)
+			}
+			if err != nil {
+				log.Printf("ERR: cassette: %s %s: %s", ev.Request.Method, ev.Request.URL, err.Error())
+			}
+		}()
+	})
+
+	return chromedp.Run(ctx, fetch.Enable().WithPatterns([]*fetch.RequestPattern{
+		{URLPattern: "*", RequestStage: stage},
+	}))
+}
+
+// recordPaused records a paused browser response and lets it continue.
+func (c *cassette) recordPaused(ctx context.Context, ev *fetch.EventRequestPaused) error {
+	defer fetch.ContinueRequest(ev.RequestID).Do(ctx)
+
+	if ev.ResponseErrorReason != "" {
+		return nil
+	}
+
+	i := &interaction{
+		Source:  cassetteSourceBrowser,
+		Method:  ev.Request.Method,
+		URL:     ev.Request.URL + ev.Request.URLFragment,
+		Status:  int(ev.ResponseStatusCode),
+		Headers: map[string][]string{},
+	}
+	for k, v := range ev.Request.Headers {
+		if strings.EqualFold(k, "Content-Type") {
+			i.requestType, _ = v.(string)
+		}
+	}
+	for _, pd := range ev.Request.PostDataEntries {
+		b, err := base64.StdEncoding.DecodeString(pd.Bytes)
+		if err == nil {
+			i.RequestBody += string(b)
+		}
+	}
+	for _, h := range ev.ResponseHeaders {
+		i.Headers[h.Name] = append(i.Headers[h.Name], h.Value)
+	}
+
+	// Redirects have no body to fetch
+	if i.Status < 300 || i.Status > 399 {
+		body, err := fetch.GetResponseBody(ev.RequestID).Do(ctx)
+		if err != nil {
+			return err
+		}
+		i.Body = body
+	}
+
+	return c.record(i)
+}
+
+// fulfill answers a paused browser request from the recording, failing it
+// as if the network were down when nothing was recorded.
+func (c *cassette) fulfill(ctx context.Context, ev *fetch.EventRequestPaused) error {
+	i, err := c.lookup(ev.Request.Method, ev.Request.URL+ev.Request.URLFragment)
+	if err != nil {
+		if ferr := fetch.FailRequest(ev.RequestID, network.ErrorReasonInternetDisconnected).Do(ctx); ferr != nil {
+			return ferr
+		}
+		return err
+	}
+
+	headers := make([]*fetch.HeaderEntry, 0)
+	for k, vs := range i.Headers {
+		for _, v := range vs {
+			headers = append(headers, &fetch.HeaderEntry{Name: k, Value: v})
+		}
+	}
+
+	return fetch.FulfillRequest(ev.RequestID, int64(i.Status)).
+		WithResponseHeaders(headers).
+		WithBody(base64.StdEncoding.EncodeToString(i.Body)).
+		Do(ctx)
+}
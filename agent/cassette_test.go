@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_cassetteRecordReplay(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "PHPSESSID", Value: "secret"})
+		switch r.URL.Path {
+		case "/main.asp":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<p>p@ss word</p><input type="hidden" id="accessToken" value="tok123"><input name="q" value="keep">`)
+			return
+		case "/login":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"session_id":"sess123","echo":"p@ss word"}`)
+			return
+		}
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"hit":%d}`, hits)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+
+	rec, err := newCassette(dir, cassetteRecord, "user", "p@ss word")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	a := &Agent{cassette: rec}
+	for i := 0; i < 2; i++ {
+		_, err = a.authorizedJsonGet(srv.URL + "/training/ws/classes.php")
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+	}
+	resp, err := a.nativeClient().Post(srv.URL+"/login", "application/x-www-form-urlencoded", strings.NewReader("u=user&p=p%40ss+word"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	resp.Body.Close()
+	resp, err = a.nativeClient().Get(srv.URL + "/main.asp")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("ERR: unexpected cassette directory %v %v", fi, err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 4 {
+		t.Fatalf("ERR: expected 4 recordings, got %d", len(files))
+	}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err != nil || fi.Mode().Perm() != 0600 {
+			t.Fatalf("ERR: unexpected recording %v %v", fi, err)
+		}
+		b, _ := os.ReadFile(f)
+		var i interaction
+		json.Unmarshal(b, &i)
+		for _, leak := range []string{"secret", "p%40ss", "u=user", "p@ss", "tok123", "sess123"} {
+			if strings.Contains(string(b), leak) || strings.Contains(string(i.Body), leak) {
+				t.Fatalf("ERR: %s leaked into %s: %s %s", leak, f, string(b), string(i.Body))
+			}
+		}
+		if i.URL == srv.URL+"/main.asp" && !strings.Contains(string(i.Body), `value="keep"`) {
+			t.Fatalf("ERR: page over-redacted: %s", string(i.Body))
+		}
+	}
+
+	srv.Close()
+
+	play, err := newCassette(dir, cassetteReplay)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	a = &Agent{cassette: play}
+	for _, expected := range []string{`{"hit":1}`, `{"hit":2}`, `{"hit":2}`} {
+		b, err := a.authorizedJsonGet(srv.URL + "/training/ws/classes.php")
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+		if string(b) != expected {
+			t.Fatalf("ERR: expected %s, got %s", expected, string(b))
+		}
+	}
+
+	resp, err = a.nativeClient().Get(srv.URL + "/not-recorded")
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Fatalf("ERR: expected ErrNotRecorded, got %v", err)
+	}
+	if resp != nil {
+		io.Copy(io.Discard, resp.Body)
+	}
+}
@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	ErrDownloadCanceled = errors.New("download canceled or failed")
+	// ErrDownloadAmbiguous is returned to waiters in a frame which began a
+	// download from a URL none of them asked for, when it cannot be told
+	// which of them it belongs to.
+	ErrDownloadAmbiguous = errors.New("download could not be matched to its request")
+)
+
+// DownloadResult describes a finished browser download.
+type DownloadResult struct {
+	GUID              string
+	URL               string
+	SuggestedFilename string
+	Path              string
+	ReceivedBytes     float64
+	TotalBytes        float64
+}
+
+// download tracks a single browser download from the navigation which
+// triggers it through to completion or cancellation.
+type download struct {
+	url string
+	// frame is the frame navigated to url, which Chrome names as the
+	// download's frame when a redirect changes its URL.
+	frame  string
+	result DownloadResult
+	done   chan error
+}
+
+// downloadManager correlates Chrome download events with the callers
+// waiting on them. Downloads are matched to waiters by URL when they begin,
+// or by frame when a redirect changed the URL, and are tracked by GUID from
+// then on, so any number of downloads can be in flight at once.
+type downloadManager struct {
+	dir string
+
+	pending []*download
+	active  map[string]*download
+	targets map[target.ID]bool
+	l       sync.Mutex
+}
+
+func newDownloadManager(dir string) *downloadManager {
+	return &downloadManager{
+		dir:     dir,
+		pending: make([]*download, 0),
+		active:  map[string]*download{},
+		targets: map[target.ID]bool{},
+	}
+}
+
+// listen attaches the download event handler to the target behind ctx,
+// once per target.
+func (m *downloadManager) listen(ctx context.Context) {
+	c := chromedp.FromContext(ctx)
+	if c == nil || c.Target == nil {
+		return
+	}
+
+	m.l.Lock()
+	if m.targets[c.Target.TargetID] {
+		m.l.Unlock()
+		return
+	}
+	m.targets[c.Target.TargetID] = true
+	m.l.Unlock()
+
+	chromedp.ListenTarget(ctx, m.handleEvent)
+}
+
+// expect registers a waiter for a download about to be triggered by
+// navigating frame to url.
+func (m *downloadManager) expect(url, frame string) *download {
+	d := &download{
+		url:   url,
+		frame: frame,
+		done:  make(chan error, 1),
+	}
+
+	m.l.Lock()
+	m.pending = append(m.pending, d)
+	m.l.Unlock()
+
+	return d
+}
+
+// forget drops a waiter which is no longer interested in its download.
+func (m *downloadManager) forget(d *download) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	for i, p := range m.pending {
+		if p == d {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			break
+		}
+	}
+	if d.result.GUID != "" {
+		delete(m.active, d.result.GUID)
+	}
+}
+
+func (m *downloadManager) handleEvent(v interface{}) {
+	switch ev := v.(type) {
+	case *browser.EventDownloadWillBegin:
+		m.begin(ev)
+	case *browser.EventDownloadProgress:
+		m.progress(ev)
+	}
+}
+
+func (m *downloadManager) begin(ev *browser.EventDownloadWillBegin) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	// Match the waiter for this exact URL, or else the one waiter in the
+	// frame the download began in, as when the server redirected it.
+	idx := -1
+	for i, p := range m.pending {
+		if p.url == ev.URL {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		framed := make([]int, 0)
+		for i, p := range m.pending {
+			if p.frame != "" && p.frame == string(ev.FrameID) {
+				framed = append(framed, i)
+			}
+		}
+		if len(framed) > 1 {
+			// Guessing could hand one caller another's file, so fail them
+			// all instead.
+			log.Printf("ERR: download %s (%s) matches %d requests in frame %s", ev.GUID, ev.URL, len(framed), ev.FrameID)
+			for i := len(framed) - 1; i >= 0; i-- {
+				m.pending[framed[i]].done <- ErrDownloadAmbiguous
+				m.pending = append(m.pending[:framed[i]], m.pending[framed[i]+1:]...)
+			}
+			return
+		}
+		if len(framed) == 1 {
+			idx = framed[0]
+		}
+	}
+	if idx == -1 {
+		log.Printf("WARN: download %s (%s) was not requested, ignoring", ev.GUID, ev.URL)
+		return
+	}
+
+	d := m.pending[idx]
+	m.pending = append(m.pending[:idx], m.pending[idx+1:]...)
+
+	d.result.GUID = ev.GUID
+	d.result.URL = ev.URL
+	d.result.SuggestedFilename = ev.SuggestedFilename
+	m.active[ev.GUID] = d
+
+	log.Printf("INFO: download %s began: %s (%s)", ev.GUID, ev.SuggestedFilename, ev.URL)
+}
+
+func (m *downloadManager) progress(ev *browser.EventDownloadProgress) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	d, ok := m.active[ev.GUID]
+	if !ok {
+		return
+	}
+
+	d.result.ReceivedBytes = ev.ReceivedBytes
+	d.result.TotalBytes = ev.TotalBytes
+
+	completed := "(unknown)"
+	if ev.TotalBytes != 0 {
+		completed = fmt.Sprintf("%0.2f%%", ev.ReceivedBytes/ev.TotalBytes*100.0)
+	}
+	log.Printf("download %s: state: %s, completed: %s", ev.GUID, ev.State.String(), completed)
+
+	switch ev.State {
+	case browser.DownloadProgressStateCompleted:
+		// We can predict the exact file location and name here because of
+		// how we configured SetDownloadBehavior and WithDownloadPath
+		d.result.Path = filepath.Join(m.dir, ev.GUID)
+		delete(m.active, ev.GUID)
+		d.done <- nil
+	case browser.DownloadProgressStateCanceled:
+		delete(m.active, ev.GUID)
+		d.done <- ErrDownloadCanceled
+	}
+}
+
+// wait blocks until the download finishes or ctx is done.
+func (d *download) wait(ctx context.Context) (DownloadResult, error) {
+	select {
+	case err := <-d.done:
+		return d.result, err
+	case <-ctx.Done():
+		return DownloadResult{URL: d.url}, ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+)
+
+func Test_downloadManager(t *testing.T) {
+	m := newDownloadManager("/tmp/downloads")
+
+	d1 := m.expect("https://example.com/one.csv", "f1")
+	d2 := m.expect("https://example.com/two.ics", "f2")
+	d3 := m.expect("https://example.com/three.pdf", "f3")
+	d4 := m.expect("https://example.com/four.pdf", "f4")
+	d5 := m.expect("https://example.com/five.pdf", "f5")
+	d6 := m.expect("https://example.com/six.pdf", "f5")
+
+	// Begin out of order, and finish overlapping
+	m.handleEvent(&browser.EventDownloadWillBegin{GUID: "g2", URL: "https://example.com/two.ics", SuggestedFilename: "calendar.ics"})
+	m.handleEvent(&browser.EventDownloadWillBegin{GUID: "g1", URL: "https://example.com/one.csv", SuggestedFilename: "export.csv"})
+	m.handleEvent(&browser.EventDownloadWillBegin{GUID: "g3", URL: "https://example.com/redirected.pdf", FrameID: "f3"})
+	// A redirect in a frame with two waiters is not guessed at
+	m.handleEvent(&browser.EventDownloadWillBegin{GUID: "g5", URL: "https://example.com/redirected.pdf", FrameID: "f5"})
+	m.handleEvent(&browser.EventDownloadProgress{GUID: "g1", State: browser.DownloadProgressStateInProgress, ReceivedBytes: 5, TotalBytes: 10})
+	m.handleEvent(&browser.EventDownloadProgress{GUID: "g2", State: browser.DownloadProgressStateCompleted, ReceivedBytes: 3, TotalBytes: 3})
+	m.handleEvent(&browser.EventDownloadProgress{GUID: "g1", State: browser.DownloadProgressStateCompleted, ReceivedBytes: 10, TotalBytes: 10})
+	m.handleEvent(&browser.EventDownloadProgress{GUID: "g3", State: browser.DownloadProgressStateCanceled})
+
+	// Stray events must not panic
+	m.handleEvent(&browser.EventDownloadProgress{GUID: "g1", State: browser.DownloadProgressStateCompleted})
+	// Nor is a download from another frame handed to the oldest waiter
+	m.handleEvent(&browser.EventDownloadWillBegin{GUID: "g4", URL: "https://example.com/stray", FrameID: "f9"})
+	m.handleEvent(&browser.EventDownloadProgress{GUID: "g4", State: browser.DownloadProgressStateCompleted})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r1, err := d1.wait(ctx)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if r1.GUID != "g1" || r1.SuggestedFilename != "export.csv" || r1.Path != filepath.Join("/tmp/downloads", "g1") {
+		t.Fatalf("ERR: unexpected result %#v", r1)
+	}
+
+	r2, err := d2.wait(ctx)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if r2.GUID != "g2" || r2.SuggestedFilename != "calendar.ics" {
+		t.Fatalf("ERR: unexpected result %#v", r2)
+	}
+
+	_, err = d3.wait(ctx)
+	if !errors.Is(err, ErrDownloadCanceled) {
+		t.Fatalf("ERR: expected cancellation, got %v", err)
+	}
+
+	for _, d := range []*download{d5, d6} {
+		if _, err = d.wait(ctx); !errors.Is(err, ErrDownloadAmbiguous) {
+			t.Fatalf("ERR: expected an ambiguous download, got %v", err)
+		}
+	}
+
+	if len(m.pending) != 1 || m.pending[0] != d4 {
+		t.Fatalf("ERR: expected only the unmatched request to be pending, got %d", len(m.pending))
+	}
+	m.forget(d4)
+	if len(m.pending) != 0 || len(m.active) != 0 {
+		t.Fatalf("ERR: leftover state pending=%d active=%d", len(m.pending), len(m.active))
+	}
+}
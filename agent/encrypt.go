@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	// EncryptedSuffix is appended to the name of every encrypted file.
+	EncryptedSuffix = ".age"
+)
+
+// ParseRecipients builds age recipients from a list of specifications,
+// each either an X25519 public key ("age1...") or the path of a recipients
+// file holding one key per line. A non-empty passphrase adds a scrypt
+// recipient instead; age does not allow a passphrase to be combined with
+// public keys, so giving both is an error.
+func ParseRecipients(specs []string, passphrase string) ([]age.Recipient, error) {
+	out := make([]age.Recipient, 0)
+
+	if passphrase != "" {
+		for _, spec := range specs {
+			if strings.TrimSpace(spec) != "" {
+				return out, fmt.Errorf("a passphrase cannot be combined with recipients")
+			}
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, r)
+	}
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if strings.HasPrefix(spec, "age1") {
+			r, err := age.ParseX25519Recipient(spec)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, r)
+			continue
+		}
+
+		fp, err := os.Open(spec)
+		if err != nil {
+			return out, fmt.Errorf("recipients file %s: %w", spec, err)
+		}
+		rs, err := age.ParseRecipients(fp)
+		fp.Close()
+		if err != nil {
+			return out, fmt.Errorf("recipients file %s: %w", spec, err)
+		}
+		out = append(out, rs...)
+	}
+
+	return out, nil
+}
+
+// ParseIdentities loads the age identities used to decrypt an export, from
+// an identity file and/or a passphrase.
+func ParseIdentities(identityFile, passphrase string) ([]age.Identity, error) {
+	out := make([]age.Identity, 0)
+
+	if passphrase != "" {
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, id)
+	}
+
+	if identityFile != "" {
+		fp, err := os.Open(identityFile)
+		if err != nil {
+			return out, err
+		}
+		ids, err := age.ParseIdentities(fp)
+		fp.Close()
+		if err != nil {
+			return out, fmt.Errorf("identity file %s: %w", identityFile, err)
+		}
+		out = append(out, ids...)
+	}
+
+	if len(out) == 0 {
+		return out, fmt.Errorf("no identity or passphrase given")
+	}
+	return out, nil
+}
+
+// encryptedWriter encrypts everything written to it into an underlying
+// writer, closing both when closed.
+type encryptedWriter struct {
+	io.WriteCloser
+	out io.WriteCloser
+}
+
+func (w *encryptedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if cerr := w.out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NewEncryptedWriter returns a writer which encrypts to recipients into w.
+// Closing it finishes the encryption and closes w.
+func NewEncryptedWriter(w io.WriteCloser, recipients ...age.Recipient) (io.WriteCloser, error) {
+	ew, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedWriter{WriteCloser: ew, out: w}, nil
+}
+
+// EncryptingSink encrypts each file individually before it reaches the
+// underlying sink, adding EncryptedSuffix to its name. Plaintext is only
+// ever held in memory. Files written earlier can only be read back when
+// Identities holds a key for one of the recipients.
+type EncryptingSink struct {
+	Sink       Sink
+	Recipients []age.Recipient
+	Identities []age.Identity
+}
+
+func NewEncryptingSink(s Sink, recipients ...age.Recipient) *EncryptingSink {
+	return &EncryptingSink{Sink: s, Recipients: recipients}
+}
+
+func (s *EncryptingSink) Create(name string) (io.WriteCloser, error) {
+	w, err := s.Sink.Create(name + EncryptedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	ew, err := NewEncryptedWriter(w, s.Recipients...)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (s *EncryptingSink) Open(name string) (io.ReadCloser, error) {
+	sr, ok := s.Sink.(SinkReader)
+	if !ok {
+		return nil, fmt.Errorf("%s: sink cannot be read back", name)
+	}
+	if len(s.Identities) == 0 {
+		return nil, fmt.Errorf("%s: no identity to decrypt with", name)
+	}
+	f, err := sr.Open(name + EncryptedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(f, s.Identities...)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+func (s *EncryptingSink) Exists(name string) (bool, error) {
+	sr, ok := s.Sink.(SinkReader)
+	if !ok {
+		return false, fmt.Errorf("%s: sink cannot be read back", name)
+	}
+	return sr.Exists(name + EncryptedSuffix)
+}
+
+func (s *EncryptingSink) Close() error {
+	return s.Sink.Close()
+}
+
+// decryptingFS reads an export whose files were encrypted individually,
+// as EncryptingSink writes them, as if it were plain.
+type decryptingFS struct {
+	fsys       fs.FS
+	identities []age.Identity
+}
+
+// NewDecryptingFS returns a file system which reads each file of fsys from
+// its encrypted copy (the name with EncryptedSuffix added) when there is
+// one, decrypting it in memory. Plain files are read as they are.
+func NewDecryptingFS(fsys fs.FS, identities ...age.Identity) fs.ReadFileFS {
+	return &decryptingFS{fsys: fsys, identities: identities}
+}
+
+func (d *decryptingFS) Open(name string) (fs.File, error) {
+	return d.fsys.Open(name)
+}
+
+func (d *decryptingFS) ReadFile(name string) ([]byte, error) {
+	f, err := d.fsys.Open(name + EncryptedSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fs.ReadFile(d.fsys, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var b bytes.Buffer
+	err = Decrypt(&b, f, d.identities...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name+EncryptedSuffix, err)
+	}
+	return b.Bytes(), nil
+}
+
+// Decrypt decrypts an age encrypted stream from src into dst.
+func Decrypt(dst io.Writer, src io.Reader, identities ...age.Identity) error {
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
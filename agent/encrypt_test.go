@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func Test_EncryptingSink(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	rs, err := ParseRecipients([]string{id.Recipient().String()}, "")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	dir := t.TempDir()
+	s, err := OpenSink(dir, rs...)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	err = WriteFile(s, "users/411472.json", []byte(`{"ssn":"000-00-0000"}`))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	s.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, "users", "411472.json")); err == nil {
+		t.Fatalf("ERR: plaintext file was written")
+	}
+	enc, err := os.ReadFile(filepath.Join(dir, "users", "411472.json.age"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if bytes.Contains(enc, []byte("000-00-0000")) {
+		t.Fatalf("ERR: file is not encrypted")
+	}
+
+	var out bytes.Buffer
+	err = Decrypt(&out, bytes.NewReader(enc), id)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if out.String() != `{"ssn":"000-00-0000"}` {
+		t.Fatalf("ERR: unexpected plaintext %q", out.String())
+	}
+}
+
+func Test_EncryptedArchive(t *testing.T) {
+	rs, err := ParseRecipients(nil, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	target := filepath.Join(t.TempDir(), "export.tar.gz")
+	s, err := OpenSink(target, rs...)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	WriteFile(s, "incident/76400195/incident.html", []byte("<html>patient</html>"))
+	if err := s.Close(); err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	if _, err := os.Stat(target); err == nil {
+		t.Fatalf("ERR: plaintext archive was written")
+	}
+	fp, err := os.Open(target + EncryptedSuffix)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	defer fp.Close()
+
+	ids, err := ParseIdentities("", "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	var out bytes.Buffer
+	err = Decrypt(&out, fp, ids...)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if out.Len() == 0 || out.Bytes()[0] != 0x1f {
+		t.Fatalf("ERR: decrypted data is not a gzip stream")
+	}
+}
+
+func Test_ParseRecipients_PassphraseAndKeys(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	_, err = ParseRecipients([]string{id.Recipient().String()}, "correct horse battery staple")
+	if err == nil {
+		t.Fatalf("ERR: passphrase and recipients accepted together")
+	}
+}
+
+func Test_DecryptingFS(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	dest := t.TempDir()
+	s := NewEncryptingSink(NewDirSink(dest), id.Recipient())
+	WriteFile(s, "training/42/attendance.json", []byte(`{"rows":[]}`))
+	WriteFile(NewDirSink(dest), "training/lookup.csv", []byte("Class ID\n"))
+
+	fsys := NewDecryptingFS(os.DirFS(dest), id)
+	for name, expected := range map[string]string{
+		"training/42/attendance.json": `{"rows":[]}`,
+		"training/lookup.csv":         "Class ID\n",
+	} {
+		data, err := fsys.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+		if string(data) != expected {
+			t.Fatalf("ERR: %s: unexpected %q", name, string(data))
+		}
+	}
+}
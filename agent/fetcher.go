@@ -0,0 +1,277 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Fetcher retrieves data from Emergency Reporting on behalf of the dataset
+// methods, so that the parsing in those methods does not depend on how the
+// data is actually transported.
+type Fetcher interface {
+	// Get returns the raw body of a page or file.
+	Get(url string) ([]byte, error)
+	// GetJSON returns the raw body of a JSON web service call.
+	GetJSON(url string) ([]byte, error)
+	// Open streams the file served at url, such as an export which ER only
+	// offers as a download, without staging it on disk. The caller must
+	// close it.
+	Open(url string) (io.ReadCloser, error)
+	// Post posts data as JSON to url and returns the response body.
+	Post(url string, data map[string]any) ([]byte, error)
+	// APIGet calls the api.emergencyreporting.com API with the access token
+	// embedded in hostPage.
+	APIGet(hostPage, apiUrl string) ([]byte, error)
+}
+
+// fetcher returns the Fetcher dataset methods should use, defaulting to the
+// agent's browser session.
+func (a *Agent) fetcher() Fetcher {
+	if a.Fetcher != nil {
+		return a.Fetcher
+	}
+	return &chromeFetcher{a: a}
+}
+
+// chromeFetcher fetches through the agent's logged in Chrome session. Pages
+// and files, downloads included, are fetched natively with the browser's
+// cookies, since navigating to them only yields the rendered DOM (and
+// downloading through the browser would stage them on disk); posts and API
+// tokens go through the browser itself.
+type chromeFetcher struct {
+	a *Agent
+}
+
+func (f *chromeFetcher) Get(url string) ([]byte, error) {
+	return f.a.authorizedNativeGet(url)
+}
+
+func (f *chromeFetcher) GetJSON(url string) ([]byte, error) {
+	return f.a.authorizedJsonGet(url)
+}
+
+func (f *chromeFetcher) Open(url string) (io.ReadCloser, error) {
+	return f.a.authorizedNativeOpen(url)
+}
+
+func (f *chromeFetcher) Post(url string, data map[string]any) ([]byte, error) {
+	return f.a.authorizedPost(url, data)
+}
+
+func (f *chromeFetcher) APIGet(hostPage, apiUrl string) ([]byte, error) {
+	return f.a.authorizedApiGetCall(hostPage, apiUrl)
+}
+
+// NativeFetcher fetches using net/http alone, without a browser. It needs
+// session cookies from an existing login, such as those returned by
+// Agent.NativeFetcher.
+type NativeFetcher struct {
+	Client *http.Client
+}
+
+// NewNativeFetcher creates a NativeFetcher which presents the given session
+// cookies to Emergency Reporting.
+func NewNativeFetcher(cookies []*http.Cookie) *NativeFetcher {
+	jar, _ := cookiejar.New(nil)
+	for _, host := range []string{"https://secure.emergencyreporting.com/", "https://api.emergencyreporting.com/"} {
+		u, _ := url.Parse(host)
+		jar.SetCookies(u, cookies)
+	}
+	return &NativeFetcher{
+		Client: &http.Client{Jar: jar},
+	}
+}
+
+// NativeFetcher returns a NativeFetcher carrying the agent's current session
+// cookies, with its traffic captured, recorded or replayed like the
+// agent's own native requests.
+func (a *Agent) NativeFetcher() *NativeFetcher {
+	a.l.Lock()
+	cookies := make([]*http.Cookie, 0, len(a.cookies))
+	for _, c := range a.cookies {
+		cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value, Path: "/"})
+	}
+	a.l.Unlock()
+
+	f := NewNativeFetcher(cookies)
+	f.Client.Transport = a.nativeClient().Transport
+	return f
+}
+
+func (f *NativeFetcher) do(req *http.Request) ([]byte, *http.Response, error) {
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return []byte{}, resp, err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return out, resp, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return out, resp, fmt.Errorf("could not get url %s: %s", req.URL, resp.Status)
+	}
+	return out, resp, nil
+}
+
+func (f *NativeFetcher) Get(url string) ([]byte, error) {
+	log.Printf("NativeFetcher.Get(%s)", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	out, _, err := f.do(req)
+	return out, err
+}
+
+func (f *NativeFetcher) GetJSON(url string) ([]byte, error) {
+	log.Printf("NativeFetcher.GetJSON(%s)", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	req.Header.Set("Accept", "application/json, text/javascript, */*; q=0.01")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+
+	out, resp, err := f.do(req)
+	if err != nil {
+		return out, err
+	}
+	err = checkJsonContentType(resp.Header.Get("Content-Type"), out)
+	if err != nil {
+		return out, fmt.Errorf("url %s: %w", url, err)
+	}
+	return out, nil
+}
+
+func (f *NativeFetcher) Open(url string) (io.ReadCloser, error) {
+	log.Printf("NativeFetcher.Open(%s)", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not get url %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (f *NativeFetcher) Post(url string, data map[string]any) ([]byte, error) {
+	log.Printf("NativeFetcher.Post(%s)", url)
+	b, err := json.Marshal(data)
+	if err != nil {
+		return []byte{}, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return []byte{}, err
+	}
+	out, _, err := f.do(req)
+	return out, err
+}
+
+func (f *NativeFetcher) APIGet(hostPage, apiUrl string) ([]byte, error) {
+	log.Printf("NativeFetcher.APIGet(%s, %s)", hostPage, apiUrl)
+	page, err := f.Get(hostPage)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	gq, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return []byte{}, err
+	}
+	accessToken, exists := gq.Find("#accessToken").Attr("value")
+	if !exists || accessToken == "" {
+		return []byte{}, fmt.Errorf("%w: no access token on %s", ErrNotAuthorized, hostPage)
+	}
+
+	req, err := http.NewRequest("GET", apiUrl, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	req.Header.Set("Authorization", accessToken)
+	out, _, err := f.do(req)
+	return out, err
+}
+
+// MemoryFetcher serves canned responses from memory, for exercising the
+// dataset methods without Emergency Reporting. Responses are keyed by URL
+// (the API URL for APIGet); unknown URLs return an error.
+type MemoryFetcher struct {
+	Responses map[string][]byte
+	Errors    map[string]error
+
+	// Requests records every URL requested, in order.
+	Requests []string
+	l        sync.Mutex
+}
+
+func NewMemoryFetcher() *MemoryFetcher {
+	return &MemoryFetcher{
+		Responses: map[string][]byte{},
+		Errors:    map[string]error{},
+		Requests:  make([]string, 0),
+	}
+}
+
+func (f *MemoryFetcher) lookup(url string) ([]byte, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.Requests = append(f.Requests, url)
+	if err, ok := f.Errors[url]; ok {
+		return []byte{}, err
+	}
+	out, ok := f.Responses[url]
+	if !ok {
+		return []byte{}, fmt.Errorf("no response for %s", url)
+	}
+	return out, nil
+}
+
+func (f *MemoryFetcher) Get(url string) ([]byte, error) {
+	return f.lookup(url)
+}
+
+func (f *MemoryFetcher) GetJSON(url string) ([]byte, error) {
+	out, err := f.lookup(url)
+	if err != nil {
+		return out, err
+	}
+	if !json.Valid(out) {
+		return out, fmt.Errorf("url %s: %w", url, ErrUnexpectedContentType)
+	}
+	return out, nil
+}
+
+func (f *MemoryFetcher) Open(url string) (io.ReadCloser, error) {
+	out, err := f.lookup(url)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
+
+func (f *MemoryFetcher) Post(url string, data map[string]any) ([]byte, error) {
+	return f.lookup(url)
+}
+
+func (f *MemoryFetcher) APIGet(hostPage, apiUrl string) ([]byte, error) {
+	return f.lookup(apiUrl)
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testMemoryAgent returns an agent which fetches the responses set on the
+// returned MemoryFetcher, by URL, and writes to a temporary directory.
+func testMemoryAgent(t *testing.T) (*Agent, *MemoryFetcher, string) {
+	f := NewMemoryFetcher()
+	dest := t.TempDir()
+	return &Agent{Fetcher: f, Output: NewDirSink(dest)}, f, dest
+}
+
+func Test_MemoryFetcher_GetIncidentIDs(t *testing.T) {
+	a, f, _ := testMemoryAgent(t)
+	f.Responses["https://secure.emergencyreporting.com/nfirs/main_results.asp?pagenumber=1"] = []byte(`<html><body><table>
+<tr><td class="listout" onclick="viewIncident('1001')">1001</td><td class="listout" onclick="viewIncident('1001')">Fire</td></tr>
+<tr><td class="listout" onclick="viewIncident('1002')">1002</td></tr>
+<tr><td class="listout">no link</td></tr>
+</table><button id="button4">Next</button></body></html>`)
+	f.Responses["https://secure.emergencyreporting.com/nfirs/main_results.asp?pagenumber=2"] = []byte(`<html><body><table>
+<tr><td class="listout" onclick="viewIncident('1003')">1003</td></tr>
+</table><button id="button4" disabled>Next</button></body></html>`)
+
+	ids, err := a.GetIncidentIDs()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	sort.Strings(ids)
+	if len(ids) != 3 || ids[0] != "1001" || ids[1] != "1002" || ids[2] != "1003" {
+		t.Fatalf("ERR: unexpected ids %#v", ids)
+	}
+}
+
+func Test_MemoryFetcher_DownloadTrainingAssets(t *testing.T) {
+	a, f, dest := testMemoryAgent(t)
+	f.Responses["https://secure.emergencyreporting.com/training/ws/class_files.php?classid=42&_function=list_json"] = []byte(`{
+		"rows": [
+			{"id": "7", "cell": ["Hose Lays.pptx", "Slides", "Members"]},
+			{"id": "8", "cell": ["Roster.pdf", "Sign in sheet", "Officers"]},
+			{"id": "9", "cell": ["short"]},
+			{"id": "10", "cell": ["../Roster.pdf", "Crafted", "Members"]},
+			{"id": "11", "cell": ["Roster.pdf", "Same title", "Members"]}
+		]}`)
+	f.Responses["https://secure.emergencyreporting.com/training/ws/class_files.php?classid=42&id=7&_function=detail"] = []byte(
+		`{"accesslevel":"1","description":"Slides","fileguid":"AAA","name":"Hose Lays.pptx","url":""}`)
+	f.Responses["https://secure.emergencyreporting.com/training/ws/class_files.php?classid=42&id=8&_function=detail"] = []byte(
+		`{"accesslevel":"2","description":"Sign in sheet","fileguid":"BBB","name":"Roster.pdf","url":""}`)
+	f.Responses["https://secure.emergencyreporting.com/training/ws/class_files.php?classid=42&id=10&_function=detail"] = []byte(
+		`{"accesslevel":"2","description":"Crafted","fileguid":"CCC","name":"../Roster.pdf","url":""}`)
+	f.Responses["https://secure.emergencyreporting.com/training/ws/class_files.php?classid=42&id=11&_function=detail"] = []byte(
+		`{"accesslevel":"2","description":"Same title","fileguid":"DDD","name":"Roster.pdf","url":""}`)
+	f.Responses["https://secure.emergencyreporting.com/filedownload.php?fileguid=DDD&contentdisposition=attachment"] = []byte("second roster")
+	f.Responses["https://secure.emergencyreporting.com/filedownload.php?fileguid=CCC&contentdisposition=attachment"] = []byte("other pdf")
+	f.Responses["https://secure.emergencyreporting.com/filedownload.php?fileguid=AAA&contentdisposition=attachment"] = []byte("pptx data")
+	f.Responses["https://secure.emergencyreporting.com/filedownload.php?fileguid=BBB&contentdisposition=attachment"] = []byte("pdf data")
+
+	err := a.DownloadTrainingAssets(42, "training/42")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	for fn, expected := range map[string]string{"Hose Lays.pptx": "pptx data", "Roster.pdf": "pdf data", ".._Roster.pdf": "other pdf", "Roster-DDD.pdf": "second roster"} {
+		b, err := os.ReadFile(filepath.Join(dest, "training", "42", fn))
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+		if string(b) != expected {
+			t.Fatalf("ERR: %s: expected %q, got %q", fn, expected, string(b))
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dest, "training", "42", "files.json"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if !strings.Contains(string(b), `"title": "../Roster.pdf"`) {
+		t.Fatalf("ERR: files.json lost its title key: %s", string(b))
+	}
+	var files []TrainingFile
+	err = json.Unmarshal(b, &files)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(files) != 4 {
+		t.Fatalf("ERR: expected 4 files, got %d", len(files))
+	}
+	for _, fi := range files {
+		if fi.ID == "10" && (fi.Title != "../Roster.pdf" || fi.OriginalName != "../Roster.pdf" || fi.FileName != ".._Roster.pdf" || fi.AccessLevel != "2" ||
+			fi.Description != "Crafted" || fi.Size != 9 || fi.ContentType != "application/pdf" || fi.Status != TrainingFileDownloaded) {
+			t.Fatalf("ERR: unexpected metadata %#v", fi)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// TrainingClassFilter selects classes from the class list. Empty fields
+// select everything; set fields must all match.
+type TrainingClassFilter struct {
+	// From and To bound the class date, From inclusive and To exclusive.
+	// Classes without a date are left out when either is set.
+	From time.Time
+	To   time.Time
+	// Categories and Stations are matched without regard to case.
+	Categories []string
+	Stations   []string
+	IDs        map[int]bool
+}
+
+// Match reports whether a class is selected.
+func (f TrainingClassFilter) Match(c TrainingClass) bool {
+	if !f.From.IsZero() || !f.To.IsZero() {
+		if c.Date.IsZero() {
+			return false
+		}
+		// Class dates carry no time zone, so compare them as wall clock
+		// times in the location of the bounds.
+		d := time.Date(c.Date.Year(), c.Date.Month(), c.Date.Day(),
+			c.Date.Hour(), c.Date.Minute(), c.Date.Second(), 0, f.location())
+		if !f.From.IsZero() && d.Before(f.From) {
+			return false
+		}
+		if !f.To.IsZero() && !d.Before(f.To) {
+			return false
+		}
+	}
+	if len(f.Categories) > 0 && !matchFold(f.Categories, c.Category) {
+		return false
+	}
+	if len(f.Stations) > 0 && !matchFold(f.Stations, c.Station) {
+		return false
+	}
+	if len(f.IDs) > 0 && !f.IDs[c.ClassID] {
+		return false
+	}
+	return true
+}
+
+func (f TrainingClassFilter) location() *time.Location {
+	if !f.From.IsZero() {
+		return f.From.Location()
+	}
+	return f.To.Location()
+}
+
+// Filter returns the rows of the class list whose classes match.
+func (f TrainingClassFilter) Filter(ix TrainingIndex) TrainingIndex {
+	rows := make([]int, 0)
+	for i := range ix.Rows {
+		if f.Match(ix.Class(i)) {
+			rows = append(rows, i)
+		}
+	}
+	return ix.Select(rows)
+}
+
+func matchFold(list []string, s string) bool {
+	s = strings.TrimSpace(s)
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseClassIDs parses class IDs separated by commas, spaces or new lines,
+// as given on the command line or in a file. Lines starting with # are
+// comments.
+func ParseClassIDs(s string) (map[int]bool, error) {
+	out := map[int]bool{}
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}) {
+			id, err := strconv.Atoi(field)
+			if err != nil || id <= 0 {
+				return out, fmt.Errorf("bad class ID %q", field)
+			}
+			out[id] = true
+		}
+	}
+	return out, nil
+}
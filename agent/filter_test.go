@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TrainingClassFilter(t *testing.T) {
+	full := [][]string{
+		{"1", "Hose Lays", "9/1/2024 19:00", "2", "Company", "Station 1"},
+		{"2", "Ladders", "9/30/2024 23:30", "2", "Company", "Station 2"},
+		{"3", "Pump Ops", "10/1/2024 00:00", "2", "Driver", "Station 1"},
+		{"4", "Undated", "", "2", "Company", "Station 1"},
+	}
+	ix := TrainingIndex{Header: TrainingClassColumns, Rows: full}
+
+	sept := TrainingClassFilter{
+		From: time.Date(2024, 9, 1, 0, 0, 0, 0, time.Local),
+		To:   time.Date(2024, 10, 1, 0, 0, 0, 0, time.Local),
+	}
+	sel := sept.Filter(ix)
+	got := sel.IDs()
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 || sel.Rows[1][1] != "Ladders" {
+		t.Fatalf("ERR: unexpected classes %v", got)
+	}
+
+	got = TrainingClassFilter{Categories: []string{"company"}, Stations: []string{"station 1"}}.Filter(ix).IDs()
+	if len(got) != 2 || got[0] != 1 || got[1] != 4 {
+		t.Fatalf("ERR: unexpected classes %v", got)
+	}
+
+	list, err := ParseClassIDs("3, 4\n# comment 5\n2\n")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	got = TrainingClassFilter{IDs: list, Stations: []string{"Station 1"}}.Filter(ix).IDs()
+	if len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Fatalf("ERR: unexpected classes %v", got)
+	}
+
+	if _, err = ParseClassIDs("12,abc"); err == nil {
+		t.Fatalf("ERR: expected an error for a bad class ID")
+	}
+
+	got = TrainingClassFilter{}.Filter(ix).IDs()
+	if len(got) != len(full) {
+		t.Fatalf("ERR: empty filter dropped classes: %v", got)
+	}
+}
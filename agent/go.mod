@@ -5,11 +5,14 @@ go 1.23
 toolchain go1.23.0
 
 require (
+	filippo.io/age v1.2.1
 	github.com/PuerkitoBio/goquery v1.9.1
 	github.com/chromedp/cdproto v0.0.0-20240417023356-ab6d61991462
 	github.com/chromedp/chromedp v0.9.5
+	github.com/dayvillefire/er-scraper/nfirs v0.0.0-00010101000000-000000000000
 	github.com/jbuchbinder/shims v0.0.0-20240327163617-a815b7a98986
 	github.com/joho/godotenv v1.5.1
+	github.com/teambition/rrule-go v1.8.2
 )
 
 require (
@@ -20,6 +23,9 @@ require (
 	github.com/gobwas/ws v1.3.2 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/mailru/easyjson v0.7.7 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/net v0.24.0 // indirect
-	golang.org/x/sys v0.19.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
+
+replace github.com/dayvillefire/er-scraper/nfirs => ../nfirs
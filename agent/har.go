@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// HAR 1.2 document structure, limited to the fields we can populate. See
+// http://www.softwareishard.com/blog/har-12-spec/
+
+type harLog struct {
+	Log harLogBody `json:"log"`
+}
+
+type harLogBody struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// redactedHeaders are replaced in HAR output unless the capture policy
+// asks to keep credentials.
+var redactedHeaders = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+}
+
+// redactedFields matches the names of form and JSON fields masked in
+// request and response bodies, such as the login form's, unless the
+// capture policy asks to keep credentials.
+var redactedFields = regexp.MustCompile(`(?i)pass|pwd|user|login|token|secret|auth|session|csrf`)
+
+// redactBody masks credential fields in a form or JSON body, sent or
+// received. Bodies of any other type, such as pages carrying an access
+// token, are dropped entirely, since their fields cannot be told apart.
+func redactBody(mimeType string, body []byte) string {
+	if b, ok := redactFields(mimeType, body); ok {
+		return string(b)
+	}
+	return "REDACTED"
+}
+
+// redactFields masks the fields named by redactedFields in a form or JSON
+// body. It reports false for bodies of other types, or which do not parse.
+func redactFields(mimeType string, body []byte) ([]byte, bool) {
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		v, err := url.ParseQuery(string(body))
+		if err != nil {
+			break
+		}
+		for k := range v {
+			if redactedFields.MatchString(k) {
+				v[k] = []string{"REDACTED"}
+			}
+		}
+		return []byte(v.Encode()), true
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		var doc any
+		if json.Unmarshal(body, &doc) != nil {
+			break
+		}
+		b, err := json.Marshal(redactJSON(doc))
+		if err != nil {
+			break
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+func redactJSON(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, item := range t {
+			if redactedFields.MatchString(k) {
+				t[k] = "REDACTED"
+			} else {
+				t[k] = redactJSON(item)
+			}
+		}
+	case []any:
+		for i, item := range t {
+			t[i] = redactJSON(item)
+		}
+	}
+	return v
+}
+
+// headerValue looks up a header regardless of the case it was captured in.
+func headerValue(h map[string]string, name string) string {
+	for k, v := range h {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// WriteHAR writes the captured network traffic to w as a HAR 1.2 document,
+// suitable for loading into browser developer tools or a HAR viewer.
+func (a *Agent) WriteHAR(w io.Writer) error {
+	out := harLog{
+		Log: harLogBody{
+			Version: "1.2",
+			Creator: harCreator{Name: "er-scraper", Version: "1"},
+			Entries: make([]harEntry, 0),
+		},
+	}
+
+	if a.capture != nil {
+		for _, e := range a.capture.snapshot() {
+			out.Log.Entries = append(out.Log.Entries, e.har(a.capture.policy.KeepCredentials))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// SaveHAR writes the captured network traffic to a HAR file.
+func (a *Agent) SaveHAR(path string) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = a.WriteHAR(fp)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (e captureEntry) har(keepCredentials bool) harEntry {
+	h := harEntry{
+		StartedDateTime: e.Started.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Request: harRequest{
+			Method:      e.Method,
+			URL:         e.URL,
+			HTTPVersion: harHTTPVersion(e.Protocol),
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.RequestHeaders, keepCredentials),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(e.RequestBody),
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  e.StatusText,
+			HTTPVersion: harHTTPVersion(e.Protocol),
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.ResponseHeaders, keepCredentials),
+			Content: harContent{
+				Size:     e.BodySize,
+				MimeType: e.MimeType,
+			},
+			HeadersSize: -1,
+			BodySize:    e.BodySize,
+		},
+		Comment: e.Error,
+	}
+
+	if u, err := url.Parse(e.URL); err == nil {
+		for k, vs := range u.Query() {
+			for _, v := range vs {
+				h.Request.QueryString = append(h.Request.QueryString, harNameValue{Name: k, Value: v})
+			}
+		}
+		sort.Slice(h.Request.QueryString, func(i, j int) bool {
+			return h.Request.QueryString[i].Name < h.Request.QueryString[j].Name
+		})
+	}
+
+	if len(e.RequestBody) > 0 {
+		mimeType := headerValue(e.RequestHeaders, "Content-Type")
+		text := string(e.RequestBody)
+		if !keepCredentials {
+			text = redactBody(mimeType, e.RequestBody)
+		}
+		h.Request.PostData = &harPostData{MimeType: mimeType, Text: text}
+	}
+
+	switch {
+	case !keepCredentials && len(e.Body) > 0:
+		h.Response.Content.Text = redactBody(e.MimeType, e.Body)
+	case utf8.Valid(e.Body):
+		h.Response.Content.Text = string(e.Body)
+	default:
+		h.Response.Content.Text = base64.StdEncoding.EncodeToString(e.Body)
+		h.Response.Content.Encoding = "base64"
+	}
+	if e.BodyTruncated {
+		h.Response.Content.Comment = "truncated by capture policy"
+	}
+	h.Response.RedirectURL = headerValue(e.ResponseHeaders, "Location")
+
+	if !e.Finished.IsZero() {
+		h.Time = ms(e.Finished.Sub(e.Started).Seconds())
+	}
+	if !e.Responded.IsZero() {
+		h.Timings.Wait = ms(e.Responded.Sub(e.Started).Seconds())
+		if !e.Finished.IsZero() {
+			h.Timings.Receive = ms(e.Finished.Sub(e.Responded).Seconds())
+		}
+	}
+
+	return h
+}
+
+func harHeaders(h map[string]string, keepCredentials bool) []harNameValue {
+	out := make([]harNameValue, 0, len(h))
+	for k, v := range h {
+		if !keepCredentials && redactedHeaders[strings.ToLower(k)] {
+			v = "REDACTED"
+		}
+		out = append(out, harNameValue{Name: k, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func harHTTPVersion(protocol string) string {
+	switch strings.ToLower(protocol) {
+	case "", "http/1.1":
+		return "HTTP/1.1"
+	case "h2", "http/2.0":
+		return "HTTP/2.0"
+	case "h3":
+		return "HTTP/3"
+	}
+	return strings.ToUpper(protocol)
+}
+
+func ms(secs float64) float64 {
+	return float64(int64(secs*1e6)) / 1e3
+}
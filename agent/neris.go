@@ -0,0 +1,338 @@
+package agent
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// NERISSourceEID is the source naming an incident's EID, rather than one of
+// its fields.
+const NERISSourceEID = "EID"
+
+// NERIS rule transforms.
+const (
+	// NERISText keeps the value as text.
+	NERISText = ""
+	// NERISDateTime converts an ER date and time, taken as local time, to
+	// RFC 3339.
+	NERISDateTime = "datetime"
+	// NERISNumber converts an amount, ignoring dollar signs and thousands
+	// separators, to a number.
+	NERISNumber = "number"
+	// NERISList splits a comma separated value into a list.
+	NERISList = "list"
+)
+
+// NERISRule fills one field of a NERIS incident document.
+type NERISRule struct {
+	// Path is the field's dotted path in the document, such as
+	// "dispatch.call_create".
+	Path string `json:"path"`
+	// Sources are the ER fields the value is taken from, tried in order,
+	// with the first one holding a value used. Fields are looked up in the
+	// incident list CSV, then the incident detail, ignoring case, spaces
+	// and punctuation.
+	Sources   []string `json:"sources"`
+	Transform string   `json:"transform,omitempty"`
+}
+
+// NERISMapping is how ER incident fields fill NERIS incident documents. It
+// is saved as JSON, a list of NERISRules.
+type NERISMapping []NERISRule
+
+// DefaultNERISMapping maps the fields of ER's incident list and printable
+// incident view, under the names they have been seen with. NFIRS codes,
+// such as the incident type, are carried over as they are; translating
+// them to NERIS's own value sets is left to the system ingesting them.
+var DefaultNERISMapping = NERISMapping{
+	{Path: "base.source_incident_id", Sources: []string{NERISSourceEID}},
+	{Path: "base.incident_number", Sources: []string{"Incident Number", "Incident #", "Incident No"}},
+	{Path: "base.station", Sources: []string{"Station"}},
+	{Path: "base.shift", Sources: []string{"Shift"}},
+	{Path: "base.district", Sources: []string{"District"}},
+	{Path: "base.nfirs_incident_type", Sources: []string{"Incident Type", "Incident Type Code"}},
+	{Path: "base.nfirs_property_use", Sources: []string{"Property Use"}},
+	{Path: "base.aid", Sources: []string{"Aid Given or Received", "Aid Given/Received"}},
+	{Path: "base.actions_taken", Sources: []string{"Actions Taken"}, Transform: NERISList},
+	{Path: "base.outcome_narrative", Sources: []string{"Narrative", "Remarks"}},
+	{Path: "dispatch.call_create", Sources: []string{"Alarm Date/Time", "Alarm Time", "Alarm Date"}, Transform: NERISDateTime},
+	{Path: "dispatch.first_unit_arrived", Sources: []string{"Arrival Date/Time", "Arrival Time"}, Transform: NERISDateTime},
+	{Path: "dispatch.incident_controlled", Sources: []string{"Controlled Date/Time", "Controlled Time"}, Transform: NERISDateTime},
+	{Path: "dispatch.incident_clear", Sources: []string{"Last Unit Cleared", "Cleared Date/Time", "Cleared Time"}, Transform: NERISDateTime},
+	{Path: "location.address", Sources: []string{"Address", "Street Address", "Location"}},
+	{Path: "location.city", Sources: []string{"City"}},
+	{Path: "location.state", Sources: []string{"State"}},
+	{Path: "location.postal_code", Sources: []string{"Zip", "Zip Code", "Postal Code"}},
+	{Path: "location.latitude", Sources: []string{"Latitude"}, Transform: NERISNumber},
+	{Path: "location.longitude", Sources: []string{"Longitude"}, Transform: NERISNumber},
+	{Path: "losses.property", Sources: []string{"Property Loss"}, Transform: NERISNumber},
+	{Path: "losses.contents", Sources: []string{"Contents Loss"}, Transform: NERISNumber},
+	{Path: "casualties.civilian_deaths", Sources: []string{"Civilian Deaths", "Civilian Fire Deaths"}, Transform: NERISNumber},
+	{Path: "casualties.civilian_injuries", Sources: []string{"Civilian Injuries", "Civilian Fire Injuries"}, Transform: NERISNumber},
+	{Path: "casualties.fire_service_deaths", Sources: []string{"Fire Service Deaths"}, Transform: NERISNumber},
+	{Path: "casualties.fire_service_injuries", Sources: []string{"Fire Service Injuries"}, Transform: NERISNumber},
+}
+
+// ParseNERISMapping reads a mapping saved as JSON.
+func ParseNERISMapping(data []byte) (NERISMapping, error) {
+	var m NERISMapping
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return m, err
+	}
+	return m, m.Validate()
+}
+
+// Validate checks that every rule has a path and sources and a known
+// transform, and that no path is both a value and holds other fields.
+func (m NERISMapping) Validate() error {
+	paths := map[string]bool{}
+	for _, r := range m {
+		if r.Path == "" || strings.Contains(r.Path, "..") || strings.HasPrefix(r.Path, ".") || strings.HasSuffix(r.Path, ".") {
+			return fmt.Errorf("NERIS mapping: bad path %q", r.Path)
+		}
+		if len(r.Sources) == 0 {
+			return fmt.Errorf("NERIS mapping: %s has no sources", r.Path)
+		}
+		switch r.Transform {
+		case NERISText, NERISDateTime, NERISNumber, NERISList:
+		default:
+			return fmt.Errorf("NERIS mapping: %s has unknown transform %q", r.Path, r.Transform)
+		}
+		if paths[r.Path] {
+			return fmt.Errorf("NERIS mapping: %s is mapped twice", r.Path)
+		}
+		paths[r.Path] = true
+	}
+	for p := range paths {
+		for i := strings.Index(p, "."); i >= 0; i = nextDot(p, i) {
+			if paths[p[:i]] {
+				return fmt.Errorf("NERIS mapping: %s is both a value and holds %s", p[:i], p)
+			}
+		}
+	}
+	return nil
+}
+
+func nextDot(s string, i int) int {
+	j := strings.Index(s[i+1:], ".")
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// IncidentRecord is the data collected for an incident: its row of the
+// incident list CSV (GetIncidentsCSV) and the fields of its printable view
+// (GetIncidentDetail), either of which may be empty.
+type IncidentRecord struct {
+	EID     string
+	Summary map[string]string
+	Detail  map[string]string
+}
+
+// NERISIncident is a NERIS-style incident document.
+type NERISIncident map[string]any
+
+// NERISReport lists what a conversion did not carry over.
+type NERISReport struct {
+	Incidents int                  `json:"incidents"`
+	Unmapped  []NERISUnmappedField `json:"unmapped"`
+	Invalid   []NERISInvalidValue  `json:"invalid"`
+}
+
+// NERISUnmappedField is an ER field which holds values but which no rule
+// of the mapping uses.
+type NERISUnmappedField struct {
+	// Source is "summary" for the incident list or "detail" for the
+	// printable view.
+	Source    string `json:"source"`
+	Field     string `json:"field"`
+	Incidents int    `json:"incidents"`
+	Example   string `json:"example"`
+}
+
+// NERISInvalidValue is a value its rule could not transform, which is kept
+// as text in the document.
+type NERISInvalidValue struct {
+	EID   string `json:"eid"`
+	Path  string `json:"path"`
+	Field string `json:"field"`
+	Value string `json:"value"`
+	Error string `json:"error"`
+}
+
+// ConvertNERIS converts incidents into NERIS-style documents following the
+// mapping, reporting fields the mapping leaves out and values which could
+// not be transformed.
+func ConvertNERIS(incidents []IncidentRecord, m NERISMapping) ([]NERISIncident, NERISReport) {
+	out := make([]NERISIncident, 0, len(incidents))
+	report := NERISReport{Unmapped: []NERISUnmappedField{}, Invalid: []NERISInvalidValue{}}
+
+	mapped := map[string]bool{}
+	for _, r := range m {
+		for _, s := range r.Sources {
+			mapped[nerisFieldKey(s)] = true
+		}
+	}
+	unmapped := map[[2]string]*NERISUnmappedField{}
+
+	for _, inc := range incidents {
+		report.Incidents++
+		summary, detail := nerisFields(inc.Summary), nerisFields(inc.Detail)
+
+		doc := NERISIncident{}
+		for _, r := range m {
+			field, value := nerisValue(inc.EID, r.Sources, summary, detail)
+			if value == "" {
+				continue
+			}
+			v, err := nerisTransform(r.Transform, value)
+			if err != nil {
+				report.Invalid = append(report.Invalid, NERISInvalidValue{
+					EID: inc.EID, Path: r.Path, Field: field, Value: value, Error: err.Error(),
+				})
+				v = value
+			}
+			nerisSet(doc, r.Path, v)
+		}
+		out = append(out, doc)
+
+		for _, src := range []struct {
+			name   string
+			fields map[string]string
+		}{{"summary", inc.Summary}, {"detail", inc.Detail}} {
+			for field, value := range src.fields {
+				value = strings.TrimSpace(value)
+				if value == "" || mapped[nerisFieldKey(field)] {
+					continue
+				}
+				k := [2]string{src.name, field}
+				u, ok := unmapped[k]
+				if !ok {
+					u = &NERISUnmappedField{Source: src.name, Field: field, Example: value}
+					unmapped[k] = u
+				}
+				u.Incidents++
+			}
+		}
+	}
+
+	for _, u := range unmapped {
+		report.Unmapped = append(report.Unmapped, *u)
+	}
+	sort.Slice(report.Unmapped, func(i, j int) bool {
+		if report.Unmapped[i].Source != report.Unmapped[j].Source {
+			// The incident list's fields first
+			return report.Unmapped[i].Source == "summary"
+		}
+		return report.Unmapped[i].Field < report.Unmapped[j].Field
+	})
+	return out, report
+}
+
+// nerisFields indexes fields by nerisFieldKey, keeping their names.
+func nerisFields(fields map[string]string) map[string][2]string {
+	out := make(map[string][2]string, len(fields))
+	for k, v := range fields {
+		out[nerisFieldKey(k)] = [2]string{k, strings.TrimSpace(v)}
+	}
+	return out
+}
+
+// nerisValue returns the first of sources holding a value, and its field
+// name.
+func nerisValue(eid string, sources []string, summary, detail map[string][2]string) (string, string) {
+	for _, s := range sources {
+		if s == NERISSourceEID {
+			if eid != "" {
+				return s, eid
+			}
+			continue
+		}
+		k := nerisFieldKey(s)
+		for _, fields := range []map[string][2]string{summary, detail} {
+			if f, ok := fields[k]; ok && f[1] != "" {
+				return f[0], f[1]
+			}
+		}
+	}
+	return "", ""
+}
+
+// nerisFieldKey folds a field name to letters and digits, lower case.
+func nerisFieldKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+func nerisTransform(transform, value string) (any, error) {
+	switch transform {
+	case NERISDateTime:
+		for _, f := range classDateFormats {
+			t, err := time.ParseInLocation(f, value, time.Local)
+			if err == nil {
+				return t.Format(time.RFC3339), nil
+			}
+		}
+		return nil, fmt.Errorf("not a known date format")
+	case NERISNumber:
+		s := strings.NewReplacer("$", "", ",", "", " ", "").Replace(value)
+		return strconv.ParseFloat(s, 64)
+	case NERISList:
+		out := make([]string, 0)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+		return out, nil
+	}
+	return value, nil
+}
+
+// nerisSet sets the value at a dotted path, creating the objects along
+// it.
+func nerisSet(doc map[string]any, path string, v any) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := doc[p].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			doc[p] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = v
+}
+
+// NERISUnmappedCSVColumns are the columns of WriteNERISUnmappedCSV.
+var NERISUnmappedCSVColumns = []string{"Source", "Field", "Incidents", "Example"}
+
+// WriteNERISUnmappedCSV writes the unmapped fields of a report as CSV.
+func WriteNERISUnmappedCSV(w io.Writer, fields []NERISUnmappedField) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(NERISUnmappedCSVColumns)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		err = cw.Write([]string{f.Source, f.Field, strconv.Itoa(f.Incidents), f.Example})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ConvertNERIS(t *testing.T) {
+	incidents := []IncidentRecord{
+		{
+			EID: "1001",
+			Summary: map[string]string{
+				"Incident #":    "24-0042",
+				"Incident Type": "111",
+				"Alarm Time":    "1/5/2024 19:03",
+				"Property Loss": "$50,000",
+				"Apparatus":     "E1",
+			},
+			Detail: map[string]string{
+				"Actions Taken": "11, 12,",
+				"Zip Code":      "06241",
+				"Incident Type": "ignored, as the summary has it",
+				"Weather":       "Snow",
+			},
+		},
+		{
+			EID:     "1002",
+			Summary: map[string]string{"Incident #": "24-0043", "Alarm Time": "yesterday", "Apparatus": ""},
+		},
+	}
+
+	docs, report := ConvertNERIS(incidents, DefaultNERISMapping)
+	if len(docs) != 2 || report.Incidents != 2 {
+		t.Fatalf("ERR: unexpected documents %#v", docs)
+	}
+	base := docs[0]["base"].(map[string]any)
+	if base["source_incident_id"] != "1001" || base["incident_number"] != "24-0042" || base["nfirs_incident_type"] != "111" {
+		t.Fatalf("ERR: unexpected base %#v", base)
+	}
+	if actions := base["actions_taken"].([]string); len(actions) != 2 || actions[1] != "12" {
+		t.Fatalf("ERR: unexpected actions %#v", base["actions_taken"])
+	}
+	alarm := time.Date(2024, 1, 5, 19, 3, 0, 0, time.Local).Format(time.RFC3339)
+	if docs[0]["dispatch"].(map[string]any)["call_create"] != alarm {
+		t.Fatalf("ERR: unexpected dispatch %#v", docs[0]["dispatch"])
+	}
+	if docs[0]["losses"].(map[string]any)["property"] != float64(50000) || docs[0]["location"].(map[string]any)["postal_code"] != "06241" {
+		t.Fatalf("ERR: unexpected document %#v", docs[0])
+	}
+	if docs[1]["dispatch"].(map[string]any)["call_create"] != "yesterday" {
+		t.Fatalf("ERR: unexpected dispatch %#v", docs[1]["dispatch"])
+	}
+
+	if len(report.Invalid) != 1 || report.Invalid[0].EID != "1002" || report.Invalid[0].Field != "Alarm Time" {
+		t.Fatalf("ERR: unexpected invalid values %#v", report.Invalid)
+	}
+	if len(report.Unmapped) != 2 || report.Unmapped[0].Field != "Apparatus" || report.Unmapped[0].Incidents != 1 || report.Unmapped[1].Field != "Weather" {
+		t.Fatalf("ERR: unexpected unmapped fields %#v", report.Unmapped)
+	}
+
+	var b strings.Builder
+	err := WriteNERISUnmappedCSV(&b, report.Unmapped)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if b.String() != "Source,Field,Incidents,Example\nsummary,Apparatus,1,E1\ndetail,Weather,1,Snow\n" {
+		t.Fatalf("ERR: unexpected CSV %q", b.String())
+	}
+}
+
+func Test_ParseNERISMapping(t *testing.T) {
+	if err := DefaultNERISMapping.Validate(); err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	m, err := ParseNERISMapping([]byte(`[{"path":"base.weather","sources":["Weather"]}]`))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	docs, report := ConvertNERIS([]IncidentRecord{{EID: "1", Detail: map[string]string{"Weather": "Snow"}}}, m)
+	if docs[0]["base"].(map[string]any)["weather"] != "Snow" || len(report.Unmapped) != 0 {
+		t.Fatalf("ERR: unexpected document %#v", docs[0])
+	}
+
+	for _, bad := range []string{
+		`[{"path":"base","sources":["A"]},{"path":"base.x","sources":["B"]}]`,
+		`[{"path":"base.x","sources":[]}]`,
+		`[{"path":"base.x","sources":["A"],"transform":"upper"}]`,
+		`[{"path":"base..x","sources":["A"]}]`,
+	} {
+		if _, err = ParseNERISMapping([]byte(bad)); err == nil {
+			t.Fatalf("ERR: expected an error for %s", bad)
+		}
+	}
+}
+
+func Test_MemoryFetcher_GetIncidentDetail(t *testing.T) {
+	a, f, _ := testMemoryAgent(t)
+	f.Responses[incidentPrintURL("1001")] = []byte(`<html><body><table>
+<tr><td>Incident Type:</td><td>111 Building fire</td><td>Shift:</td><td>B</td></tr>
+<tr><th>Unit:</th><td> E1 </td></tr>
+<tr><td>Unit:</td><td>L1</td></tr>
+<tr><td>District:</td><td>Aid Given:</td><td>N None</td></tr>
+<tr><td>Not a label</td><td>value</td></tr>
+</table></body></html>`)
+
+	detail, err := a.GetIncidentDetail("1001")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(detail) != 5 || detail["Incident Type"] != "111 Building fire" || detail["Shift"] != "B" ||
+		detail["Unit"] != "E1" || detail["Unit 2"] != "L1" || detail["Aid Given"] != "N None" {
+		t.Fatalf("ERR: unexpected detail %#v", detail)
+	}
+}
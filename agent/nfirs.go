@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dayvillefire/er-scraper/nfirs"
+)
+
+const (
+	// NFIRSExportFile is the NFIRS 5.0 transaction file, saved under
+	// NFIRSPath.
+	NFIRSExportFile = "nfirs5.txt"
+	// NFIRSValidationFile holds the NFIRSValidation of the export, saved
+	// under NFIRSPath.
+	NFIRSValidationFile = "validation.json"
+)
+
+// DefaultNFIRSFrom is the start of the default NFIRS export range, before
+// NFIRS 5.0 itself.
+var DefaultNFIRSFrom = time.Date(1999, 1, 1, 0, 0, 0, 0, time.Local)
+
+// NFIRSIncident is an incident of ER's incident list CSV, as checked
+// against an NFIRS export.
+type NFIRSIncident struct {
+	EID    string    `json:"eid"`
+	Number string    `json:"incident_number"`
+	Date   time.Time `json:"date,omitempty"`
+}
+
+// NFIRSIncidentColumns name the columns of the incident list CSV that
+// NFIRSIncidents reads, each tried in order. Names ignore case, spaces and
+// punctuation.
+var NFIRSIncidentColumns = struct {
+	EID    []string
+	Number []string
+	Date   []string
+}{
+	EID:    []string{"EID"},
+	Number: []string{"Incident Number", "Incident #", "Incident No"},
+	Date:   []string{"Incident Date", "Alarm Date/Time", "Alarm Date", "Alarm Time"},
+}
+
+// NFIRSIncidents reads the incidents of the incident list CSV, as returned
+// by GetIncidentsCSV, with the EID, incident number and date of each. It
+// fails when the list has no EID or incident number column.
+func NFIRSIncidents(rows [][]string) ([]NFIRSIncident, error) {
+	out := make([]NFIRSIncident, 0)
+	if len(rows) == 0 {
+		return out, nil
+	}
+
+	column := func(names []string) int {
+		for _, name := range names {
+			for k, h := range rows[0] {
+				if nerisFieldKey(h) == nerisFieldKey(name) {
+					return k
+				}
+			}
+		}
+		return -1
+	}
+	cell := func(r []string, k int) string {
+		if k < 0 || k >= len(r) {
+			return ""
+		}
+		return strings.TrimSpace(r[k])
+	}
+
+	eid, number, date := column(NFIRSIncidentColumns.EID), column(NFIRSIncidentColumns.Number), column(NFIRSIncidentColumns.Date)
+	if eid < 0 {
+		return out, fmt.Errorf("incident list has no EID column")
+	}
+	if number < 0 {
+		return out, fmt.Errorf("incident list has no incident number column")
+	}
+
+	for _, r := range rows[1:] {
+		inc := NFIRSIncident{EID: cell(r, eid), Number: cell(r, number)}
+		if inc.EID == "" {
+			continue
+		}
+		for _, f := range classDateFormats {
+			t, err := time.ParseInLocation(f, cell(r, date), time.Local)
+			if err == nil {
+				inc.Date = t
+				break
+			}
+		}
+		out = append(out, inc)
+	}
+	return out, nil
+}
+
+// NFIRSValidation is the result of checking an NFIRS export against the
+// incident list.
+type NFIRSValidation struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Records int       `json:"records"`
+	// Incidents is the number of incidents in the range checked, of which
+	// Missing have no Basic record with their incident number.
+	Incidents int             `json:"incidents"`
+	Missing   []NFIRSIncident `json:"missing"`
+	// Unlisted are the EIDs of incidents found by the incident search but
+	// absent from the incident list CSV, so without a number or date to
+	// check them by.
+	Unlisted []string `json:"unlisted"`
+	// Undated are incidents whose date could not be read, so could not be
+	// placed in or out of the range. They are not checked.
+	Undated []NFIRSIncident `json:"undated"`
+}
+
+// OK reports whether every incident was found in the export.
+func (v NFIRSValidation) OK() bool {
+	return len(v.Missing) == 0 && len(v.Unlisted) == 0
+}
+
+// NFIRSExportURL returns the URL of ER's NFIRS 5.0 flat file export for
+// incidents from from up to, but not including, to, filling in the
+// template tmpl. ER's address for the export has not been recorded, so
+// there is no default: tmpl is taken from a --har capture of the export,
+// with {start} in place of the first day and {end} of the last day
+// included, each as MM/DD/YYYY.
+func NFIRSExportURL(tmpl string, from, to time.Time) (string, error) {
+	if u, err := url.Parse(tmpl); err != nil || !u.IsAbs() || !strings.Contains(tmpl, "{start}") || !strings.Contains(tmpl, "{end}") {
+		return "", fmt.Errorf("NFIRS export URL %q must be absolute and hold {start} and {end}", tmpl)
+	}
+	return strings.NewReplacer(
+		"{start}", url.QueryEscape(from.Format(calendarDateFormat)),
+		"{end}", url.QueryEscape(to.AddDate(0, 0, -1).Format(calendarDateFormat)),
+	).Replace(tmpl), nil
+}
+
+// ExportNFIRS returns the NFIRS 5.0 transaction file for incidents from
+// from up to, but not including, to, from the export at the URL template
+// tmpl (see NFIRSExportURL). ER only offers it as a download, which is
+// read into memory rather than saved through the browser.
+func (a *Agent) ExportNFIRS(tmpl string, from, to time.Time) ([]byte, error) {
+	if !to.After(from) {
+		return []byte{}, fmt.Errorf("NFIRS range %s to %s is empty", from.Format(calendarDateFormat), to.Format(calendarDateFormat))
+	}
+	u, err := NFIRSExportURL(tmpl, from, to)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	log.Printf("INFO: Load NFIRS export for %s to %s", from.Format(calendarDateFormat), to.Format(calendarDateFormat))
+	return a.downloadFile(u)
+}
+
+// ValidateNFIRS checks that each incident EID in ids, as returned by
+// GetIncidentIDs, dated from from up to to has a Basic record in the NFIRS
+// transaction file data whose incident number is its own, ignoring leading
+// zeros. The number and date of each come from its row in incidents, read
+// from the incident list CSV by NFIRSIncidents. The file is read with the nfirs
+// package, and it is an error for it not to parse or to hold records but
+// no Basic ones, as then its layout is not the one expected. That package's
+// layouts are provisional, so a real NFIRS 5.0 file fails this way.
+func ValidateNFIRS(data []byte, ids []string, incidents []NFIRSIncident, from, to time.Time) (NFIRSValidation, error) {
+	out := NFIRSValidation{From: from, To: to, Missing: []NFIRSIncident{}, Unlisted: []string{}, Undated: []NFIRSIncident{}}
+
+	f, err := nfirs.Parse(bytes.NewReader(data))
+	if err != nil {
+		return out, err
+	}
+	out.Records = len(f.Records)
+
+	numbers := map[string]bool{}
+	for _, rec := range f.Records {
+		if b, ok := rec.(*nfirs.Basic); ok {
+			numbers[nfirsKey(b.Number)] = true
+		}
+	}
+	if out.Records > 0 && len(numbers) == 0 {
+		return out, fmt.Errorf("NFIRS export has %d records but no %s records in the nfirs package's provisional layout", out.Records, nfirs.TypeBasic)
+	}
+
+	listed := map[string]NFIRSIncident{}
+	for _, inc := range incidents {
+		if _, ok := listed[inc.EID]; !ok {
+			listed[inc.EID] = inc
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, eid := range ids {
+		eid = strings.TrimSpace(eid)
+		if eid == "" || seen[eid] {
+			continue
+		}
+		seen[eid] = true
+		inc, ok := listed[eid]
+		switch {
+		case !ok:
+			out.Unlisted = append(out.Unlisted, eid)
+			continue
+		case inc.Date.IsZero():
+			out.Undated = append(out.Undated, inc)
+			continue
+		case inc.Date.Before(from) || !inc.Date.Before(to):
+			continue
+		}
+		out.Incidents++
+		if inc.Number == "" || !numbers[nfirsKey(inc.Number)] {
+			out.Missing = append(out.Missing, inc)
+		}
+	}
+	sort.Slice(out.Missing, func(i, j int) bool {
+		return out.Missing[i].Date.Before(out.Missing[j].Date)
+	})
+	return out, nil
+}
+
+func nfirsKey(s string) string {
+	s = strings.TrimSpace(s)
+	if t := strings.TrimLeft(s, "0"); t != "" {
+		return t
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_MemoryFetcher_ExportNFIRS(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+
+	// A made up template, as ER's has not been recorded
+	tmpl := "https://er.example/nfirs/export?from={start}&to={end}"
+	a, f, _ := testMemoryAgent(t)
+	f.Responses["https://er.example/nfirs/export?from=01%2F01%2F2024&to=12%2F31%2F2024"] = []byte("BASIC^CT^12345^01012024^1^0001001^000^N^111\r\n" +
+		"FIRE^CT^12345^01012024^1^0001001^000^1^^24\r\n\r\n" +
+		"BASIC^CT^12345^01022024^1^0000111^000^N^111\r\n")
+
+	data, err := a.ExportNFIRS(tmpl, from, to)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	// EID 7's number only appears in a field other than the incident
+	// number, EID 8 is outside the range, EID 10 is not in the incident list
+	// and EID 11 was not found by the incident search
+	ids := []string{"5", "6", "6", "7", "8", "9", "10"}
+	incidents, err := NFIRSIncidents([][]string{
+		{"EID", "Incident #", "Incident Date"},
+		{"5", "1001", "1/1/2024"},
+		{"6", "2024-111", "1/2/2024 10:00:00 AM"},
+		{"6", "2024-111", "1/2/2024 10:00:00 AM"},
+		{"7", "24", "1/3/2024"},
+		{"8", "1002", "12/31/2023"},
+		{"9", "1003", ""},
+		{"11", "1004", "1/4/2024"},
+	})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	v, err := ValidateNFIRS(data, ids, incidents, from, to)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if v.Records != 3 || v.Incidents != 3 || v.OK() || len(v.Missing) != 2 || v.Missing[0].EID != "6" || v.Missing[1].EID != "7" ||
+		len(v.Unlisted) != 1 || v.Unlisted[0] != "10" || len(v.Undated) != 1 || v.Undated[0].EID != "9" {
+		t.Fatalf("ERR: unexpected validation %#v", v)
+	}
+
+	if _, err = NFIRSIncidents([][]string{{"EID", "Incident Type"}, {"5", "111"}}); err == nil {
+		t.Fatalf("ERR: expected an error without an incident number column")
+	}
+	if _, err = ValidateNFIRS([]byte("AA^12345^0001001\r\n"), ids, incidents, from, to); err == nil {
+		t.Fatalf("ERR: expected an error for a file without Basic records")
+	}
+
+	if _, err = NFIRSExportURL("https://er.example/nfirs/export", from, to); err == nil {
+		t.Fatalf("ERR: expected an error for a template without dates")
+	}
+
+	if _, err = a.ExportNFIRS(tmpl, to, from); err == nil {
+		t.Fatalf("ERR: expected an error for an empty range")
+	}
+}
@@ -1 +1,307 @@
 package agent
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TrainingFileDownloaded    = "downloaded"
+	TrainingFileAlreadyStored = "already_stored"
+	TrainingFileFailed        = "failed"
+	// TrainingFileInSeries marks a file shared by a class series, stored
+	// once with the series rather than with each class.
+	TrainingFileInSeries = "in_series"
+)
+
+// TrainingFile is a file attached to a training class.
+type TrainingFile struct {
+	ID      string `json:"id"`
+	ClassID int    `json:"class_id"`
+	// Title is the name the file is listed under in the class.
+	Title string `json:"title"`
+	// OriginalName is that name exactly as the server sent it, before it
+	// was made safe to save under (see FileName).
+	OriginalName string `json:"original_name"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	AccessLevel  string `json:"access_level"`
+	GUID         string `json:"file_guid"`
+	URL          string `json:"url,omitempty"`
+
+	// Filled in once downloaded. FileName is the name the file was saved
+	// under, which may differ from Title to make it safe or unique.
+	FileName    string `json:"file_name,omitempty"`
+	Path        string `json:"path,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// The training reference tables which classes refer to by name.
+const (
+	TrainingCategories  = "categories"
+	TrainingCodes       = "codes"
+	TrainingTemplates   = "templates"
+	TrainingInstructors = "instructors"
+	TrainingResources   = "resources"
+)
+
+// TrainingReferenceTables lists every training reference table.
+var TrainingReferenceTables = []string{
+	TrainingCategories, TrainingCodes, TrainingTemplates, TrainingInstructors, TrainingResources,
+}
+
+// TrainingReference is a row of a training reference table, such as a
+// category or a training code.
+type TrainingReference struct {
+	Table string   `json:"table"`
+	ID    string   `json:"id"`
+	Cells []string `json:"cells"`
+	// Detail is the full record, for tables whose source has a detail
+	// service, as ER returns it.
+	Detail json.RawMessage `json:"detail,omitempty"`
+}
+
+// TrainingReferenceSource is where a training reference table is served:
+// the URL of its list web service, returning jqGrid rows, and optionally
+// that of each row's detail, with {id} standing for the row ID.
+type TrainingReferenceSource struct {
+	List   string `json:"list"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// TrainingReferenceSources maps training reference tables to where they
+// are served. ER's addresses for them have not been recorded, so there is
+// no default: they are read, with ParseTrainingReferenceSources, from a
+// file made from a --har capture of the training admin pages.
+type TrainingReferenceSources map[string]TrainingReferenceSource
+
+// ParseTrainingReferenceSources reads training reference sources saved as
+// JSON, keyed by table.
+func ParseTrainingReferenceSources(data []byte) (TrainingReferenceSources, error) {
+	var s TrainingReferenceSources
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return s, err
+	}
+	return s, s.Validate()
+}
+
+// Validate checks that every source is for a known table, and that its
+// URLs are absolute, with a detail URL placing the row ID.
+func (s TrainingReferenceSources) Validate() error {
+	if len(s) == 0 {
+		return fmt.Errorf("training reference sources: no tables")
+	}
+	for table, src := range s {
+		if !slices.Contains(TrainingReferenceTables, table) {
+			return fmt.Errorf("training reference sources: unknown table %q", table)
+		}
+		if u, err := url.Parse(src.List); err != nil || !u.IsAbs() {
+			return fmt.Errorf("training reference sources: %s: bad list URL %q", table, src.List)
+		}
+		if src.Detail == "" {
+			continue
+		}
+		if u, err := url.Parse(src.Detail); err != nil || !u.IsAbs() || !strings.Contains(src.Detail, "{id}") {
+			return fmt.Errorf("training reference sources: %s: bad detail URL %q", table, src.Detail)
+		}
+	}
+	return nil
+}
+
+// TrainingClassColumns are the columns of the training class list, in the
+// order the class list web service returns them.
+var TrainingClassColumns = []string{
+	"Class ID", "Name", "Class Date",
+	"Length", "Category Name", "Station",
+	"Evaluations", "Template", "Lead Instructor",
+	"Instructors", "Resources", "Training Codes",
+	"Location", "Objective", "Narrative",
+}
+
+// TrainingIndex is the training class list, as returned by
+// GetTrainingClassIndex.
+type TrainingIndex struct {
+	// Header names every column, as ER's header row does, with columns it
+	// does not name called "Column N".
+	Header []string
+	Rows   [][]string
+}
+
+// IDs returns the class ID of each row, 0 where it is missing.
+func (ix TrainingIndex) IDs() []int {
+	out := make([]int, len(ix.Rows))
+	k := ix.column("Class ID")
+	for i, r := range ix.Rows {
+		if k >= 0 && k < len(r) {
+			out[i], _ = strconv.Atoi(strings.TrimSpace(r[k]))
+		}
+	}
+	return out
+}
+
+// column returns the position of the named column in the header, or -1.
+// Names are matched ignoring case and surrounding space.
+func (ix TrainingIndex) column(name string) int {
+	for k, h := range ix.Header {
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")), name) {
+			return k
+		}
+	}
+	return -1
+}
+
+// Value returns the named column of row i, empty when the header has no
+// such column or the row is too short.
+func (ix TrainingIndex) Value(i int, name string) string {
+	k := ix.column(name)
+	if k < 0 || i < 0 || i >= len(ix.Rows) || k >= len(ix.Rows[i]) {
+		return ""
+	}
+	return ix.Rows[i][k]
+}
+
+// Class returns row i as a TrainingClass, reading each field from the
+// column the header names for it, wherever ER places it.
+func (ix TrainingIndex) Class(i int) TrainingClass {
+	return newTrainingClass(func(name string) string {
+		return ix.Value(i, name)
+	})
+}
+
+// Select returns the index with only the rows at the given positions.
+func (ix TrainingIndex) Select(rows []int) TrainingIndex {
+	out := TrainingIndex{Header: ix.Header, Rows: make([][]string, 0, len(rows))}
+	for _, i := range rows {
+		out.Rows = append(out.Rows, ix.Rows[i])
+	}
+	return out
+}
+
+// Records returns the rows keyed by column name. Rows shorter than the
+// header have the missing columns empty.
+func (ix TrainingIndex) Records() []map[string]string {
+	out := make([]map[string]string, 0, len(ix.Rows))
+	for _, r := range ix.Rows {
+		rec := make(map[string]string, len(ix.Header))
+		for k, name := range ix.Header {
+			rec[name] = ""
+			if k < len(r) {
+				rec[name] = r[k]
+			}
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// WriteCSV writes the index as CSV, header first.
+func (ix TrainingIndex) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(ix.Header)
+	if err != nil {
+		return err
+	}
+	err = cw.WriteAll(ix.Rows)
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// WriteJSON writes the index as a JSON array of Records.
+func (ix TrainingIndex) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ix.Records())
+}
+
+// TrainingClass is a row of the training class list.
+type TrainingClass struct {
+	ClassID        int
+	Name           string
+	Date           time.Time
+	Year           int
+	Month          int
+	Length         string
+	Category       string
+	Station        string
+	Evaluations    string
+	Template       string
+	LeadInstructor string
+	Instructors    string
+	Resources      string
+	TrainingCodes  string
+	Location       string
+	Objective      string
+	Narrative      string
+}
+
+// NewTrainingClass builds a TrainingClass from a row whose columns are in
+// the order of TrainingClassColumns. Rows of a class list read from ER
+// should go through TrainingIndex.Class, which follows its header instead.
+// Missing columns are left empty.
+func NewTrainingClass(row []string) TrainingClass {
+	return TrainingIndex{Header: TrainingClassColumns, Rows: [][]string{row}}.Class(0)
+}
+
+// newTrainingClass builds a TrainingClass from the value of each named
+// column.
+func newTrainingClass(value func(name string) string) TrainingClass {
+	col := func(name string) string {
+		return strings.TrimSpace(value(name))
+	}
+
+	c := TrainingClass{
+		Name:           col("Name"),
+		Length:         col("Length"),
+		Category:       col("Category Name"),
+		Station:        col("Station"),
+		Evaluations:    col("Evaluations"),
+		Template:       col("Template"),
+		LeadInstructor: col("Lead Instructor"),
+		Instructors:    col("Instructors"),
+		Resources:      col("Resources"),
+		TrainingCodes:  col("Training Codes"),
+		Location:       col("Location"),
+		Objective:      col("Objective"),
+		Narrative:      col("Narrative"),
+	}
+	c.ClassID, _ = strconv.Atoi(col("Class ID"))
+	c.Date = parseClassDate(col("Class Date"))
+	if !c.Date.IsZero() {
+		c.Year = c.Date.Year()
+		c.Month = int(c.Date.Month())
+	}
+	return c
+}
+
+// Hours returns the length of a class in hours, or zero when it is
+// not given.
+func (c TrainingClass) Hours() float64 {
+	h, _ := parseHours(c.Length)
+	return h
+}
+
+// ExportRun describes the export itself, for datasets which have no record
+// of their own to name their files after.
+type ExportRun struct {
+	Date  time.Time
+	Year  int
+	Month int
+}
+
+func NewExportRun(t time.Time) ExportRun {
+	return ExportRun{Date: t, Year: t.Year(), Month: int(t.Month())}
+}
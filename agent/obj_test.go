@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func Test_MemoryFetcher_GetTrainingClassIndex(t *testing.T) {
+	a, f, _ := testMemoryAgent(t)
+	f.Responses["https://secure.emergencyreporting.com/training/ws/classes.php?_function=list_csv&_csvtype=info"] = []byte("\ufeff" +
+		"Class ID,Name,Class Date,Length,Category Name,Station,Lead Instructor,Training Codes,Instructors,Template,Start Time,End Time,Location,Objective,Narrative,Added By\n" +
+		"42,Hose Lays,3/5/2024 19:00,2,Company,1,\"Doe, Al\",FF1,,,,,,,,Roe\n" +
+		"7,Ladders,1/9/2024 19:00,1,Company,1,,,,,,,,,,,extra\n")
+
+	ix, err := a.GetTrainingClassIndex()
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	ids := ix.IDs()
+	if len(ids) != 2 || ids[0] != 42 || ids[1] != 7 {
+		t.Fatalf("ERR: unexpected ids %#v", ids)
+	}
+	if len(ix.Header) != 17 || ix.Header[0] != "Class ID" || ix.Header[15] != "Added By" || ix.Header[16] != "Column 17" {
+		t.Fatalf("ERR: unexpected header %#v", ix.Header)
+	}
+
+	c := ix.Class(0)
+	if c.LeadInstructor != "Doe, Al" || c.TrainingCodes != "FF1" || c.Template != "" || c.Category != "Company" {
+		t.Fatalf("ERR: unexpected class %#v", c)
+	}
+
+	recs := ix.Records()
+	if recs[0]["Added By"] != "Roe" || recs[0]["Column 17"] != "" || recs[1]["Column 17"] != "extra" {
+		t.Fatalf("ERR: unexpected records %#v", recs)
+	}
+
+	var b bytes.Buffer
+	err = ix.WriteJSON(&b)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	var decoded []map[string]string
+	err = json.Unmarshal(b.Bytes(), &decoded)
+	if err != nil || len(decoded) != 2 || decoded[0]["Lead Instructor"] != "Doe, Al" {
+		t.Fatalf("ERR: unexpected JSON %s", b.String())
+	}
+
+	// The saved CSV reads back the same, as the transcripts do
+	b.Reset()
+	err = ix.WriteCSV(&b)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	saved, err := readTrainingLookup(b.Bytes())
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(saved.Rows) != 2 || saved.Class(0).Name != "Hose Lays" || saved.Rows[1][16] != "extra" {
+		t.Fatalf("ERR: unexpected rows %#v", saved.Rows)
+	}
+
+	// Without a header row, the known columns are assumed
+	ix, err = ParseTrainingClassIndex([]byte("5,Pump Ops\n"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(ix.Rows) != 1 || ix.IDs()[0] != 5 || len(ix.Header) != len(TrainingClassColumns) {
+		t.Fatalf("ERR: unexpected index %#v", ix)
+	}
+}
+
+func Test_TrainingIndex_ClassByHeader(t *testing.T) {
+	// A column inserted before the date moves every later one along
+	ix, err := ParseTrainingClassIndex([]byte(
+		"Class ID,Name,Status,Class Date,Length,Category Name,Station\n" +
+			"42,Hose Lays,Closed,3/5/2024 19:00,2,Company,Station 1\n"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	c := ix.Class(0)
+	if c.ClassID != 42 || c.Year != 2024 || c.Month != 3 || c.Length != "2" || c.Category != "Company" || c.Station != "Station 1" {
+		t.Fatalf("ERR: unexpected class %#v", c)
+	}
+
+	got := TrainingClassFilter{Stations: []string{"Station 1"}}.Filter(ix).IDs()
+	if len(got) != 1 || got[0] != 42 {
+		t.Fatalf("ERR: unexpected classes %v", got)
+	}
+	if ix.Value(0, "Status") != "Closed" || ix.Value(0, "Missing") != "" {
+		t.Fatalf("ERR: unexpected values %#v", ix.Rows[0])
+	}
+}
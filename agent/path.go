@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultTrainingPath places each class's files in a directory named
+	// after its ID.
+	DefaultTrainingPath = "training/{{.ClassID}}"
+	// DefaultCalendarPath is where the calendar export is saved.
+	DefaultCalendarPath = "calendar.ics"
+	// TrainingReferencePath is where the training reference tables are
+	// saved.
+	TrainingReferencePath = "training/reference"
+	// TrainingSeriesPath is where recurring class series are saved, each
+	// in a directory named after its first class.
+	TrainingSeriesPath = "training/series"
+	// NFIRSPath is where the NFIRS 5.0 export and its validation are saved.
+	NFIRSPath = "nfirs"
+)
+
+// PathTemplate places the files of a dataset within an export, rendering a
+// text/template against each typed record, such as TrainingClass, e.g.
+//
+//	training/{{.Year}}/{{.ClassID}}-{{.Name}}
+//
+// Separators in record values are replaced, so a value can never add
+// directories or climb out of the export.
+type PathTemplate struct {
+	t *template.Template
+}
+
+func ParsePathTemplate(name, text string) (*PathTemplate, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("path template %s: %w", name, err)
+	}
+	return &PathTemplate{t: t}, nil
+}
+
+// Render returns the sink path for a record.
+func (p *PathTemplate) Render(rec any) (string, error) {
+	var b strings.Builder
+	err := p.t.Execute(&b, pathFields(rec))
+	if err != nil {
+		return "", fmt.Errorf("path template %s: %w", p.t.Name(), err)
+	}
+	out := strings.TrimSpace(b.String())
+	if out == "" {
+		return "", fmt.Errorf("path template %s rendered an empty path", p.t.Name())
+	}
+	return cleanSinkName(path.Clean(out))
+}
+
+// pathFields returns a copy of a struct record with path separators and
+// dot directories in its string fields replaced.
+func pathFields(rec any) any {
+	v := reflect.ValueOf(rec)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return rec
+	}
+
+	out := reflect.New(v.Type()).Elem()
+	out.Set(v)
+	for i := 0; i < out.NumField(); i++ {
+		f := out.Field(i)
+		if f.Kind() == reflect.String && f.CanSet() {
+			s := pathSeparators.Replace(f.String())
+			if s == "." || s == ".." {
+				s = "_"
+			}
+			f.SetString(s)
+		}
+	}
+	return out.Interface()
+}
+
+var pathSeparators = strings.NewReplacer("/", "-", `\`, "-")
+
+const (
+	// maxFilenameBytes leaves room below the usual 255 byte limit for a
+	// collision suffix and an encryption or pointer suffix.
+	maxFilenameBytes = 180
+)
+
+var (
+	unsafeFilenameChars = strings.NewReplacer(
+		"/", "_", `\`, "_", "<", "_", ">", "_", ":", "_",
+		`"`, "_", "|", "_", "?", "_", "*", "_",
+	)
+	reservedFilenames = map[string]bool{
+		"CON": true, "PRN": true, "AUX": true, "NUL": true,
+		"CONIN$": true, "CONOUT$": true,
+		"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+		"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+		"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+		"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+		"COM¹": true, "COM²": true, "COM³": true,
+		"LPT¹": true, "LPT²": true, "LPT³": true,
+	}
+)
+
+// SafeFilename turns a server supplied file name into one which is safe to
+// use as a single path element on any filesystem: separators, reserved and
+// control characters are replaced, dot names and reserved device names are
+// disarmed, and overlong names are shortened keeping their extension.
+func SafeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	name = unsafeFilenameChars.Replace(name)
+	// Windows drops trailing dots and spaces
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+
+	if name == "" {
+		return "file"
+	}
+
+	// Windows reserves device names whatever follows the first dot, so
+	// "NUL.tar.gz" is as much the null device as "NUL"
+	stem, _, _ := strings.Cut(name, ".")
+	if reservedFilenames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		name = "_" + name
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" {
+		// A dot file such as ".htaccess"
+		base, ext = name, ""
+	}
+
+	if len(ext) > maxFilenameBytes/4 {
+		base, ext = base+ext, ""
+	}
+	if len(base)+len(ext) > maxFilenameBytes {
+		base = truncateUTF8(base, maxFilenameBytes-len(ext))
+	}
+	return base + ext
+}
+
+// uniqueFilename returns name, or if it is already used (ignoring case, as
+// many filesystems do) a variant with key, and then a counter, added before
+// the extension. The chosen name is marked as used.
+func uniqueFilename(used map[string]bool, name, key string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for n := 1; used[strings.ToLower(candidate)]; n++ {
+		suffix := "-" + SafeFilename(key)
+		if key == "" || n > 1 {
+			suffix = fmt.Sprintf("-%d", n)
+		}
+		candidate = truncateUTF8(base, maxFilenameBytes-len(suffix)-len(ext)) + suffix + ext
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
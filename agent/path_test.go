@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_PathTemplate(t *testing.T) {
+	c := NewTrainingClass([]string{"42", "Hose Lays / Advancing", "1/5/2024 19:00", "2.0", "Fire", "Station 1"})
+	if c.ClassID != 42 || c.Year != 2024 || c.Month != 1 || c.Station != "Station 1" {
+		t.Fatalf("ERR: unexpected class %#v", c)
+	}
+
+	for text, expected := range map[string]string{
+		DefaultTrainingPath:                                        "training/42",
+		"training/{{.Year}}/{{.ClassID}}-{{.Name}}/":               "training/2024/42-Hose Lays - Advancing",
+		`training/{{.Year}}/{{printf "%02d" .Month}}/{{.ClassID}}`: "training/2024/01/42",
+	} {
+		p, err := ParsePathTemplate("training", text)
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+		out, err := p.Render(c)
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+		if out != expected {
+			t.Fatalf("ERR: %s: expected %q, got %q", text, expected, out)
+		}
+	}
+
+	// Values cannot climb out of the export
+	p, _ := ParsePathTemplate("training", "{{.Name}}/x")
+	out, err := p.Render(TrainingClass{Name: ".."})
+	if err != nil || out != "_/x" {
+		t.Fatalf("ERR: unexpected %q, %v", out, err)
+	}
+	p, _ = ParsePathTemplate("training", "../{{.ClassID}}")
+	if _, err := p.Render(c); err == nil {
+		t.Fatalf("ERR: expected an escaping template to be rejected")
+	}
+}
+
+func Test_SafeFilename(t *testing.T) {
+	for in, expected := range map[string]string{
+		"Roster.pdf":                       "Roster.pdf",
+		"../../etc/passwd":                 ".._.._etc_passwd",
+		"..":                               "file",
+		`C:\temp\a.doc`:                    "C__temp_a.doc",
+		"what?<now>.txt":                   "what__now_.txt",
+		"tab\there.txt":                    "tab_here.txt",
+		"CON.txt":                          "_CON.txt",
+		"CON.tar.gz":                       "_CON.tar.gz",
+		"nul.tar.gz":                       "_nul.tar.gz",
+		"COM0.log":                         "_COM0.log",
+		"LPT0":                             "_LPT0",
+		"CONIN$.txt":                       "_CONIN$.txt",
+		"conout$":                          "_conout$",
+		"CONSOLE.txt":                      "CONSOLE.txt",
+		"trailing. . ":                     "trailing",
+		".htaccess":                        ".htaccess",
+		strings.Repeat("é", 200) + ".pptx": strings.Repeat("é", 87) + ".pptx",
+	} {
+		if out := SafeFilename(in); out != expected {
+			t.Fatalf("ERR: %q: expected %q, got %q", in, expected, out)
+		}
+	}
+
+	used := map[string]bool{}
+	for _, expected := range []string{"a.pdf", "a-G1.pdf", "a-2.pdf"} {
+		if out := uniqueFilename(used, "a.pdf", "G1"); out != expected {
+			t.Fatalf("ERR: expected %q, got %q", expected, out)
+		}
+	}
+	long := strings.Repeat("x", maxFilenameBytes-4) + ".pdf"
+	if a, b := uniqueFilename(used, long, "G"), uniqueFilename(used, long, "G"); a == b || len(b) > maxFilenameBytes {
+		t.Fatalf("ERR: long names not made unique: %q %q", a, b)
+	}
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/teambition/rrule-go"
+)
+
+// ExpandEvents replaces each recurring event with its occurrences between
+// from and to, each carrying its RecurrenceID and no RRule. Occurrences
+// which the calendar overrides with an event of their own are dropped in
+// favor of the override. Events which do not recur are kept if they
+// overlap the range.
+func ExpandEvents(evs []CalendarEvent, from, to time.Time) ([]CalendarEvent, error) {
+	out := make([]CalendarEvent, 0, len(evs))
+
+	// Overridden occurrences, by UID and original start
+	overrides := map[string]bool{}
+	for _, e := range evs {
+		if e.RecurrenceID != nil {
+			overrides[e.UID+" "+e.RecurrenceID.UTC().Format(time.RFC3339)] = true
+		}
+	}
+
+	for _, e := range evs {
+		if e.RRule == "" || e.RecurrenceID != nil {
+			if e.Start.Before(to) && !calendarEventEndOrStart(e).Before(from) {
+				out = append(out, e)
+			}
+			continue
+		}
+
+		starts, err := occurrences(e, from, to)
+		if err != nil {
+			return out, fmt.Errorf("event %s: %w", e.UID, err)
+		}
+		length := e.End.Sub(e.Start)
+		for _, start := range starts {
+			if overrides[e.UID+" "+start.UTC().Format(time.RFC3339)] {
+				continue
+			}
+			occ := e
+			occ.Start = start
+			occ.End = start.Add(length)
+			rid := start
+			occ.RecurrenceID = &rid
+			occ.RRule = ""
+			occ.ExDates = nil
+			out = append(out, occ)
+		}
+	}
+	return out, nil
+}
+
+// occurrences returns the starts of a recurring event between from and to.
+func occurrences(e CalendarEvent, from, to time.Time) ([]time.Time, error) {
+	opt, err := rrule.StrToROptionInLocation(e.RRule, e.Start.Location())
+	if err != nil {
+		return nil, err
+	}
+	opt.Dtstart = e.Start
+	r, err := rrule.NewRRule(*opt)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &rrule.Set{}
+	set.RRule(r)
+	for _, ex := range e.ExDates {
+		set.ExDate(ex)
+	}
+
+	// Take in occurrences which started before the range but run into it
+	length := e.End.Sub(e.Start)
+	starts := set.Between(from.Add(-length), to, true)
+	out := make([]time.Time, 0, len(starts))
+	for _, s := range starts {
+		if s.Before(to) && (s.Add(length).After(from) || !s.Before(from)) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func calendarEventEndOrStart(e CalendarEvent) time.Time {
+	if e.End.After(e.Start) {
+		return e.End
+	}
+	return e.Start
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ExpandEvents(t *testing.T) {
+	data := []byte("BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:drill\r\n" +
+		"SUMMARY:Weekly drill\r\n" +
+		"DTSTART;TZID=America/New_York:20240102T190000\r\n" +
+		"DURATION:PT2H\r\n" +
+		"RRULE:FREQ=WEEKLY;BYDAY=TU;COUNT=5\r\n" +
+		"EXDATE;TZID=America/New_York:20240109T190000\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:drill\r\n" +
+		"SUMMARY:Weekly drill (moved)\r\n" +
+		"RECURRENCE-ID;TZID=America/New_York:20240116T190000\r\n" +
+		"DTSTART;TZID=America/New_York:20240117T190000\r\n" +
+		"DTEND;TZID=America/New_York:20240117T210000\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:meeting\r\n" +
+		"SUMMARY:Business meeting\r\n" +
+		"DTSTART:20240301T000000Z\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n")
+
+	evs, err := ParseCalendar(data)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if evs[0].TimeZone != "America/New_York" || evs[0].End.Sub(evs[0].Start) != 2*time.Hour || len(evs[0].ExDates) != 1 {
+		t.Fatalf("ERR: unexpected event %#v", evs[0])
+	}
+
+	out, err := ExpandEvents(evs,
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	// 5 occurrences, less one excluded and one moved, plus the moved one;
+	// the meeting is outside the range
+	days := []int{}
+	for _, e := range out {
+		if e.RRule != "" || e.RecurrenceID == nil {
+			t.Fatalf("ERR: unexpanded event %#v", e)
+		}
+		days = append(days, e.Start.Day())
+	}
+	expected := []int{2, 23, 30, 17}
+	if len(days) != len(expected) {
+		t.Fatalf("ERR: expected days %v, got %v", expected, days)
+	}
+	for i := range days {
+		if days[i] != expected[i] {
+			t.Fatalf("ERR: expected days %v, got %v", expected, days)
+		}
+	}
+	if out[0].Start.Hour() != 19 || out[0].End.Hour() != 21 {
+		t.Fatalf("ERR: unexpected local times %s - %s", out[0].Start, out[0].End)
+	}
+}
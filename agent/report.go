@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HoursRow is the training a member received in a year, in a category at
+// a station.
+type HoursRow struct {
+	MemberID string  `json:"member_id"`
+	Name     string  `json:"name"`
+	Year     int     `json:"year"`
+	Category string  `json:"category"`
+	Station  string  `json:"station"`
+	Classes  int     `json:"classes"`
+	Hours    float64 `json:"hours"`
+}
+
+// HoursShortfall is a member whose hours in a category fell below the
+// annual requirement.
+type HoursShortfall struct {
+	MemberID string  `json:"member_id"`
+	Name     string  `json:"name"`
+	Year     int     `json:"year"`
+	Category string  `json:"category"`
+	Hours    float64 `json:"hours"`
+	Required float64 `json:"required"`
+}
+
+// HoursThresholds are the annual hours required by category name, matched
+// without regard to case.
+type HoursThresholds map[string]float64
+
+// ParseHoursThresholds parses thresholds given as a comma separated list
+// of category=hours, e.g. "Company=192,Facility=18,Officer=12,Driver=12".
+func ParseHoursThresholds(s string) (HoursThresholds, error) {
+	out := HoursThresholds{}
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return out, fmt.Errorf("threshold %q is not category=hours", item)
+		}
+		h, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || h < 0 {
+			return out, fmt.Errorf("threshold %q has bad hours", item)
+		}
+		out[strings.ToLower(strings.TrimSpace(k))] = h
+	}
+	return out, nil
+}
+
+// TrainingHours totals the hours on members' transcripts by member,
+// calendar year, category and station. Classes without a date are left
+// out, as they belong to no year.
+func TrainingHours(ts []Transcript) []HoursRow {
+	type key struct {
+		member            string
+		year              int
+		category, station string
+	}
+	rows := map[key]*HoursRow{}
+	for _, t := range ts {
+		for _, e := range t.Classes {
+			if e.Date.IsZero() {
+				continue
+			}
+			k := key{t.MemberID + "\x00" + t.Name, e.Date.Year(), e.Category, e.Station}
+			r, ok := rows[k]
+			if !ok {
+				r = &HoursRow{MemberID: t.MemberID, Name: t.Name, Year: k.year, Category: e.Category, Station: e.Station}
+				rows[k] = r
+			}
+			r.Classes++
+			r.Hours += e.Hours
+		}
+	}
+
+	out := make([]HoursRow, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, *r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		switch {
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		case a.MemberID != b.MemberID:
+			return a.MemberID < b.MemberID
+		case a.Year != b.Year:
+			return a.Year < b.Year
+		case a.Category != b.Category:
+			return a.Category < b.Category
+		}
+		return a.Station < b.Station
+	})
+	return out
+}
+
+// HoursShortfalls returns, for every member and every year from firstYear
+// to lastYear, each category with a threshold in which their hours across
+// all stations fell short, including categories they had no training in
+// and years they had no training at all. A zero firstYear or lastYear is
+// taken from the earliest or latest year in rows.
+func HoursShortfalls(rows []HoursRow, thresholds HoursThresholds, firstYear, lastYear int) []HoursShortfall {
+	type member struct {
+		id, name string
+	}
+	type memberYear struct {
+		member
+		year int
+	}
+	hours := map[memberYear]map[string]float64{}
+	members := make([]member, 0)
+	seen := map[member]bool{}
+	minYear, maxYear := 0, 0
+	for _, r := range rows {
+		m := member{r.MemberID, r.Name}
+		if !seen[m] {
+			seen[m] = true
+			members = append(members, m)
+		}
+		if r.Year != 0 && (minYear == 0 || r.Year < minYear) {
+			minYear = r.Year
+		}
+		if r.Year > maxYear {
+			maxYear = r.Year
+		}
+		k := memberYear{m, r.Year}
+		if hours[k] == nil {
+			hours[k] = map[string]float64{}
+		}
+		hours[k][strings.ToLower(strings.TrimSpace(r.Category))] += r.Hours
+	}
+	if firstYear == 0 {
+		firstYear = minYear
+	}
+	if lastYear == 0 {
+		lastYear = maxYear
+	}
+	order := make([]memberYear, 0)
+	for _, m := range members {
+		for y := firstYear; y <= lastYear && y != 0; y++ {
+			order = append(order, memberYear{m, y})
+		}
+	}
+
+	categories := make([]string, 0, len(thresholds))
+	for c := range thresholds {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+
+	// Report categories under the name classes use, where there is one
+	names := map[string]string{}
+	for _, r := range rows {
+		if c := strings.ToLower(strings.TrimSpace(r.Category)); names[c] == "" {
+			names[c] = r.Category
+		}
+	}
+
+	out := make([]HoursShortfall, 0)
+	for _, k := range order {
+		for _, c := range categories {
+			got, required := hours[k][c], thresholds[c]
+			if math.Round(got*100) >= math.Round(required*100) {
+				continue
+			}
+			name := names[c]
+			if name == "" {
+				name = c
+			}
+			out = append(out, HoursShortfall{
+				MemberID: k.id, Name: k.name, Year: k.year,
+				Category: name, Hours: got, Required: required,
+			})
+		}
+	}
+	return out
+}
+
+// HoursCSVColumns are the columns of WriteHoursCSV.
+var HoursCSVColumns = []string{"Member ID", "Member", "Year", "Category", "Station", "Classes", "Hours"}
+
+// WriteHoursCSV writes training hours as CSV.
+func WriteHoursCSV(w io.Writer, rows []HoursRow) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(HoursCSVColumns)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		err = cw.Write([]string{
+			r.MemberID, r.Name, strconv.Itoa(r.Year), r.Category, r.Station,
+			strconv.Itoa(r.Classes), formatHours(r.Hours),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ShortfallCSVColumns are the columns of WriteShortfallCSV.
+var ShortfallCSVColumns = []string{"Member ID", "Member", "Year", "Category", "Hours", "Required", "Short By"}
+
+// WriteShortfallCSV writes members below their annual hours as CSV.
+func WriteShortfallCSV(w io.Writer, rows []HoursShortfall) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(ShortfallCSVColumns)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		err = cw.Write([]string{
+			r.MemberID, r.Name, strconv.Itoa(r.Year), r.Category,
+			formatHours(r.Hours), formatHours(r.Required), formatHours(r.Required - r.Hours),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
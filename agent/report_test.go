@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_TrainingHours(t *testing.T) {
+	day := func(y, m, d int) time.Time { return time.Date(y, time.Month(m), d, 19, 0, 0, 0, time.UTC) }
+	ts := []Transcript{
+		{MemberID: "11", Name: "Smith, Jo", Classes: []TranscriptEntry{
+			{ClassID: 1, Date: day(2023, 3, 1), Category: "Company", Station: "1", Hours: 100},
+			{ClassID: 2, Date: day(2023, 4, 1), Category: "Company", Station: "2", Hours: 92.1},
+			{ClassID: 3, Date: day(2023, 5, 1), Category: "company", Station: "2", Hours: 0.2},
+			{ClassID: 4, Date: day(2024, 1, 1), Category: "Driver", Station: "1", Hours: 2},
+			{ClassID: 5, Category: "Company", Hours: 40},
+		}},
+	}
+
+	rows := TrainingHours(ts)
+	if len(rows) != 4 {
+		t.Fatalf("ERR: unexpected rows %#v", rows)
+	}
+	if rows[0].Year != 2023 || rows[0].Category != "Company" || rows[0].Station != "1" || rows[0].Hours != 100 {
+		t.Fatalf("ERR: unexpected row %#v", rows[0])
+	}
+	if rows[3].Year != 2024 || rows[3].Category != "Driver" || rows[3].Classes != 1 {
+		t.Fatalf("ERR: unexpected row %#v", rows[3])
+	}
+
+	th, err := ParseHoursThresholds("Company=192, driver=12")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if _, err = ParseHoursThresholds("Company"); err == nil {
+		t.Fatalf("ERR: expected an error for a threshold without hours")
+	}
+
+	short := HoursShortfalls(rows, th, 0, 0)
+	// 2023: company met across stations and spellings, no driver training;
+	// 2024: both short
+	if len(short) != 3 {
+		t.Fatalf("ERR: unexpected shortfalls %#v", short)
+	}
+	if short[0].Year != 2023 || short[0].Category != "Driver" || short[0].Hours != 0 {
+		t.Fatalf("ERR: unexpected shortfall %#v", short[0])
+	}
+	if short[1].Year != 2024 || short[1].Category != "Company" || short[2].Category != "Driver" || short[2].Hours != 2 {
+		t.Fatalf("ERR: unexpected shortfalls %#v", short)
+	}
+
+	var b strings.Builder
+	err = WriteShortfallCSV(&b, short[2:])
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if !strings.HasSuffix(b.String(), "\n11,\"Smith, Jo\",2024,Driver,2,12,10\n") {
+		t.Fatalf("ERR: unexpected CSV %q", b.String())
+	}
+}
+
+func Test_HoursShortfalls_YearsWithoutTraining(t *testing.T) {
+	rows := []HoursRow{
+		{MemberID: "12", Name: "Doe, Al", Year: 2022, Category: "Company", Hours: 200},
+		{MemberID: "11", Name: "Smith, Jo", Year: 2024, Category: "Company", Hours: 200},
+	}
+	th := HoursThresholds{"company": 192}
+
+	short := HoursShortfalls(rows, th, 0, 0)
+	if len(short) != 4 {
+		t.Fatalf("ERR: unexpected shortfalls %#v", short)
+	}
+	if short[0].Name != "Doe, Al" || short[0].Year != 2023 || short[0].Hours != 0 || short[3].Name != "Smith, Jo" || short[3].Year != 2023 {
+		t.Fatalf("ERR: unexpected shortfalls %#v", short)
+	}
+
+	if short = HoursShortfalls(rows, th, 2022, 2025); len(short) != 6 {
+		t.Fatalf("ERR: unexpected shortfalls over 2022-2025 %#v", short)
+	}
+}
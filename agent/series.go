@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	trainingSeriesSidecar = "series.json"
+	// minRuleOccurrences is how many evenly spaced classes it takes to call
+	// them a series on their schedule alone, without shared files.
+	minRuleOccurrences = 3
+)
+
+// TrainingSeries is a recurring class, as guessed by DetectTrainingSeries:
+// classes which share a name, template, category, station and their files.
+// It is inferred from the class list, not read from ER's own series.
+type TrainingSeries struct {
+	// ID is the class ID of the first occurrence.
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Template string `json:"template,omitempty"`
+	Category string `json:"category,omitempty"`
+	Station  string `json:"station,omitempty"`
+	// RRule is the RFC 5545 recurrence rule the occurrences follow from
+	// Start, when they are evenly spaced.
+	RRule       string                     `json:"rrule,omitempty"`
+	Start       time.Time                  `json:"start"`
+	Occurrences []TrainingSeriesOccurrence `json:"occurrences"`
+	// Files are attached to every occurrence, and saved with the series.
+	Files []TrainingFile `json:"files"`
+}
+
+// TrainingSeriesOccurrence is a class of a series.
+type TrainingSeriesOccurrence struct {
+	ClassID int       `json:"class_id"`
+	Date    time.Time `json:"date"`
+}
+
+// TrainingSeriesLink is saved as series.json in each occurrence's
+// directory, pointing to the series.
+type TrainingSeriesLink struct {
+	SeriesID int    `json:"series_id"`
+	Path     string `json:"path"`
+}
+
+// DetectTrainingSeries guesses the series among classes, given each class's
+// files as listed by GetTrainingFiles. ER's own series membership is not
+// available to it, so unrelated classes that look alike can be grouped.
+// Classes with the same name, template, category and station are a series
+// when they share files, or when at least three of them fall on a regular
+// schedule. Classes without a date are never part of a series.
+func DetectTrainingSeries(classes []TrainingClass, files map[int][]TrainingFile) []TrainingSeries {
+	groups := map[string][]TrainingClass{}
+	keys := make([]string, 0)
+	seen := map[int]bool{}
+	for _, c := range classes {
+		if c.ClassID == 0 || c.Date.IsZero() || seen[c.ClassID] {
+			continue
+		}
+		seen[c.ClassID] = true
+		k := strings.Join([]string{
+			strings.ToLower(c.Name), strings.ToLower(c.Template),
+			strings.ToLower(c.Category), strings.ToLower(c.Station),
+		}, "\x00")
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], c)
+	}
+
+	out := make([]TrainingSeries, 0)
+	for _, k := range keys {
+		g := groups[k]
+		if len(g) < 2 {
+			continue
+		}
+		sort.Slice(g, func(i, j int) bool {
+			if !g[i].Date.Equal(g[j].Date) {
+				return g[i].Date.Before(g[j].Date)
+			}
+			return g[i].ClassID < g[j].ClassID
+		})
+
+		dates := make([]time.Time, len(g))
+		for i, c := range g {
+			dates[i] = c.Date
+		}
+		rule := seriesRRule(dates)
+		shared := sharedTrainingFiles(g, files)
+		if len(shared) == 0 && (rule == "" || len(g) < minRuleOccurrences) {
+			continue
+		}
+
+		s := TrainingSeries{
+			ID:       g[0].ClassID,
+			Name:     g[0].Name,
+			Template: g[0].Template,
+			Category: g[0].Category,
+			Station:  g[0].Station,
+			RRule:    rule,
+			Start:    g[0].Date,
+			Files:    shared,
+		}
+		for _, c := range g {
+			s.Occurrences = append(s.Occurrences, TrainingSeriesOccurrence{ClassID: c.ClassID, Date: c.Date})
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// sharedTrainingFiles returns the files, by GUID, attached to every class,
+// as listed for the first.
+func sharedTrainingFiles(classes []TrainingClass, files map[int][]TrainingFile) []TrainingFile {
+	counts := map[string]int{}
+	for _, c := range classes {
+		guids := map[string]bool{}
+		for _, f := range files[c.ClassID] {
+			if f.GUID != "" && !guids[f.GUID] {
+				guids[f.GUID] = true
+				counts[f.GUID]++
+			}
+		}
+	}
+
+	out := make([]TrainingFile, 0)
+	taken := map[string]bool{}
+	for _, f := range files[classes[0].ClassID] {
+		if counts[f.GUID] == len(classes) && !taken[f.GUID] {
+			taken[f.GUID] = true
+			f.ClassID = 0
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// seriesRRule returns the recurrence rule followed by dates, in order, or
+// an empty string when they are not evenly spaced by days, weeks, months
+// or years.
+func seriesRRule(dates []time.Time) string {
+	if len(dates) < 2 {
+		return ""
+	}
+	count := ";COUNT=" + strconv.Itoa(len(dates))
+
+	if months, ok := evenSpacing(dates, func(a, b time.Time) (int, bool) {
+		m := (b.Year()-a.Year())*12 + int(b.Month()) - int(a.Month())
+		return m, m > 0 && a.AddDate(0, m, 0).Equal(b)
+	}); ok {
+		if months%12 == 0 {
+			return "FREQ=YEARLY" + rruleInterval(months/12) + count
+		}
+		return "FREQ=MONTHLY" + rruleInterval(months) + count
+	}
+
+	if days, ok := evenSpacing(dates, func(a, b time.Time) (int, bool) {
+		d := b.Sub(a)
+		return int(d / (24 * time.Hour)), d > 0 && d%(24*time.Hour) == 0
+	}); ok {
+		if days%7 == 0 {
+			return "FREQ=WEEKLY" + rruleInterval(days/7) + count
+		}
+		return "FREQ=DAILY" + rruleInterval(days) + count
+	}
+	return ""
+}
+
+// evenSpacing returns the step between consecutive dates, as measured by
+// step, if it is the same throughout.
+func evenSpacing(dates []time.Time, step func(a, b time.Time) (int, bool)) (int, bool) {
+	first := 0
+	for i := 1; i < len(dates); i++ {
+		n, ok := step(dates[i-1], dates[i])
+		if !ok || (i > 1 && n != first) {
+			return 0, false
+		}
+		first = n
+	}
+	return first, true
+}
+
+func rruleInterval(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return ";INTERVAL=" + strconv.Itoa(n)
+}
+
+// DownloadTrainingSeries saves the files shared by a series once, in the
+// series's Dir, along with the series definition as series.json, filling in
+// where each file was saved.
+func (a *Agent) DownloadTrainingSeries(s *TrainingSeries) error {
+	files, err := a.SaveTrainingFiles(s.Dir(), s.Files, nil)
+	if err != nil {
+		return err
+	}
+	s.Files = files
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(a.output(), sinkPath(s.Dir(), trainingSeriesSidecar), b)
+}
+
+// LinkTrainingSeries records in a class's directory that it is an
+// occurrence of a series.
+func (a *Agent) LinkTrainingSeries(s TrainingSeries, destPath string) error {
+	b, err := json.MarshalIndent(TrainingSeriesLink{SeriesID: s.ID, Path: s.Dir()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(a.output(), sinkPath(destPath, trainingSeriesSidecar), b)
+}
+
+// SeriesFiles returns a series's saved files by GUID, for SaveTrainingFiles.
+func (s TrainingSeries) SeriesFiles() map[string]TrainingFile {
+	out := map[string]TrainingFile{}
+	for _, f := range s.Files {
+		if f.Status != TrainingFileFailed {
+			out[f.GUID] = f
+		}
+	}
+	return out
+}
+
+// Dir is the directory a series is saved in.
+func (s TrainingSeries) Dir() string {
+	return sinkPath(TrainingSeriesPath, strconv.Itoa(s.ID))
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_DetectTrainingSeries(t *testing.T) {
+	class := func(id int, name, date string) TrainingClass {
+		return NewTrainingClass([]string{strconv.Itoa(id), name, date, "2", "Company", "1", "", "Hose"})
+	}
+	classes := []TrainingClass{
+		// Weekly, sharing slides, listed out of order
+		class(10, "Hose Lays", "1/15/2024 19:00"),
+		class(11, "Hose Lays", "1/1/2024 19:00"),
+		class(12, "Hose Lays", "1/8/2024 19:00"),
+		// Monthly, no files
+		class(20, "Pump Ops", "1/31/2024 19:00"),
+		class(21, "Pump Ops", "2/29/2024 19:00"),
+		class(22, "Pump Ops", "3/31/2024 19:00"),
+		class(30, "Ladders", "1/3/2024 19:00"),
+		class(31, "Ladders", "1/4/2024 19:00"),
+		class(32, "Ladders", "3/9/2024 19:00"),
+		class(40, "One off", "1/5/2024 19:00"),
+	}
+	files := map[int][]TrainingFile{
+		10: {{ID: "1", GUID: "SLIDES", Title: "Slides.pptx"}, {ID: "2", GUID: "R10", Title: "Roster.pdf"}},
+		11: {{ID: "3", GUID: "SLIDES", Title: "Slides.pptx"}},
+		12: {{ID: "4", GUID: "SLIDES", Title: "Slides.pptx"}, {ID: "5", GUID: "R12", Title: "Roster.pdf"}},
+	}
+
+	series := DetectTrainingSeries(classes, files)
+	if len(series) != 1 {
+		t.Fatalf("ERR: unexpected series %#v", series)
+	}
+	s := series[0]
+	if s.ID != 11 || s.RRule != "FREQ=WEEKLY;COUNT=3" || len(s.Occurrences) != 3 || s.Occurrences[2].ClassID != 10 {
+		t.Fatalf("ERR: unexpected series %#v", s)
+	}
+	if len(s.Files) != 1 || s.Files[0].GUID != "SLIDES" {
+		t.Fatalf("ERR: unexpected shared files %#v", s.Files)
+	}
+
+	day := func(m, d int) time.Time { return time.Date(2024, time.Month(m), d, 19, 0, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		dates    []time.Time
+		expected string
+	}{
+		{[]time.Time{day(1, 1), day(1, 15), day(1, 29)}, "FREQ=WEEKLY;INTERVAL=2;COUNT=3"},
+		{[]time.Time{day(1, 1), day(1, 4), day(1, 7)}, "FREQ=DAILY;INTERVAL=3;COUNT=3"},
+		{[]time.Time{day(1, 10), day(2, 10), day(3, 10)}, "FREQ=MONTHLY;COUNT=3"},
+		{[]time.Time{day(1, 10), day(1, 10).AddDate(1, 0, 0)}, "FREQ=YEARLY;COUNT=2"},
+		// Month ends are not a monthly rule
+		{[]time.Time{day(1, 31), day(2, 29), day(3, 31)}, ""},
+		{[]time.Time{day(1, 1), day(1, 1)}, ""},
+	} {
+		if got := seriesRRule(c.dates); got != c.expected {
+			t.Fatalf("ERR: expected %q for %v, got %q", c.expected, c.dates, got)
+		}
+	}
+}
+
+func Test_MemoryFetcher_DownloadTrainingSeries(t *testing.T) {
+	a, f, dest := testMemoryAgent(t)
+	f.Responses["https://secure.emergencyreporting.com/filedownload.php?fileguid=SLIDES&contentdisposition=attachment"] = []byte("slides")
+	f.Responses["https://secure.emergencyreporting.com/filedownload.php?fileguid=R12&contentdisposition=attachment"] = []byte("roster")
+
+	s := TrainingSeries{ID: 11, Name: "Hose Lays", Files: []TrainingFile{{ID: "1", GUID: "SLIDES", Title: "Slides.pptx"}}}
+	err := a.DownloadTrainingSeries(&s)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if s.Files[0].Path != "training/series/11/Slides.pptx" {
+		t.Fatalf("ERR: unexpected series file %#v", s.Files[0])
+	}
+
+	// The series copy is used rather than downloading the slides again
+	delete(f.Responses, "https://secure.emergencyreporting.com/filedownload.php?fileguid=SLIDES&contentdisposition=attachment")
+	files, err := a.SaveTrainingFiles("training/12", []TrainingFile{
+		{ID: "4", ClassID: 12, GUID: "SLIDES", Title: "Slides.pptx"},
+		{ID: "5", ClassID: 12, GUID: "R12", Title: "Roster.pdf"},
+	}, s.SeriesFiles())
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if files[0].Status != TrainingFileInSeries || files[0].Path != s.Files[0].Path || files[0].SHA256 != sha256Hex([]byte("slides")) {
+		t.Fatalf("ERR: unexpected shared file %#v", files[0])
+	}
+	if files[1].Status != TrainingFileDownloaded {
+		t.Fatalf("ERR: unexpected file %#v", files[1])
+	}
+	if _, err = os.Stat(filepath.Join(dest, "training", "12", "Slides.pptx")); err == nil {
+		t.Fatalf("ERR: shared file was saved with the class")
+	}
+
+	err = a.LinkTrainingSeries(s, "training/12")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	b, err := os.ReadFile(filepath.Join(dest, "training", "12", "series.json"))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	var link TrainingSeriesLink
+	json.Unmarshal(b, &link)
+	if link.SeriesID != 11 || link.Path != "training/series/11" {
+		t.Fatalf("ERR: unexpected link %s", b)
+	}
+	if _, err = os.Stat(filepath.Join(dest, "training", "series", "11", "series.json")); err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+}
@@ -0,0 +1,590 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Sink receives exported files. Names are slash separated paths relative
+// to the root of the export, and must not escape it.
+type Sink interface {
+	// Create opens a file for writing. The file is complete once the
+	// returned writer has been closed without error.
+	Create(name string) (io.WriteCloser, error)
+	// Close finishes the export, flushing any archive trailer or pending
+	// upload.
+	Close() error
+}
+
+// SinkReader is implemented by sinks that can read back what an earlier
+// export left in the same place. Archives cannot, since every run writes a
+// new archive that has to stand on its own.
+type SinkReader interface {
+	// Open opens a file written earlier. A missing file gives an error
+	// wrapping os.ErrNotExist.
+	Open(name string) (io.ReadCloser, error)
+	// Exists reports whether a file was written earlier.
+	Exists(name string) (bool, error)
+}
+
+// ReadFile reads name back from a sink.
+func ReadFile(s SinkReader, name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// SizedSink is implemented by sinks that can stream a file whose size is
+// known before it is written, which would otherwise have to buffer it.
+type SizedSink interface {
+	// CreateSize opens a file of size bytes for writing, or of unknown
+	// size when size is negative.
+	CreateSize(name string, size int64) (io.WriteCloser, error)
+}
+
+// CreateSize opens name in the sink for writing size bytes, or an unknown
+// number when size is negative, passing the size on to sinks that use it.
+func CreateSize(s Sink, name string, size int64) (io.WriteCloser, error) {
+	if ss, ok := s.(SizedSink); ok {
+		return ss.CreateSize(name, size)
+	}
+	return s.Create(name)
+}
+
+// WriteFile writes data to name in the sink.
+func WriteFile(s Sink, name string, data []byte) error {
+	w, err := CreateSize(s, name, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// OpenSink opens an output sink from a target specification:
+//
+//   - "" or a directory path writes plain files under that directory
+//   - a path ending in .tar.gz or .tgz streams a gzipped tar archive
+//   - a path ending in .zip streams a zip archive
+//   - s3://bucket/prefix uploads to an S3 compatible bucket, configured with
+//     the S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY and
+//     S3_INSECURE environment variables
+//
+// When recipients are given, archives are encrypted as a whole (an
+// ".age" suffix is added to the archive name if missing) and directories
+// and buckets have each file encrypted individually.
+func OpenSink(target string, recipients ...age.Recipient) (Sink, error) {
+	encrypt := len(recipients) > 0
+	archive := strings.TrimSuffix(target, EncryptedSuffix)
+
+	var s Sink
+	var err error
+
+	switch {
+	case strings.HasPrefix(target, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(target, "s3://"), "/")
+		s, err = NewS3Sink(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_ACCESS_KEY_ID"),
+			os.Getenv("S3_SECRET_ACCESS_KEY"),
+			os.Getenv("S3_INSECURE") == "",
+			bucket, prefix,
+		)
+	case strings.HasSuffix(archive, ".tar.gz"), strings.HasSuffix(archive, ".tgz"), strings.HasSuffix(archive, ".zip"):
+		var w io.WriteCloser
+		w, err = openArchiveFile(archive, recipients)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(archive, ".zip") {
+			return NewZipSink(w), nil
+		}
+		return NewTarGzSink(w), nil
+	case target == "":
+		s = NewDirSink(".")
+	default:
+		s = NewDirSink(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypt {
+		return NewEncryptingSink(s, recipients...), nil
+	}
+	return s, nil
+}
+
+// openArchiveFile creates the file an archive sink streams into, wrapping
+// it in encryption when there are recipients so that the plaintext
+// archive never touches the disk.
+func openArchiveFile(name string, recipients []age.Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return os.Create(name)
+	}
+
+	fp, err := os.Create(name + EncryptedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewEncryptedWriter(fp, recipients...)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// sinkPath joins path elements into a sink file name.
+func sinkPath(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// cleanSinkName validates and normalizes a file name within a sink.
+func cleanSinkName(name string) (string, error) {
+	name = path.Clean(filepath.ToSlash(name))
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("invalid export file name %q", name)
+	}
+	return name, nil
+}
+
+// DirSink writes plain files under a directory.
+type DirSink struct {
+	Root string
+}
+
+func NewDirSink(root string) *DirSink {
+	return &DirSink{Root: root}
+}
+
+func (s *DirSink) Create(name string) (io.WriteCloser, error) {
+	name, err := cleanSinkName(name)
+	if err != nil {
+		return nil, err
+	}
+	fn := filepath.Join(s.Root, filepath.FromSlash(name))
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(fn)
+}
+
+func (s *DirSink) Open(name string) (io.ReadCloser, error) {
+	name, err := cleanSinkName(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(s.Root, filepath.FromSlash(name)))
+}
+
+func (s *DirSink) Exists(name string) (bool, error) {
+	name, err := cleanSinkName(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(s.Root, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DirSink) Close() error {
+	return nil
+}
+
+// archiveSink is the common part of the streaming archive sinks. Archive
+// formats can only have one member open at a time, so a member being
+// written holds the sink until it is closed, and Create from elsewhere
+// waits for it. Members are streamed into the archive as they are written,
+// except that tar needs each member's size before its data: a tar member
+// created without one, through Create rather than CreateSize, is buffered
+// in memory until closed, so the largest such file bounds memory use.
+type archiveSink struct {
+	out io.WriteCloser
+	// begin starts a member and returns its writer. size is -1 when not
+	// known, which only formats that stream accept.
+	begin func(name string, size int64) (io.Writer, error)
+	// end finishes the member begun last.
+	end func() error
+	// streams is set for formats whose members can be written without
+	// knowing their size first.
+	streams bool
+	flush   func() error
+	l       sync.Mutex
+}
+
+type archiveFile struct {
+	// buf holds a member whose size is not known yet, which is nil for
+	// members written straight to w.
+	buf  *bytes.Buffer
+	w    io.Writer
+	name string
+	s    *archiveSink
+	done bool
+}
+
+func (f *archiveFile) Write(p []byte) (int, error) {
+	if f.buf != nil {
+		return f.buf.Write(p)
+	}
+	return f.w.Write(p)
+}
+
+func (f *archiveFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	if f.buf == nil {
+		defer f.s.l.Unlock()
+		return f.s.end()
+	}
+
+	f.s.l.Lock()
+	defer f.s.l.Unlock()
+	w, err := f.s.begin(f.name, int64(f.buf.Len()))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(f.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return f.s.end()
+}
+
+func (s *archiveSink) Create(name string) (io.WriteCloser, error) {
+	return s.CreateSize(name, -1)
+}
+
+func (s *archiveSink) CreateSize(name string, size int64) (io.WriteCloser, error) {
+	name, err := cleanSinkName(name)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 && !s.streams {
+		return &archiveFile{buf: &bytes.Buffer{}, name: name, s: s}, nil
+	}
+
+	s.l.Lock()
+	w, err := s.begin(name, size)
+	if err != nil {
+		s.l.Unlock()
+		return nil, err
+	}
+	return &archiveFile{w: w, name: name, s: s}, nil
+}
+
+func (s *archiveSink) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	err := s.flush()
+	if cerr := s.out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NewTarGzSink streams a gzipped tar archive to w, closing w when the sink
+// is closed.
+func NewTarGzSink(w io.WriteCloser) Sink {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	return &archiveSink{
+		out: w,
+		begin: func(name string, size int64) (io.Writer, error) {
+			err := tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0644,
+				Size:    size,
+				ModTime: time.Now(),
+			})
+			return tw, err
+		},
+		// Fails when fewer bytes were written than the size given
+		end: tw.Flush,
+		flush: func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return gz.Close()
+		},
+	}
+}
+
+// NewZipSink streams a zip archive to w, closing w when the sink is closed.
+func NewZipSink(w io.WriteCloser) Sink {
+	zw := zip.NewWriter(w)
+	return &archiveSink{
+		out: w,
+		begin: func(name string, size int64) (io.Writer, error) {
+			return zw.CreateHeader(&zip.FileHeader{
+				Name:     name,
+				Method:   zip.Deflate,
+				Modified: time.Now(),
+			})
+		},
+		end:     func() error { return nil },
+		streams: true,
+		flush:   zw.Close,
+	}
+}
+
+// S3Sink uploads each file as an object in an S3 compatible bucket, such
+// as AWS S3 or MinIO, using path style addressing. Each file is buffered in
+// memory and sent as a single signed PUT when closed.
+type S3Sink struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func NewS3Sink(endpoint, accessKey, secretKey string, secure bool, bucket, prefix string) (*S3Sink, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("S3 sink needs an endpoint and a bucket")
+	}
+	if !strings.Contains(endpoint, "://") {
+		if secure {
+			endpoint = "https://" + endpoint
+		} else {
+			endpoint = "http://" + endpoint
+		}
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Sink{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		Prefix:    strings.Trim(prefix, "/"),
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{},
+	}, nil
+}
+
+type s3File struct {
+	bytes.Buffer
+	name string
+	s    *S3Sink
+}
+
+func (f *s3File) Close() error {
+	return f.s.put(f.name, f.Bytes())
+}
+
+func (s *S3Sink) Create(name string) (io.WriteCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{name: key, s: s}, nil
+}
+
+func (s *S3Sink) Open(name string) (io.ReadCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("fetching %s: %s: %s", key, resp.Status, string(body))
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Sink) Exists(name string) (bool, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do("HEAD", key, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("checking %s: %s", key, resp.Status)
+}
+
+func (s *S3Sink) Close() error {
+	return nil
+}
+
+// key gives the object key for a file name.
+func (s *S3Sink) key(name string) (string, error) {
+	name, err := cleanSinkName(name)
+	if err != nil {
+		return "", err
+	}
+	if s.Prefix != "" {
+		name = s.Prefix + "/" + name
+	}
+	return name, nil
+}
+
+// do sends a signed request for an object.
+func (s *S3Sink) do(method, key string, data []byte) (*http.Response, error) {
+	u := s.Endpoint + "/" + s3EscapePath(s.Bucket+"/"+key)
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if method == "PUT" {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	signS3Request(req, data, s.AccessKey, s.SecretKey, s.Region, time.Now())
+	return s.Client.Do(req)
+}
+
+func (s *S3Sink) put(key string, data []byte) error {
+	resp, err := s.do("PUT", key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("uploading %s: %s: %s", key, resp.Status, string(body))
+	}
+	return nil
+}
+
+// s3EscapePath percent-encodes an object path the way Signature Version 4
+// requires: every byte but the RFC 3986 unreserved characters and the
+// slashes between segments. url.URL leaves characters such as & + = ; @ $
+// alone, which S3 would then sign differently.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// signS3Request adds an AWS Signature Version 4 authorization to req for
+// the s3 service, signing every header already present plus host and the
+// x-amz-* headers it sets.
+func signS3Request(req *http.Request, payload []byte, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(req.Header.Values(k), ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	qs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			qs = append(qs, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		strings.ReplaceAll(strings.Join(qs, "&"), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Time zones are resolved the same way whatever the host has installed
+	_ "time/tzdata"
+)
+
+// calendarZones resolves the TZIDs of a calendar to locations, using the
+// calendar's own VTIMEZONE definitions for names the zone database does
+// not know, such as Windows zone names.
+type calendarZones struct {
+	defs  map[string]calendarComponent
+	cache map[string]*time.Location
+	errs  map[string]error
+}
+
+func newCalendarZones(data []byte) *calendarZones {
+	z := &calendarZones{
+		defs:  map[string]calendarComponent{},
+		cache: map[string]*time.Location{},
+		errs:  map[string]error{},
+	}
+	_, comps := splitCalendar(data)
+	for _, c := range comps {
+		if c.kind != "VTIMEZONE" {
+			continue
+		}
+		if k := c.key(); k != "" {
+			z.defs[strings.TrimPrefix(k, "VTIMEZONE ")] = c
+		}
+	}
+	return z
+}
+
+// location returns the location named by tzid, or an error when neither
+// the zone database nor the calendar defines it.
+func (z *calendarZones) location(tzid string) (*time.Location, error) {
+	if l, ok := z.cache[tzid]; ok {
+		return l, nil
+	}
+	if err, ok := z.errs[tzid]; ok {
+		return nil, err
+	}
+
+	l, err := time.LoadLocation(tzid)
+	if err != nil {
+		c, ok := z.defs[tzid]
+		if !ok {
+			err = fmt.Errorf("unknown time zone %q", tzid)
+		} else {
+			l, err = vtimezoneLocation(tzid, c)
+		}
+	}
+	if err != nil {
+		z.errs[tzid] = err
+		return nil, err
+	}
+	z.cache[tzid] = l
+	return l, nil
+}
+
+// vtimezoneObservance is a STANDARD or DAYLIGHT part of a VTIMEZONE.
+type vtimezoneObservance struct {
+	name   string
+	start  string
+	offset int
+	rrule  string
+}
+
+// vtimezoneLocation builds a location from a VTIMEZONE. An X-LIC-LOCATION
+// naming a known zone is used as is; otherwise the current (latest
+// starting) standard and daylight observances are turned into a POSIX TZ
+// rule, which covers the yearly rules calendar programs write.
+func vtimezoneLocation(tzid string, c calendarComponent) (*time.Location, error) {
+	var std, dst *vtimezoneObservance
+	var cur *vtimezoneObservance
+	for _, line := range c.lines {
+		name, _, value := splitCalendarLine(line)
+		switch {
+		case name == "X-LIC-LOCATION" && cur == nil:
+			if l, err := time.LoadLocation(value); err == nil {
+				return l, nil
+			}
+		case name == "BEGIN" && (strings.EqualFold(value, "STANDARD") || strings.EqualFold(value, "DAYLIGHT")):
+			cur = &vtimezoneObservance{}
+		case name == "END" && cur != nil:
+			latest := &std
+			if strings.EqualFold(value, "DAYLIGHT") {
+				latest = &dst
+			}
+			if *latest == nil || cur.start > (*latest).start {
+				*latest = cur
+			}
+			cur = nil
+		case cur == nil:
+		case name == "TZNAME":
+			cur.name = value
+		case name == "DTSTART":
+			cur.start = value
+		case name == "RRULE":
+			cur.rrule = value
+		case name == "TZOFFSETTO":
+			off, err := parseUTCOffset(value)
+			if err != nil {
+				return nil, fmt.Errorf("time zone %q: %w", tzid, err)
+			}
+			cur.offset = off
+		}
+	}
+	if std == nil {
+		return nil, fmt.Errorf("time zone %q has no standard time", tzid)
+	}
+
+	tz := posixZoneName(std.name, std.offset) + posixOffset(std.offset)
+	if dst != nil && dst.rrule != "" && std.rrule != "" {
+		start, err := posixRule(dst)
+		if err != nil {
+			return nil, fmt.Errorf("time zone %q: %w", tzid, err)
+		}
+		end, err := posixRule(std)
+		if err != nil {
+			return nil, fmt.Errorf("time zone %q: %w", tzid, err)
+		}
+		tz += posixZoneName(dst.name, dst.offset) + posixOffset(dst.offset) + "," + start + "," + end
+	}
+	return time.LoadLocationFromTZData(tzid, posixTZData(tz, std.offset))
+}
+
+// parseUTCOffset parses an offset such as "-0500" or "+053000" into
+// seconds east of UTC.
+func parseUTCOffset(s string) (int, error) {
+	if len(s) != 5 && len(s) != 7 || (s[0] != '+' && s[0] != '-') {
+		return 0, fmt.Errorf("bad UTC offset %q", s)
+	}
+	n := 0
+	for i, unit := range []int{3600, 60, 1} {
+		if 1+i*2 >= len(s) {
+			break
+		}
+		v, err := strconv.Atoi(s[1+i*2 : 3+i*2])
+		if err != nil {
+			return 0, fmt.Errorf("bad UTC offset %q", s)
+		}
+		n += v * unit
+	}
+	if s[0] == '-' {
+		n = -n
+	}
+	return n, nil
+}
+
+// posixZoneName gives a zone abbreviation in the form a POSIX TZ rule
+// accepts, falling back to the quoted offset.
+func posixZoneName(name string, offset int) string {
+	ok := len(name) >= 3
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') {
+			ok = false
+		}
+	}
+	if ok {
+		return name
+	}
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("<%c%02d%02d>", sign, offset/3600, offset/60%60)
+}
+
+// posixOffset writes an offset the POSIX way round, as the time to add to
+// local time to get UTC.
+func posixOffset(offset int) string {
+	sign := ""
+	if offset > 0 {
+		sign = "-"
+	} else {
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%d:%02d:%02d", sign, offset/3600, offset/60%60, offset%60)
+}
+
+// posixRule turns a yearly "nth weekday of the month" RRULE and the time of
+// day of its DTSTART into a POSIX "Mm.w.d/time" rule.
+func posixRule(o *vtimezoneObservance) (string, error) {
+	var month, week, day int
+	week = -1
+	for _, part := range strings.Split(o.rrule, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			if !strings.EqualFold(v, "YEARLY") {
+				return "", fmt.Errorf("unsupported rule %q", o.rrule)
+			}
+		case "BYMONTH":
+			month, _ = strconv.Atoi(v)
+		case "BYDAY":
+			if len(v) < 3 {
+				return "", fmt.Errorf("unsupported rule %q", o.rrule)
+			}
+			n, err := strconv.Atoi(v[:len(v)-2])
+			if err != nil || n == 0 || n < -1 || n > 5 {
+				return "", fmt.Errorf("unsupported rule %q", o.rrule)
+			}
+			if n == -1 {
+				n = 5
+			}
+			week = n
+			day = strings.Index("SUMOTUWETHFRSA", strings.ToUpper(v[len(v)-2:]))
+			if day < 0 || day%2 != 0 {
+				return "", fmt.Errorf("unsupported rule %q", o.rrule)
+			}
+			day /= 2
+		}
+	}
+	if month < 1 || month > 12 || week < 0 {
+		return "", fmt.Errorf("unsupported rule %q", o.rrule)
+	}
+
+	at := "2:00:00"
+	if _, clock, ok := strings.Cut(o.start, "T"); ok && len(clock) >= 6 {
+		at = fmt.Sprintf("%s:%s:%s", strings.TrimPrefix(clock[0:2], "0"), clock[2:4], clock[4:6])
+		if strings.HasPrefix(at, ":") {
+			at = "0" + at
+		}
+	}
+	return fmt.Sprintf("M%d.%d.%d/%s", month, week, day, at), nil
+}
+
+// posixTZData wraps a POSIX TZ rule in the smallest TZif (RFC 8536)
+// file that time.LoadLocationFromTZData accepts: no transitions, one
+// local time type and the rule as the footer, which then applies to all
+// times.
+func posixTZData(rule string, offset int) []byte {
+	var b bytes.Buffer
+	header := func(typecnt, charcnt uint32) {
+		b.WriteString("TZif2")
+		b.Write(make([]byte, 15))
+		for _, n := range []uint32{0, 0, 0, 0, typecnt, charcnt} {
+			binary.Write(&b, binary.BigEndian, n)
+		}
+	}
+
+	// An empty version 1 block, then the version 2 block
+	header(0, 0)
+	header(1, 1)
+	binary.Write(&b, binary.BigEndian, int32(offset))
+	b.Write([]byte{0, 0, 0})
+	b.WriteString("\n" + rule + "\n")
+	return b.Bytes()
+}
@@ -0,0 +1,371 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TrainingLookupFile is the class list saved by the training export,
+	// as CSV, with TrainingLookupJSONFile holding the same as JSON.
+	TrainingLookupFile     = "training/lookup.csv"
+	TrainingLookupJSONFile = "training/lookup.json"
+	// TrainingAttendanceFile is the attendance list saved in each class
+	// directory.
+	TrainingAttendanceFile = "attendance.json"
+)
+
+// Attendee is a row of a class's attendance list.
+type Attendee struct {
+	// RowID is the id of the attendance row itself, not of the member.
+	RowID string `json:"row_id"`
+	// UserID is the member's user ID, when the layout has a column for it.
+	UserID string `json:"user_id,omitempty"`
+	Name   string `json:"name"`
+	// Hours is the credit recorded for the member, if any.
+	Hours float64  `json:"hours,omitempty"`
+	Cells []string `json:"cells"`
+}
+
+// AttendanceColumns says which cell of a class_people.php row holds what,
+// counting from zero, with -1 for a column the list does not have. ER's
+// grid sends its cells without names, and the only one known for certain
+// is the member's name in the first; departments whose grid shows user
+// IDs or hours can map them with ParseAttendanceColumns.
+type AttendanceColumns struct {
+	Name   int
+	UserID int
+	Hours  int
+}
+
+// DefaultAttendanceColumns reads only the member's name.
+var DefaultAttendanceColumns = AttendanceColumns{Name: 0, UserID: -1, Hours: -1}
+
+// ParseAttendanceColumns parses a column mapping such as
+// "name=0,user=3,hours=4". Columns not given keep their default.
+func ParseAttendanceColumns(s string) (AttendanceColumns, error) {
+	out := DefaultAttendanceColumns
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err != nil || n < -1 {
+			return out, fmt.Errorf("bad attendance column %q", part)
+		}
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "name":
+			out.Name = n
+		case "user":
+			out.UserID = n
+		case "hours":
+			out.Hours = n
+		default:
+			return out, fmt.Errorf("unknown attendance column %q", k)
+		}
+	}
+	return out, nil
+}
+
+// ParseAttendance parses the attendance list of a class, as returned by
+// GetTrainingAttendance, reading the cells as cols lays them out.
+func ParseAttendance(data []byte, cols AttendanceColumns) ([]Attendee, error) {
+	var grid struct {
+		Rows []struct {
+			ID   string   `json:"id"`
+			Cell []string `json:"cell"`
+		} `json:"rows"`
+	}
+	err := json.Unmarshal(data, &grid)
+	if err != nil {
+		return []Attendee{}, err
+	}
+
+	out := make([]Attendee, 0, len(grid.Rows))
+	for _, r := range grid.Rows {
+		cell := func(i int) string {
+			if i < 0 || i >= len(r.Cell) {
+				return ""
+			}
+			return strings.TrimSpace(r.Cell[i])
+		}
+		a := Attendee{
+			RowID:  strings.TrimSpace(r.ID),
+			UserID: cell(cols.UserID),
+			Name:   cell(cols.Name),
+			Cells:  r.Cell,
+		}
+		if h, ok := parseHours(cell(cols.Hours)); ok {
+			a.Hours = h
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// ClassAttendance is a class and who attended it.
+type ClassAttendance struct {
+	Class     TrainingClass
+	Attendees []Attendee
+}
+
+// ReadTrainingExport reads the classes and attendance saved by the training
+// export from an export directory, placing each class with the same path
+// template as the export did and reading attendance with cols. Classes
+// without an attendance list are kept, with no attendees.
+func ReadTrainingExport(fsys fs.FS, tmpl *PathTemplate, cols AttendanceColumns) ([]ClassAttendance, error) {
+	out := make([]ClassAttendance, 0)
+
+	lookup, err := fs.ReadFile(fsys, TrainingLookupFile)
+	if err != nil {
+		return out, err
+	}
+	ix, err := readTrainingLookup(lookup)
+	if err != nil {
+		return out, fmt.Errorf("%s: %w", TrainingLookupFile, err)
+	}
+
+	for i := range ix.Rows {
+		c := ix.Class(i)
+		if c.ClassID == 0 {
+			continue
+		}
+
+		ca := ClassAttendance{Class: c, Attendees: []Attendee{}}
+		dir, err := tmpl.Render(c)
+		if err != nil {
+			return out, err
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, TrainingAttendanceFile))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return out, err
+		default:
+			ca.Attendees, err = ParseAttendance(data, cols)
+			if err != nil {
+				log.Printf("ERR: Attendance for class %d: %s", c.ClassID, err.Error())
+			}
+		}
+		out = append(out, ca)
+	}
+	return out, nil
+}
+
+// readTrainingLookup returns a saved class list. Exports made
+// before the list was saved as CSV hold a JSON array of records keyed by
+// column name instead.
+func readTrainingLookup(data []byte) (TrainingIndex, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '[' {
+		return ParseTrainingClassIndex(data)
+	}
+
+	ix := TrainingIndex{Header: TrainingClassColumns, Rows: [][]string{}}
+	var records []map[string]string
+	err := json.Unmarshal(data, &records)
+	if err != nil {
+		return ix, err
+	}
+	for _, r := range records {
+		row := make([]string, len(ix.Header))
+		for i, col := range ix.Header {
+			row[i] = r[col]
+		}
+		ix.Rows = append(ix.Rows, row)
+	}
+	return ix, nil
+}
+
+// TranscriptEntry is a class on a member's transcript.
+type TranscriptEntry struct {
+	ClassID       int       `json:"class_id"`
+	Name          string    `json:"name"`
+	Date          time.Time `json:"date"`
+	Category      string    `json:"category,omitempty"`
+	Station       string    `json:"station,omitempty"`
+	TrainingCodes []string  `json:"training_codes,omitempty"`
+	Hours         float64   `json:"hours"`
+	Instructor    string    `json:"instructor,omitempty"`
+}
+
+// Transcript is a member's training history.
+type Transcript struct {
+	// MemberID is the member's user ID, empty when the attendance lists
+	// have none.
+	MemberID   string            `json:"member_id"`
+	Name       string            `json:"name"`
+	TotalHours float64           `json:"total_hours"`
+	Classes    []TranscriptEntry `json:"classes"`
+}
+
+// BuildTranscripts turns class attendance into a transcript per member,
+// sorted by name, each listing its classes in date order. Members are told
+// apart by user ID, or by name when the attendance list has no user IDs,
+// and credited with the hours recorded in the attendance list, falling
+// back to the length of the class.
+func BuildTranscripts(classes []ClassAttendance) []Transcript {
+	byMember := map[string]*Transcript{}
+	for _, ca := range classes {
+		c := ca.Class
+		instructor := c.LeadInstructor
+		if instructor == "" {
+			instructor = c.Instructors
+		}
+		for _, a := range ca.Attendees {
+			key := a.UserID
+			if key == "" {
+				key = "name:" + a.Name
+			}
+			t, ok := byMember[key]
+			if !ok {
+				t = &Transcript{MemberID: a.UserID, Name: a.Name, Classes: []TranscriptEntry{}}
+				byMember[key] = t
+			}
+
+			hours := a.Hours
+			if hours == 0 {
+				hours = c.Hours()
+			}
+			t.Classes = append(t.Classes, TranscriptEntry{
+				ClassID:       c.ClassID,
+				Name:          c.Name,
+				Date:          c.Date,
+				Category:      c.Category,
+				Station:       c.Station,
+				TrainingCodes: splitTrainingCodes(c.TrainingCodes),
+				Hours:         hours,
+				Instructor:    instructor,
+			})
+			t.TotalHours += hours
+		}
+	}
+
+	out := make([]Transcript, 0, len(byMember))
+	for _, t := range byMember {
+		sort.SliceStable(t.Classes, func(i, j int) bool {
+			if !t.Classes[i].Date.Equal(t.Classes[j].Date) {
+				return t.Classes[i].Date.Before(t.Classes[j].Date)
+			}
+			return t.Classes[i].ClassID < t.Classes[j].ClassID
+		})
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].MemberID < out[j].MemberID
+	})
+	return out
+}
+
+// splitTrainingCodes splits the class list's comma separated codes.
+func splitTrainingCodes(s string) []string {
+	out := make([]string, 0)
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// TranscriptFilename is the base name, without extension, a member's
+// transcript is saved under.
+func TranscriptFilename(t Transcript) string {
+	if t.MemberID == "" {
+		return SafeFilename(t.Name)
+	}
+	return SafeFilename(t.MemberID + "-" + t.Name)
+}
+
+// formatHours formats hours to at most two decimal places, hiding the
+// rounding of sums of fractional hours.
+func formatHours(h float64) string {
+	return strconv.FormatFloat(math.Round(h*100)/100, 'f', -1, 64)
+}
+
+// TranscriptCSVColumns are the columns of WriteTranscriptCSV.
+var TranscriptCSVColumns = []string{
+	"Member ID", "Member", "Class ID", "Class", "Date",
+	"Category", "Station", "Training Codes", "Hours", "Instructor",
+}
+
+// WriteTranscriptCSV writes transcripts as CSV, one row per class attended.
+func WriteTranscriptCSV(w io.Writer, ts ...Transcript) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(TranscriptCSVColumns)
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		for _, e := range t.Classes {
+			err = cw.Write([]string{
+				t.MemberID, t.Name, strconv.Itoa(e.ClassID), e.Name, csvDate(e.Date),
+				e.Category, e.Station, strings.Join(e.TrainingCodes, ", "),
+				formatHours(e.Hours), e.Instructor,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var transcriptHTML = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"date":  csvDate,
+	"hours": formatHours,
+	"join":  strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Training transcript: {{.Name}}</title>
+<style>
+body { font-family: sans-serif; font-size: 11pt; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #999; padding: 4px 6px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+td.hours { text-align: right; }
+thead { display: table-header-group; }
+tr { page-break-inside: avoid; }
+@page { margin: 1.5cm; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>Training transcript</h1>
+<p><strong>{{.Name}}</strong>{{if .MemberID}} (member {{.MemberID}}){{end}}<br>
+{{len .Classes}} classes, {{hours .TotalHours}} hours</p>
+<table>
+<thead><tr><th>Date</th><th>Class</th><th>Category</th><th>Training codes</th><th>Instructor</th><th>Hours</th></tr></thead>
+<tbody>
+{{range .Classes}}<tr><td>{{date .Date}}</td><td>{{.Name}}</td><td>{{.Category}}</td><td>{{join .TrainingCodes ", "}}</td><td>{{.Instructor}}</td><td class="hours">{{hours .Hours}}</td></tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+// WriteTranscriptHTML writes a transcript as a standalone HTML page laid
+// out for printing, or saving as PDF from a browser.
+func WriteTranscriptHTML(w io.Writer, t Transcript) error {
+	return transcriptHTML.Execute(w, t)
+}
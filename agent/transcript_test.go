@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func Test_BuildTranscripts(t *testing.T) {
+	fsys := fstest.MapFS{
+		TrainingLookupFile: {Data: []byte(`[
+{"Class ID":"42","Name":"Hose Lays","Class Date":"3/5/2024 19:00","Length":"2","Category Name":"Company","Station":"1","Lead Instructor":"Doe, Al","Training Codes":"FF1, HOSE"},
+{"Class ID":"7","Name":"Ladders","Class Date":"1/9/2024 19:00","Length":"1:30","Category Name":"Company","Instructors":"Roe, Bo"},
+{"Class ID":"8","Name":"No attendance","Class Date":"2/1/2024 19:00","Length":"1"}
+]`)},
+		"training/42/attendance.json": {Data: []byte(`{"rows":[{"id":"501","cell":["Smith, Jo","3.0","11"]},{"id":"502","cell":["Doe, Al","","12"]}]}`)},
+		"training/7/attendance.json":  {Data: []byte(`{"rows":[{"id":"377","cell":["Smith, Jo","","11"]}]}`)},
+	}
+
+	tmpl, err := ParsePathTemplate("training-path", DefaultTrainingPath)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	classes, err := ReadTrainingExport(fsys, tmpl, AttendanceColumns{Name: 0, Hours: 1, UserID: 2})
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(classes) != 3 || len(classes[2].Attendees) != 0 {
+		t.Fatalf("ERR: unexpected classes %#v", classes)
+	}
+
+	ts := BuildTranscripts(classes)
+	if len(ts) != 2 || ts[0].Name != "Doe, Al" || ts[1].MemberID != "11" {
+		t.Fatalf("ERR: unexpected transcripts %#v", ts)
+	}
+	if ts[0].TotalHours != 2 {
+		t.Fatalf("ERR: expected class length to be credited, got %v", ts[0].TotalHours)
+	}
+
+	jo := ts[1]
+	if len(jo.Classes) != 2 || jo.Classes[0].ClassID != 7 || jo.TotalHours != 4.5 {
+		t.Fatalf("ERR: unexpected transcript %#v", jo)
+	}
+	if jo.Classes[0].Instructor != "Roe, Bo" || jo.Classes[1].Instructor != "Doe, Al" || len(jo.Classes[1].TrainingCodes) != 2 {
+		t.Fatalf("ERR: unexpected classes %#v", jo.Classes)
+	}
+
+	var b strings.Builder
+	err = WriteTranscriptCSV(&b, jo)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || lines[2] != `11,"Smith, Jo",42,Hose Lays,03/05/2024,Company,1,"FF1, HOSE",3,"Doe, Al"` {
+		t.Fatalf("ERR: unexpected CSV %q", b.String())
+	}
+
+	b.Reset()
+	err = WriteTranscriptHTML(&b, jo)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if !strings.Contains(b.String(), "<td>Ladders</td>") || !strings.Contains(b.String(), "2 classes, 4.5 hours") {
+		t.Fatalf("ERR: unexpected HTML %q", b.String())
+	}
+}
+
+func Test_ParseAttendance_Default(t *testing.T) {
+	as, err := ParseAttendance([]byte(`{"rows":[{"id":"501","cell":["Smith, Jo","7","1"]}]}`), DefaultAttendanceColumns)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	// Unmapped numbers are neither hours nor user IDs
+	if len(as) != 1 || as[0].Name != "Smith, Jo" || as[0].RowID != "501" || as[0].UserID != "" || as[0].Hours != 0 {
+		t.Fatalf("ERR: unexpected attendees %#v", as)
+	}
+
+	cols, err := ParseAttendanceColumns("user=2, hours=1")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if cols != (AttendanceColumns{Name: 0, UserID: 2, Hours: 1}) {
+		t.Fatalf("ERR: unexpected columns %+v", cols)
+	}
+	if _, err := ParseAttendanceColumns("badge=3"); err == nil {
+		t.Fatalf("ERR: unknown column accepted")
+	}
+}
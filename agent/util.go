@@ -1,8 +1,17 @@
 package agent
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,11 +39,114 @@ func parseShortDate(dt string) time.Time {
 	return t
 }
 
-// unwantedTraffic determines if a URL should be stored in memory or not
-func unwantedTraffic(url string) bool {
-	return !strings.HasPrefix(url, "http") ||
-		strings.HasSuffix(url, ".css") ||
-		strings.HasSuffix(url, ".js") ||
-		strings.HasSuffix(url, ".svg") ||
-		strings.HasSuffix(url, ".woff2")
+// classDateFormats are the formats class dates have been seen in.
+var classDateFormats = []string{
+	dateFormat,
+	dateShortFormat,
+	"1/2/2006 3:04:05 PM",
+	"1/2/2006 3:04 PM",
+	"1/2/2006",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// unparsedClassDates remembers the class dates already warned about, so
+// that each is only logged once however often its class is looked at.
+var unparsedClassDates sync.Map
+
+// parseClassDate parses a class date, returning the zero time when it is
+// not in any known format. Such dates are logged, since path templates
+// and filters using .Date, .Year or .Month then see no date at all.
+func parseClassDate(dt string) time.Time {
+	for _, f := range classDateFormats {
+		t, err := time.Parse(f, dt)
+		if err == nil {
+			return t
+		}
+	}
+	if _, seen := unparsedClassDates.LoadOrStore(dt, true); !seen {
+		log.Printf("WARN: Unrecognized class date %q, leaving .Date, .Year and .Month empty", dt)
+	}
+	return time.Time{}
+}
+
+// checkJsonContentType validates that a web service response is JSON. ER's
+// older PHP services do not always label their JSON correctly, so a body
+// which parses cleanly is accepted regardless of the declared type; an
+// HTML login or error page served in place of data is rejected.
+func checkJsonContentType(contentType string, body []byte) error {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err == nil && (mt == "application/json" || mt == "text/json" || strings.HasSuffix(mt, "+json")) {
+		if !json.Valid(body) {
+			return fmt.Errorf("%w: %s body is not valid JSON", ErrUnexpectedContentType, mt)
+		}
+		return nil
+	}
+	if json.Valid(body) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnexpectedContentType, contentType)
+}
+
+// attachmentKey identifies an attachment link by its file GUID, falling
+// back to the link itself when it does not carry one.
+func attachmentKey(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	for k, v := range u.Query() {
+		if strings.EqualFold(k, "fileguid") && len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
+	}
+	return href
+}
+
+// officeContentTypes covers the document formats most often attached to
+// classes, which are missing from minimal systems' MIME tables.
+var officeContentTypes = map[string]string{
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// detectContentType determines the media type of a downloaded file. Sniffing
+// only recognizes the container of Office documents (a zip file), so the
+// extension wins when sniffing is not specific.
+func detectContentType(name string, data []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	sniffed := http.DetectContentType(data)
+	byExt := mime.TypeByExtension(ext)
+	if byExt == "" {
+		byExt = officeContentTypes[ext]
+	}
+	if byExt != "" && (strings.HasPrefix(sniffed, "application/octet-stream") ||
+		strings.HasPrefix(sniffed, "application/zip") ||
+		strings.HasPrefix(sniffed, "text/plain")) {
+		return byExt
+	}
+	return sniffed
+}
+
+var hoursMinutes = regexp.MustCompile(`^(\d+):(\d{1,2})$`)
+
+// parseHours parses a class length or credit, such as "2", "1.5",
+// "1:30" or "2 hours".
+func parseHours(s string) (float64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(s, "hours"), "hrs"), "hr"))
+	if m := hoursMinutes.FindStringSubmatch(s); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		mins, _ := strconv.Atoi(m[2])
+		return float64(h) + float64(mins)/60, true
+	}
+	h, err := strconv.ParseFloat(s, 64)
+	if err != nil || h < 0 {
+		return 0, false
+	}
+	return h, true
 }
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_checkJsonContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		ok          bool
+	}{
+		{"application/json", `{"rows":[]}`, true},
+		{"application/json; charset=utf-8", `[1,2,3]`, true},
+		{"application/json", `<html></html>`, false},
+		{"text/html; charset=UTF-8", `{"accesslevel":"1","fileguid":"abc"}`, true},
+		{"text/html; charset=UTF-8", `<html><body>Please log in</body></html>`, false},
+		{"", ``, false},
+	}
+
+	for _, tc := range tests {
+		err := checkJsonContentType(tc.contentType, []byte(tc.body))
+		if tc.ok && err != nil {
+			t.Errorf("%q / %q: unexpected error %s", tc.contentType, tc.body, err.Error())
+		}
+		if !tc.ok && !errors.Is(err, ErrUnexpectedContentType) {
+			t.Errorf("%q / %q: expected ErrUnexpectedContentType, got %v", tc.contentType, tc.body, err)
+		}
+	}
+}
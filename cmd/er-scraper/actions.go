@@ -1,48 +1,253 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"filippo.io/age"
 	"github.com/dayvillefire/er-scraper/agent"
-	"github.com/jbuchbinder/shims"
 )
 
 func exportCommon() *agent.Agent {
+	openOutput()
 	a := getAgent()
 	err := a.Init()
 	if err != nil {
 		panic(err)
 	}
+	if *native {
+		a.Fetcher = a.NativeFetcher()
+	}
 	return a
 }
 
 func exportEvents() {
 	a := exportCommon()
 
-	cal, err := a.ExportCalendar()
+	dest, err := pathTemplate("events-path", *eventsPath).Render(agent.NewExportRun(time.Now()))
+	if err != nil {
+		panic(err)
+	}
+
+	from, to, chunk := calendarRange()
+	cal, typed, err := exportCalendar(a, from, to, chunk)
+	if err != nil {
+		panic(err)
+	}
+	err = agent.WriteFile(output, dest, cal)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("INFO: Exported %s", dest)
+
+	if *caldavURL != "" {
+		dav := agent.NewCalDAVClient(*caldavURL, os.Getenv("CALDAV_USERNAME"), os.Getenv("CALDAV_PASSWORD"))
+		_, err = dav.Sync(cal, from, to)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	base, ext := strings.TrimSuffix(dest, path.Ext(dest)), path.Ext(dest)
+	writeCalendarEvents(base, cal, from, to)
+
+	for _, tc := range typed {
+		typeBase := base + "-" + agent.SafeFilename(tc.entryType.Name)
+		err = agent.WriteFile(output, typeBase+ext, tc.cal)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("INFO: Exported %s", typeBase+ext)
+		writeCalendarEvents(typeBase, tc.cal, from, to)
+	}
+}
+
+// typedCalendar is the calendar of a single entry type.
+type typedCalendar struct {
+	entryType agent.CalendarEntryType
+	cal       []byte
+}
+
+// exportCalendar exports the calendar and, with --by-type, each entry type
+// on its own. The entry type tags of the latter are merged into the whole
+// calendar, which still takes in any entries without a type.
+func exportCalendar(a *agent.Agent, from, to time.Time, chunk agent.CalendarChunk) ([]byte, []typedCalendar, error) {
+	typed := make([]typedCalendar, 0)
+
+	cal, err := a.ExportCalendarRange(from, to, chunk)
+	if err != nil || !*eventsByType {
+		return cal, typed, err
+	}
+
+	types, err := a.GetCalendarEntryTypes()
+	if err != nil {
+		return cal, typed, err
+	}
+	cals := make([][]byte, 0, len(types)+1)
+	for _, t := range types {
+		tcal, err := a.ExportCalendarEntryType(from, to, chunk, t)
+		if err != nil {
+			return cal, typed, fmt.Errorf("entry type %s: %w", t.Name, err)
+		}
+		typed = append(typed, typedCalendar{entryType: t, cal: tcal})
+		cals = append(cals, tcal)
+	}
+	return agent.MergeCalendars(append(cals, cal)...), typed, nil
+}
+
+// writeCalendarEvents parses a calendar and writes its events as base.json
+// and base.csv, expanded with --expand.
+func writeCalendarEvents(base string, cal []byte, from, to time.Time) {
+	evs, err := agent.ParseCalendar(cal)
+	if err != nil {
+		panic(err)
+	}
+	if *expandEvents {
+		evs, err = agent.ExpandEvents(evs, from, to)
+		if err != nil {
+			panic(err)
+		}
+	}
+	writeEvents(base, evs)
+}
+
+// writeEvents writes parsed events as base.json and base.csv.
+func writeEvents(base string, evs []agent.CalendarEvent) {
+	var b bytes.Buffer
+	err := agent.WriteEventsJSON(&b, evs)
+	if err == nil {
+		err = agent.WriteFile(output, base+".json", b.Bytes())
+	}
 	if err != nil {
 		panic(err)
 	}
-	err = os.WriteFile("calendar.vcs", cal, 0644)
+
+	b.Reset()
+	err = agent.WriteEventsCSV(&b, evs)
+	if err == nil {
+		err = agent.WriteFile(output, base+".csv", b.Bytes())
+	}
 	if err != nil {
 		panic(err)
 	}
-	log.Printf("INFO: Exported calendar.vcs")
+	log.Printf("INFO: Exported %d events to %s.json and %s.csv", len(evs), base, base)
+}
+
+// calendarRange returns the event range and chunk size from the command
+// line, exiting on bad values.
+func calendarRange() (time.Time, time.Time, agent.CalendarChunk) {
+	from := agent.DefaultCalendarFrom
+	if *fromDate != "" {
+		from = dateFlag("from", *fromDate)
+	}
+	// --to is the last day included, as for training and NFIRS
+	to := agent.DefaultCalendarTo()
+	if *toDate != "" {
+		to = dateFlag("to", *toDate).AddDate(0, 0, 1)
+	}
+	chunk, err := agent.ParseCalendarChunk(*eventsChunk)
+	if err != nil {
+		log.Fatalf("ERR: --chunk: %s", err.Error())
+	}
+	return from, to, chunk
+}
+
+// dateFlag parses a YYYY-MM-DD date flag, exiting on a bad value.
+func dateFlag(name, value string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		log.Fatalf("ERR: --%s: %s", name, err.Error())
+	}
+	return t
+}
+
+// trainingFilter builds the training class filter from the command line,
+// exiting on bad values. --to takes in classes on the day itself.
+func trainingFilter() agent.TrainingClassFilter {
+	f := agent.TrainingClassFilter{
+		Categories: splitList(*classCategory),
+		Stations:   splitList(*classStation),
+		IDs:        map[int]bool{},
+	}
+	if *fromDate != "" {
+		f.From = dateFlag("from", *fromDate)
+	}
+	if *toDate != "" {
+		f.To = dateFlag("to", *toDate).AddDate(0, 0, 1)
+	}
+
+	lists := []string{*classIDs}
+	if *classIDsFile != "" {
+		b, err := os.ReadFile(*classIDsFile)
+		if err != nil {
+			log.Fatalf("ERR: --ids-file: %s", err.Error())
+		}
+		lists = append(lists, string(b))
+	}
+	for _, list := range lists {
+		ids, err := agent.ParseClassIDs(list)
+		if err != nil {
+			log.Fatalf("ERR: Class IDs: %s", err.Error())
+		}
+		for id := range ids {
+			f.IDs[id] = true
+		}
+	}
+	return f
 }
 
 func exportTraining() {
 	a := exportCommon()
 
 	log.Printf("INFO: Fetching all training class IDs")
-	ids, full, err := a.GetAllTrainingClassIDs()
+	ix, err := a.GetTrainingClassIndex()
+	if err != nil {
+		panic(err)
+	}
+
+	exportTrainingFromData(a, ix)
+}
+
+// exportTrainingReference exports the training categories, codes,
+// templates, instructors and resources which classes refer to by name,
+// from the sources given with --trainingref-sources. Every table that can
+// be fetched is saved, but any that cannot fails the export.
+func exportTrainingReference() {
+	sources := trainingReferenceSources()
+	if sources == nil {
+		log.Fatal("ERR: trainingref needs --trainingref-sources; ER's reference services are not built in")
+	}
+	a := exportCommon()
+
+	err := a.DownloadTrainingReference(agent.TrainingReferencePath, sources)
 	if err != nil {
 		panic(err)
 	}
+}
 
-	exportTrainingFromData(a, ids, full)
+// trainingReferenceSources returns the sources named by
+// --trainingref-sources, or nil without the flag, exiting if they cannot
+// be read.
+func trainingReferenceSources() agent.TrainingReferenceSources {
+	if *trainingRefFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(*trainingRefFile)
+	if err != nil {
+		log.Fatalf("ERR: --trainingref-sources: %s", err.Error())
+	}
+	sources, err := agent.ParseTrainingReferenceSources(data)
+	if err != nil {
+		log.Fatalf("ERR: --trainingref-sources: %s", err.Error())
+	}
+	return sources
 }
 
 func exportTrainingFromCSV(csvfile string) {
@@ -54,69 +259,82 @@ func exportTrainingFromCSV(csvfile string) {
 	}
 
 	log.Printf("INFO: Fetching all training class IDs")
-	ids, full, err := a.GetAllTrainingClassIDsFromCSV(csvdata)
+	ix, err := agent.ParseTrainingClassIndex(csvdata)
 	if err != nil {
 		panic(err)
 	}
 
-	exportTrainingFromData(a, ids, full)
+	exportTrainingFromData(a, ix)
 }
 
-func exportTrainingFromData(a *agent.Agent, ids []int, full [][]string) {
-	cols := []string{
-		"Class ID", "Name", "Class Date",
-		"Length", "Category Name", "Station",
-		"Evaluations", "Template", "Lead Instructor",
-		"Instructors", "Resources", "Training Codes",
-		"Location", "Objective", "Narrative",
-	}
+func exportTrainingFromData(a *agent.Agent, ix agent.TrainingIndex) {
+	tmpl := pathTemplate("training-path", *trainingPath)
 
-	lookupOut := []map[string]string{}
-	for _, r := range full {
-		item := map[string]string{}
-		for k, v := range r {
-			item[cols[k]] = v
-		}
-		lookupOut = append(lookupOut, item)
+	var b bytes.Buffer
+	err := ix.WriteCSV(&b)
+	if err == nil {
+		err = agent.WriteFile(output, agent.TrainingLookupFile, b.Bytes())
 	}
-
-	b, err := json.Marshal(lookupOut)
 	if err != nil {
 		log.Printf("ERR: %s", err.Error())
 		panic(err)
 	}
 
-	os.MkdirAll(fmt.Sprintf("%s/training", shims.SingleValueDiscardError(os.Getwd())), 0755)
-	err = os.WriteFile(fmt.Sprintf("%s/training/lookup.csv", shims.SingleValueDiscardError(os.Getwd())), b, 0644)
+	b.Reset()
+	err = ix.WriteJSON(&b)
+	if err == nil {
+		err = agent.WriteFile(output, agent.TrainingLookupJSONFile, b.Bytes())
+	}
 	if err != nil {
 		log.Printf("ERR: %s", err.Error())
 		panic(err)
 	}
 
-	for _, id := range ids {
+	// The index above lists every class; only the selected ones are fetched
+	sel := trainingFilter().Filter(ix)
+	ids := sel.IDs()
+	log.Printf("INFO: Exporting %d training classes", len(ids))
+
+	files, series := trainingSeries(a, ix, ids)
+
+	for i, id := range ids {
 		if id == 0 {
 			continue
 		}
 
 		log.Printf("INFO: Attempting to download assets for class %d", id)
-		os.MkdirAll(fmt.Sprintf("%s/training/%d", shims.SingleValueDiscardError(os.Getwd()), id), 0755)
+		dest, err := tmpl.Render(sel.Class(i))
+		if err != nil {
+			log.Printf("ERR: %s", err.Error())
+			continue
+		}
 
 		log.Printf("INFO: Getting narrative for class %d", id)
-		err = a.DownloadTrainingNarrative(id, fmt.Sprintf("%s/training/%d/narrative.json", shims.SingleValueDiscardError(os.Getwd()), id))
+		err = a.DownloadTrainingNarrative(id, dest+"/narrative.json")
 		if err != nil {
 			log.Printf("ERR: %s", err.Error())
 		}
 
 		log.Printf("INFO: Getting attendance for class %d", id)
-		err = a.DownloadTrainingAttendance(id, fmt.Sprintf("%s/training/%d/attendance.json", shims.SingleValueDiscardError(os.Getwd()), id))
+		err = a.DownloadTrainingAttendance(id, dest+"/attendance.json")
 		if err != nil {
 			log.Printf("ERR: %s", err.Error())
 		}
 
-		dest := fmt.Sprintf("%s/training/%d", shims.SingleValueDiscardError(os.Getwd()), id)
-		os.MkdirAll(dest, 0755)
-
-		err = a.DownloadTrainingAssets(id, dest)
+		list, listed := files[id]
+		var saved map[string]agent.TrainingFile
+		if s := series[id]; s != nil {
+			saved = s.SeriesFiles()
+			err = a.LinkTrainingSeries(*s, dest)
+			if err != nil {
+				log.Printf("ERR: %s", err.Error())
+			}
+		}
+		if listed {
+			_, err = a.SaveTrainingFiles(dest, list, saved)
+		} else {
+			err = a.DownloadTrainingAssets(id, dest)
+		}
 		if err != nil {
 			log.Printf("ERR: %s", err.Error())
 		}
@@ -125,3 +343,138 @@ func exportTrainingFromData(a *agent.Agent, ids []int, full [][]string) {
 		//time.Sleep(5 * time.Second)
 	}
 }
+
+// trainingSeries, with --series, lists every class's files and guesses the
+// recurring class series among them. Series are found across the whole
+// index, so that re-pulling some classes finds the same series as a full
+// run, but only those with an occurrence among the selected ids are saved,
+// with their shared files, once. It returns the files listed, and the
+// series by class ID.
+func trainingSeries(a *agent.Agent, ix agent.TrainingIndex, ids []int) (map[int][]agent.TrainingFile, map[int]*agent.TrainingSeries) {
+	files := map[int][]agent.TrainingFile{}
+	bySeries := map[int]*agent.TrainingSeries{}
+	if !*detectSeries {
+		return files, bySeries
+	}
+
+	selected := map[int]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	classes := make([]agent.TrainingClass, 0, len(ix.Rows))
+	for i, id := range ix.IDs() {
+		if id == 0 {
+			continue
+		}
+		classes = append(classes, ix.Class(i))
+		if _, ok := files[id]; ok {
+			continue
+		}
+		list, err := a.GetTrainingFiles(id)
+		if err != nil {
+			log.Printf("ERR: Files for class %d: %s", id, err.Error())
+			continue
+		}
+		files[id] = list
+	}
+
+	series := agent.DetectTrainingSeries(classes, files)
+	for i := range series {
+		s := &series[i]
+		wanted := false
+		for _, o := range s.Occurrences {
+			wanted = wanted || selected[o.ClassID]
+		}
+		if !wanted {
+			continue
+		}
+		log.Printf("INFO: Class %d starts a series of %d classes", s.ID, len(s.Occurrences))
+		err := a.DownloadTrainingSeries(s)
+		if err != nil {
+			log.Printf("ERR: Series %d: %s", s.ID, err.Error())
+			continue
+		}
+		for _, o := range s.Occurrences {
+			bySeries[o.ClassID] = s
+		}
+	}
+	return files, bySeries
+}
+
+// decrypt decrypts an encrypted archive or file, or every encrypted file
+// in a directory tree, dropping the .age suffix. Output defaults to
+// alongside the input.
+func decrypt(in, out string) {
+	ids, err := agent.ParseIdentities(*identityFile, passphrase())
+	if err != nil {
+		panic(err)
+	}
+
+	st, err := os.Stat(in)
+	if err != nil {
+		panic(err)
+	}
+
+	if !st.IsDir() {
+		if out == "" {
+			out = strings.TrimSuffix(in, agent.EncryptedSuffix)
+		}
+		err = decryptFile(in, out, ids)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if out == "" {
+		out = in
+	}
+	err = filepath.WalkDir(in, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, agent.EncryptedSuffix) {
+			return err
+		}
+		rel, err := filepath.Rel(in, p)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(out, strings.TrimSuffix(rel, agent.EncryptedSuffix))
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+		return decryptFile(p, dest, ids)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func decryptFile(in, out string, ids []age.Identity) error {
+	if in == out {
+		return fmt.Errorf("%s does not end in %s, refusing to overwrite it", in, agent.EncryptedSuffix)
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = agent.Decrypt(dst, src, ids...)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return fmt.Errorf("%s: %w", in, err)
+	}
+
+	log.Printf("INFO: Decrypted %s to %s", in, out)
+	return nil
+}
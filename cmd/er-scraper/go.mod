@@ -7,12 +7,14 @@ toolchain go1.23.0
 replace (
 	github.com/dayvillefire/er-scraper => ../..
 	github.com/dayvillefire/er-scraper/agent => ../../agent
+	github.com/dayvillefire/er-scraper/nfirs => ../../nfirs
 )
 
 require (
+	filippo.io/age v1.2.1
 	github.com/dayvillefire/er-scraper/agent v0.0.0-20240127175231-2a9c10659f74
-	github.com/jbuchbinder/shims v0.0.0-20240506232043-4fac4ec97ccb
 	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.22
 )
 
 require (
@@ -21,11 +23,15 @@ require (
 	github.com/chromedp/cdproto v0.0.0-20240810084448-b931b754e476 // indirect
 	github.com/chromedp/chromedp v0.10.0 // indirect
 	github.com/chromedp/sysutil v1.0.0 // indirect
+	github.com/dayvillefire/er-scraper/nfirs v0.0.0-00010101000000-000000000000 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.4.0 // indirect
+	github.com/jbuchbinder/shims v0.0.0-20240506232043-4fac4ec97ccb // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/mailru/easyjson v0.7.7 // indirect
+	github.com/teambition/rrule-go v1.8.2 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
 )
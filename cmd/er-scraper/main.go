@@ -4,50 +4,247 @@ import (
 	"flag"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/dayvillefire/er-scraper/agent"
 	"github.com/joho/godotenv"
 )
 
 var (
-	debug      = flag.Bool("debug", false, "Debug")
-	user, pass string
+	debug             = flag.Bool("debug", false, "Debug")
+	harFile           = flag.String("har", "", "Write captured network traffic to this HAR file on exit")
+	captureInclude    = flag.String("capture-include", "", "Comma separated URL regexps to capture (default all)")
+	captureExclude    = flag.String("capture-exclude", "", "Comma separated URL regexps to never capture (default static assets)")
+	captureMaxBody    = flag.Int("capture-max-body", 0, "Largest response body to capture, in bytes (default 1 MiB, -1 for none)")
+	captureMaxEntries = flag.Int("capture-max-entries", 0, "Number of exchanges kept in the capture ring buffer (default 500)")
+	native            = flag.Bool("native", false, "After logging in, fetch data natively with the session cookies instead of through the browser")
+	outDir            = flag.String("out", ".", "Directory the export is written to")
+	sinkTarget        = flag.String("sink", "", "Export destination: a directory, a .tar.gz or .zip archive, or s3://bucket/prefix (default --out)")
+	fromDate          = flag.String("from", "", "Start date (YYYY-MM-DD) of exported events, training classes and NFIRS incidents (default all; events from 2005-01-01)")
+	toDate            = flag.String("to", "", "Last date (YYYY-MM-DD), included, of exported events, training classes and NFIRS incidents (default all; events to the end of next year)")
+	classCategory     = flag.String("category", "", "Comma separated training categories to export (default all)")
+	classStation      = flag.String("station", "", "Comma separated stations whose training classes to export (default all)")
+	classIDs          = flag.String("ids", "", "Comma separated training class IDs to export (default all)")
+	classIDsFile      = flag.String("ids-file", "", "File listing training class IDs to export, one or more per line")
+	trainingPath      = flag.String("training-path", agent.DefaultTrainingPath, "Path template for each training class directory")
+	attendanceCols    = flag.String("attendance-columns", "", "Cells of the class attendance list holding the member's name, user ID and hours, e.g. name=0,user=3,hours=4 (default name=0 only)")
+	hoursThresholds   = flag.String("hours-thresholds", "", "Annual training hours required by category for the training-hours report, e.g. Company=192,Facility=18,Officer=12,Driver=12")
+	detectSeries      = flag.Bool("series", false, "Guess recurring class series from shared names and files, saving each series and its shared files once under training/series")
+	eventsChunk       = flag.String("chunk", "year", "Request the calendar a year or a month at a time")
+	expandEvents      = flag.Bool("expand", false, "Expand recurring events into one event per occurrence in the JSON and CSV exports")
+	eventsPath        = flag.String("events-path", agent.DefaultCalendarPath, "Path template for the calendar export; .json and .csv versions are written alongside")
+	eventsByType      = flag.Bool("by-type", false, "Also export each calendar entry type to its own file, tagging events with their type")
+	caldavURL         = flag.String("caldav", "", "Also sync the events to this CalDAV calendar collection, as CALDAV_USERNAME and CALDAV_PASSWORD")
+	nfirsExportURL    = flag.String("nfirs-export-url", "", "URL of ER's NFIRS export, from a --har capture, with {start} and {end} in place of the first and last day (MM/DD/YYYY)")
+	nerisMappingFile  = flag.String("neris-mapping", "", "JSON file mapping ER incident fields to NERIS document fields for the neris action (default built in)")
+	trainingRefFile   = flag.String("trainingref-sources", "", "JSON file giving the list (and detail) URL of each training reference table, from a --har capture, for the trainingref and sqlite actions")
+	nerisDetail       = flag.Bool("neris-detail", true, "Read each incident's printable view for the neris action, as well as the incident list")
+	recipients        = flag.String("recipient", "", "Comma separated age public keys or recipients files to encrypt the export to")
+	usePassphrase     = flag.Bool("passphrase", false, "Encrypt (or decrypt) with the passphrase in the EXPORT_PASSPHRASE environment variable")
+	dedup             = flag.Bool("dedup", false, "Store each attachment once under blobs/, linking it from every class and incident")
+	identityFile      = flag.String("identity", "", "age identity file for the decrypt action, reading back an encrypted --dedup index, and reading an encrypted export for transcripts and report")
+	recordDir         = flag.String("record", "", "Record all traffic into this directory")
+	replayDir         = flag.String("replay", "", "Replay traffic recorded with --record from this directory, without using the network")
+	user, pass        string
+
+	// offlineActions work on an existing export, without logging in
+	offlineActions = map[string]bool{"decrypt": true, "transcripts": true, "report": true}
+
+	activeAgent *agent.Agent
+	output      agent.Sink
+	blobs       *agent.BlobStore
 )
 
 func main() {
 	flag.Parse()
 
+	// Credentials are not needed to replay a recording or for the actions
+	// which work on an existing export
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && *replayDir == "" && !offlineActions[flag.Arg(0)] {
 		log.Fatal("Error loading .env file")
 	}
 
 	if len(flag.Args()) < 1 {
 		log.Printf("syntax: er-scraper [--flags] ACTION")
-		log.Printf("actions: events, training")
+		log.Printf("actions: events, training, trainingref, trainingcsv FILE, nfirs, neris, sqlite [FILE], transcripts [DIR], report training-hours [DIR], decrypt IN [OUT]")
 		return
 	}
 
 	user = os.Getenv("USERNAME")
 	pass = os.Getenv("PASSWORD")
 
+	defer closeAgent()
+	defer closeOutput()
+	defer saveHAR()
+
 	switch flag.Arg(0) {
 	case "events":
 		exportEvents()
 	case "training":
 		exportTraining()
+	case "trainingref":
+		exportTrainingReference()
 	case "trainingcsv":
 		exportTrainingFromCSV(flag.Arg(1))
+	case "nfirs":
+		exportNFIRS()
+	case "neris":
+		exportNERIS()
+	case "sqlite":
+		exportSQLite(flag.Arg(1))
+	case "transcripts":
+		exportTranscripts(flag.Arg(1))
+	case "report":
+		exportReport(flag.Arg(1), flag.Arg(2))
+	case "decrypt":
+		decrypt(flag.Arg(1), flag.Arg(2))
 	default:
-		log.Printf("Valid actions: events, training")
+		log.Printf("Valid actions: events, training, trainingref, trainingcsv, nfirs, neris, sqlite, transcripts, report, decrypt")
 		return
 	}
 }
 
+// openOutput opens the export sink, encrypting it if any recipients or a
+// passphrase were given. A HAR or recording would hold the same data in
+// plaintext, so neither is allowed alongside encryption.
+func openOutput() {
+	rs, err := agent.ParseRecipients(splitList(*recipients), passphrase())
+	if err != nil {
+		log.Fatalf("ERR: Encryption recipients: %s", err.Error())
+	}
+	if len(rs) > 0 && (*harFile != "" || *recordDir != "") {
+		log.Fatal("ERR: --har and --record are written in plaintext and cannot be used with --recipient or --passphrase")
+	}
+	output, err = agent.OpenSink(sinkTargetPath(), rs...)
+	if err != nil {
+		log.Fatalf("ERR: Opening output %s: %s", sinkTargetPath(), err.Error())
+	}
+	if *dedup {
+		// Reading back the index of an encrypted export needs a key
+		if es, ok := output.(*agent.EncryptingSink); ok && (*identityFile != "" || passphrase() != "") {
+			es.Identities, err = agent.ParseIdentities(*identityFile, passphrase())
+			if err != nil {
+				log.Fatalf("ERR: Decryption identity: %s", err.Error())
+			}
+		}
+		blobs, err = agent.NewBlobStore(output)
+		if err != nil {
+			log.Fatalf("ERR: Opening blob store: %s", err.Error())
+		}
+	}
+}
+
+// sinkTargetPath resolves the export destination, placing relative archive
+// paths within the output directory.
+func sinkTargetPath() string {
+	switch {
+	case *sinkTarget == "":
+		return *outDir
+	case strings.HasPrefix(*sinkTarget, "s3://"), filepath.IsAbs(*sinkTarget):
+		return *sinkTarget
+	}
+	return filepath.Join(*outDir, *sinkTarget)
+}
+
+// pathTemplate parses a path template flag, exiting on a bad template.
+func pathTemplate(name, text string) *agent.PathTemplate {
+	t, err := agent.ParsePathTemplate(name, text)
+	if err != nil {
+		log.Fatalf("ERR: %s", err.Error())
+	}
+	return t
+}
+
+func passphrase() string {
+	if !*usePassphrase {
+		return ""
+	}
+	p := os.Getenv("EXPORT_PASSPHRASE")
+	if p == "" {
+		log.Fatal("ERR: --passphrase given but EXPORT_PASSPHRASE is not set")
+	}
+	return p
+}
+
 func getAgent() *agent.Agent {
-	return &agent.Agent{
+	activeAgent = &agent.Agent{
 		Debug:    *debug,
 		Username: user,
 		Password: pass,
+		Capture: agent.CapturePolicy{
+			Include:     splitList(*captureInclude),
+			Exclude:     splitList(*captureExclude),
+			MaxBodySize: *captureMaxBody,
+			MaxEntries:  *captureMaxEntries,
+		},
+		RecordDir: *recordDir,
+		ReplayDir: *replayDir,
+		Output:    output,
+		Blobs:     blobs,
+	}
+	return activeAgent
+}
+
+// saveHAR writes the network capture of the agent, if requested. It is
+// deferred from main so that a HAR is still produced when an export panics,
+// which is exactly when one is wanted.
+func saveHAR() {
+	if *harFile == "" || activeAgent == nil {
+		return
+	}
+	r := recover()
+	err := activeAgent.SaveHAR(*harFile)
+	if err != nil {
+		log.Printf("ERR: Writing HAR %s: %s", *harFile, err.Error())
+	} else {
+		log.Printf("INFO: Wrote network capture to %s", *harFile)
+	}
+	if r != nil {
+		panic(r)
+	}
+}
+
+// closeAgent shuts down the browser and removes the agent's temporary
+// directories, whether or not the export succeeded.
+func closeAgent() {
+	if activeAgent == nil {
+		return
+	}
+	r := recover()
+	if err := activeAgent.Close(); err != nil {
+		log.Printf("ERR: Closing agent: %s", err.Error())
+	}
+	if r != nil {
+		panic(r)
+	}
+}
+
+// closeOutput finishes the export, which for archives writes the trailer
+// that makes them readable.
+func closeOutput() {
+	if output == nil {
+		return
+	}
+	r := recover()
+	if blobs != nil {
+		if err := blobs.Close(); err != nil {
+			log.Printf("ERR: Writing blob index: %s", err.Error())
+		}
+	}
+	err := output.Close()
+	if err != nil {
+		log.Printf("ERR: Closing output %s: %s", sinkTargetPath(), err.Error())
+	}
+	if r != nil {
+		panic(r)
+	}
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
 	}
+	return strings.Split(s, ",")
 }
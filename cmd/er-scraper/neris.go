@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+
+	"github.com/dayvillefire/er-scraper/agent"
+)
+
+const nerisDir = "neris"
+
+// exportNERIS converts every incident into a NERIS-style JSON document
+// under neris/, following --neris-mapping (default the built in mapping),
+// with the mapping used and a report of what was not carried over saved
+// alongside.
+func exportNERIS() {
+	m := nerisMapping()
+	a := exportCommon()
+
+	log.Printf("INFO: Fetching all incident IDs")
+	eids, err := a.GetIncidentIDs()
+	if err != nil {
+		panic(err)
+	}
+	rows, err := a.GetIncidentsCSV()
+	if err != nil {
+		log.Printf("ERR: Incident CSV: %s", err.Error())
+	}
+	summaries := incidentSummaries(rows)
+	if summaries == nil && len(rows) > 0 {
+		log.Printf("WARN: Incident CSV has no EID column; incidents are saved without their row")
+	}
+
+	incidents := make([]agent.IncidentRecord, 0, len(eids))
+	for _, eid := range eids {
+		inc := agent.IncidentRecord{EID: eid, Summary: summaries[eid]}
+		if *nerisDetail {
+			inc.Detail, err = a.GetIncidentDetail(eid)
+			if err != nil {
+				log.Printf("ERR: Incident %s: %s", eid, err.Error())
+			}
+		}
+		incidents = append(incidents, inc)
+	}
+
+	docs, report := agent.ConvertNERIS(incidents, m)
+	for i, doc := range docs {
+		writeNERISJSON(agent.SafeFilename(incidents[i].EID)+".json", doc)
+	}
+	writeNERISJSON("mapping.json", m)
+	writeNERISJSON("report.json", report)
+
+	var b bytes.Buffer
+	err = agent.WriteNERISUnmappedCSV(&b, report.Unmapped)
+	if err == nil {
+		err = agent.WriteFile(output, path.Join(nerisDir, "unmapped.csv"), b.Bytes())
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("INFO: Exported %d NERIS incidents; %d fields unmapped and %d values not converted, see %s",
+		len(docs), len(report.Unmapped), len(report.Invalid), path.Join(nerisDir, "report.json"))
+}
+
+// nerisMapping returns the mapping named by --neris-mapping, exiting if it
+// cannot be read.
+func nerisMapping() agent.NERISMapping {
+	if *nerisMappingFile == "" {
+		return agent.DefaultNERISMapping
+	}
+	data, err := os.ReadFile(*nerisMappingFile)
+	if err != nil {
+		log.Fatalf("ERR: --neris-mapping: %s", err.Error())
+	}
+	m, err := agent.ParseNERISMapping(data)
+	if err != nil {
+		log.Fatalf("ERR: --neris-mapping: %s", err.Error())
+	}
+	return m
+}
+
+func writeNERISJSON(name string, v any) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err == nil {
+		err = agent.WriteFile(output, path.Join(nerisDir, name), b)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/dayvillefire/er-scraper/agent"
+)
+
+// exportNFIRS saves ER's NFIRS transaction file, from --nfirs-export-url,
+// for the --from and --to range (default all incidents), and checks that
+// every incident the incident search finds in that range has a Basic
+// record with its incident number, saving the result alongside. It fails
+// when any incident is missing, or cannot be checked for want of a row in
+// the incident list.
+func exportNFIRS() {
+	if *nfirsExportURL == "" {
+		log.Fatal("ERR: nfirs needs --nfirs-export-url; ER's export address is not built in")
+	}
+	a := exportCommon()
+
+	from, to := nfirsRange()
+	data, err := a.ExportNFIRS(*nfirsExportURL, from, to)
+	if err != nil {
+		panic(err)
+	}
+	err = agent.WriteFile(output, path.Join(agent.NFIRSPath, agent.NFIRSExportFile), data)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("INFO: Fetching incident IDs")
+	ids, err := a.GetIncidentIDs()
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("INFO: Fetching the incident list")
+	rows, err := a.GetIncidentsCSV()
+	if err != nil {
+		panic(err)
+	}
+	incidents, err := agent.NFIRSIncidents(rows)
+	if err != nil {
+		panic(err)
+	}
+
+	v, err := agent.ValidateNFIRS(data, ids, incidents, from, to)
+	if err != nil {
+		panic(err)
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err == nil {
+		err = agent.WriteFile(output, path.Join(agent.NFIRSPath, agent.NFIRSValidationFile), b)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	if len(v.Undated) > 0 {
+		log.Printf("WARN: %d incidents have no readable date and were not checked; see %s", len(v.Undated), path.Join(agent.NFIRSPath, agent.NFIRSValidationFile))
+	}
+	if !v.OK() {
+		panic(fmt.Errorf("%d of %d incidents are missing from the NFIRS export and %d could not be checked; see %s", len(v.Missing), v.Incidents, len(v.Unlisted), path.Join(agent.NFIRSPath, agent.NFIRSValidationFile)))
+	}
+	log.Printf("INFO: Exported %d NFIRS records, covering all %d incidents", v.Records, v.Incidents)
+}
+
+// nfirsRange returns the incident range from the command line, with --to
+// taking in incidents on the day itself.
+func nfirsRange() (time.Time, time.Time) {
+	from := agent.DefaultNFIRSFrom
+	if *fromDate != "" {
+		from = dateFlag("from", *fromDate)
+	}
+	now := time.Now()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, 1)
+	if *toDate != "" {
+		to = dateFlag("to", *toDate).AddDate(0, 0, 1)
+	}
+	return from, to
+}
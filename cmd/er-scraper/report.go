@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+
+	"github.com/dayvillefire/er-scraper/agent"
+)
+
+const reportsDir = "reports"
+
+// exportReport runs a report over an existing export in dir.
+func exportReport(name, dir string) {
+	switch name {
+	case "training-hours":
+		reportTrainingHours(dir)
+	default:
+		log.Fatalf("ERR: Unknown report %q; valid reports: training-hours", name)
+	}
+}
+
+// reportTrainingHours totals members' training hours by year, category and
+// station, and lists those below the --hours-thresholds in any year.
+func reportTrainingHours(dir string) {
+	thresholds, err := agent.ParseHoursThresholds(*hoursThresholds)
+	if err != nil {
+		log.Fatalf("ERR: --hours-thresholds: %s", err.Error())
+	}
+
+	// Every member is checked in every year of the range, trained or not
+	firstYear, lastYear := 0, 0
+	if *fromDate != "" {
+		firstYear = dateFlag("from", *fromDate).Year()
+	}
+	if *toDate != "" {
+		lastYear = dateFlag("to", *toDate).Year()
+	}
+
+	_, ts := readTranscripts(dir)
+	rows := agent.TrainingHours(ts)
+	short := agent.HoursShortfalls(rows, thresholds, firstYear, lastYear)
+
+	openOutput()
+	b, err := json.MarshalIndent(struct {
+		Thresholds agent.HoursThresholds  `json:"thresholds"`
+		Hours      []agent.HoursRow       `json:"hours"`
+		Shortfalls []agent.HoursShortfall `json:"shortfalls"`
+	}{thresholds, rows, short}, "", "  ")
+	if err == nil {
+		err = agent.WriteFile(output, reportsDir+"/training-hours.json", b)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var cb bytes.Buffer
+	err = agent.WriteHoursCSV(&cb, rows)
+	if err == nil {
+		err = agent.WriteFile(output, reportsDir+"/training-hours.csv", cb.Bytes())
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	cb.Reset()
+	err = agent.WriteShortfallCSV(&cb, short)
+	if err == nil {
+		err = agent.WriteFile(output, reportsDir+"/training-hours-shortfalls.csv", cb.Bytes())
+	}
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("INFO: Training hours for %d members, %d below their annual hours", len(ts), len(short))
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dayvillefire/er-scraper/agent"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema normalizes every dataset into one database. Columns we know
+// the meaning of are broken out; the rest of each source record is kept as
+// JSON in a data column.
+const sqliteSchema = `
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY,
+	data TEXT
+);
+CREATE TABLE certifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	certification_id TEXT,
+	data TEXT
+);
+CREATE TABLE training_classes (
+	id INTEGER PRIMARY KEY,
+	name TEXT,
+	class_date TEXT,
+	length TEXT,
+	category TEXT,
+	station TEXT,
+	evaluations TEXT,
+	template TEXT,
+	lead_instructor TEXT,
+	instructors TEXT,
+	resources TEXT,
+	training_codes TEXT,
+	location TEXT,
+	objective TEXT,
+	narrative TEXT
+);
+CREATE TABLE training_reference (
+	ref_table TEXT NOT NULL,
+	id TEXT NOT NULL,
+	data TEXT,
+	detail TEXT,
+	PRIMARY KEY (ref_table, id)
+);
+CREATE TABLE training_attendance (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	class_id INTEGER NOT NULL REFERENCES training_classes(id),
+	row_id TEXT,
+	user_id INTEGER REFERENCES users(id),
+	data TEXT
+);
+CREATE TABLE training_files (
+	class_id INTEGER NOT NULL REFERENCES training_classes(id),
+	id TEXT NOT NULL,
+	title TEXT,
+	name TEXT,
+	description TEXT,
+	access_level TEXT,
+	file_guid TEXT,
+	path TEXT,
+	sha256 TEXT,
+	size INTEGER,
+	content_type TEXT,
+	PRIMARY KEY (class_id, id)
+);
+CREATE TABLE hydrants (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	data TEXT
+);
+CREATE TABLE incidents (
+	eid TEXT PRIMARY KEY,
+	data TEXT
+);
+CREATE TABLE calendar_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid TEXT,
+	summary TEXT,
+	description TEXT,
+	location TEXT,
+	categories TEXT,
+	start_time TEXT,
+	end_time TEXT,
+	time_zone TEXT,
+	all_day INTEGER,
+	rrule TEXT,
+	entry_type TEXT
+);
+CREATE INDEX training_attendance_user ON training_attendance(user_id);
+CREATE INDEX training_files_sha256 ON training_files(sha256);
+CREATE INDEX certifications_user ON certifications(user_id);
+`
+
+// exportSQLite exports every dataset into a single SQLite database, saved
+// as name in the output. Training files are saved alongside it and
+// referenced by path and hash.
+//
+// The database is built in memory and serialized straight into the
+// output, so that an encrypted export never has a plaintext copy on disk.
+func exportSQLite(name string) {
+	if name == "" {
+		name = "er-scraper.db"
+	}
+	a := exportCommon()
+
+	db, err := openSQLite(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	err = populateSQLite(a, db)
+	if err != nil {
+		panic(err)
+	}
+
+	data, err := serializeSQLite(db)
+	if err != nil {
+		panic(err)
+	}
+	err = agent.WriteFile(output, name, data)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("INFO: Exported %s", name)
+}
+
+// openSQLite opens the database in fn and creates the schema. The pool is
+// held to one connection, since each connection to ":memory:" would
+// otherwise get a database of its own.
+func openSQLite(fn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fn+"?_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// serializeSQLite returns the database file image of db.
+func serializeSQLite(db *sql.DB) ([]byte, error) {
+	c, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var out []byte
+	err = c.Raw(func(dc any) error {
+		sc, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected sqlite driver connection %T", dc)
+		}
+		out, err = sc.Serialize("main")
+		return err
+	})
+	return out, err
+}
+
+// populateSQLite loads each dataset in turn. A dataset which cannot be
+// fetched is logged and skipped so that the rest still make it into the
+// database; only database errors are fatal.
+func populateSQLite(a *agent.Agent, db *sql.DB) error {
+	users, err := sqliteUsers(a, db)
+	if err != nil {
+		return err
+	}
+	steps := []struct {
+		name string
+		fn   func(*agent.Agent, *sql.DB, map[int]bool) error
+	}{
+		{"certifications", sqliteCertifications},
+		{"training", sqliteTraining},
+		{"training reference", sqliteTrainingReference},
+		{"hydrants", sqliteHydrants},
+		{"incidents", sqliteIncidents},
+		{"calendar", sqliteCalendar},
+	}
+	for _, s := range steps {
+		log.Printf("INFO: Loading %s into database", s.name)
+		err = s.fn(a, db, users)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// jqGridRow is a row of the jqGrid list_json web services.
+type jqGridRow struct {
+	Id   string   `json:"id"`
+	Cell []string `json:"cell"`
+}
+
+func jqGridRows(v any) []jqGridRow {
+	var out struct {
+		Rows []jqGridRow `json:"rows"`
+	}
+	var b []byte
+	switch t := v.(type) {
+	case []byte:
+		b = t
+	default:
+		b, _ = json.Marshal(v)
+	}
+	json.Unmarshal(b, &out)
+	return out.Rows
+}
+
+func jsonString(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// knownUser returns id as a user reference, or nil when it is not a user
+// in the database, so that foreign keys hold.
+func knownUser(users map[int]bool, id string) any {
+	n, err := strconv.Atoi(strings.TrimSpace(id))
+	if err != nil || !users[n] {
+		return nil
+	}
+	return n
+}
+
+func sqliteUsers(a *agent.Agent, db *sql.DB) (map[int]bool, error) {
+	users := map[int]bool{}
+
+	log.Printf("INFO: Loading users into database")
+	list, err := a.GetUsers()
+	if err != nil {
+		log.Printf("ERR: Users: %s", err.Error())
+		return users, nil
+	}
+	for _, r := range jqGridRows(list) {
+		id, err := strconv.Atoi(r.Id)
+		if err != nil || users[id] {
+			continue
+		}
+		_, err = db.Exec(`INSERT INTO users (id, data) VALUES (?, ?)`, id, jsonString(r.Cell))
+		if err != nil {
+			return users, err
+		}
+		users[id] = true
+	}
+	return users, nil
+}
+
+func sqliteCertifications(a *agent.Agent, db *sql.DB, users map[int]bool) error {
+	for id := range users {
+		certs, err := a.GetUserCertifications(id)
+		if err != nil {
+			log.Printf("ERR: Certifications for user %d: %s", id, err.Error())
+			continue
+		}
+		// The API wraps the list in an object, under a key we do not rely on
+		for _, v := range certs {
+			list, ok := v.([]any)
+			if !ok {
+				continue
+			}
+			for _, c := range list {
+				certId := ""
+				if m, ok := c.(map[string]any); ok {
+					for k, v := range m {
+						if strings.EqualFold(k, "certificationID") || strings.EqualFold(k, "id") {
+							certId = fmt.Sprint(v)
+						}
+					}
+				}
+				_, err = db.Exec(`INSERT INTO certifications (user_id, certification_id, data) VALUES (?, ?, ?)`,
+					id, certId, jsonString(c))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func sqliteTraining(a *agent.Agent, db *sql.DB, users map[int]bool) error {
+	ix, err := a.GetTrainingClassIndex()
+	if err != nil {
+		log.Printf("ERR: Training classes: %s", err.Error())
+		return nil
+	}
+
+	tmpl, err := agent.ParsePathTemplate("training-path", *trainingPath)
+	if err != nil {
+		return err
+	}
+	cols := attendanceColumns()
+
+	seen := map[int]bool{}
+	for i, id := range ix.IDs() {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		vals := make([]any, len(agent.TrainingClassColumns))
+		for k, name := range agent.TrainingClassColumns {
+			vals[k] = ix.Value(i, name)
+		}
+		vals[0] = id
+		_, err = db.Exec(`INSERT INTO training_classes (id, name, class_date, length, category, station,
+			evaluations, template, lead_instructor, instructors, resources, training_codes, location, objective, narrative)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, vals...)
+		if err != nil {
+			return err
+		}
+
+		attendance, err := a.GetTrainingAttendance(id)
+		if err != nil {
+			log.Printf("ERR: Attendance for class %d: %s", id, err.Error())
+		}
+		attendees, err := agent.ParseAttendance(attendance, cols)
+		if err != nil && attendance != nil {
+			log.Printf("ERR: Attendance for class %d: %s", id, err.Error())
+		}
+		for _, at := range attendees {
+			_, err = db.Exec(`INSERT INTO training_attendance (class_id, row_id, user_id, data) VALUES (?, ?, ?, ?)`,
+				id, at.RowID, knownUser(users, at.UserID), jsonString(at.Cells))
+			if err != nil {
+				return err
+			}
+		}
+
+		dest, err := tmpl.Render(ix.Class(i))
+		if err != nil {
+			return err
+		}
+		files, err := a.DownloadTrainingFiles(id, dest)
+		if err != nil {
+			log.Printf("ERR: Files for class %d: %s", id, err.Error())
+		}
+		for _, f := range files {
+			_, err = db.Exec(`INSERT OR REPLACE INTO training_files (class_id, id, title, name, description, access_level,
+				file_guid, path, sha256, size, content_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, f.ID, f.Title, f.Name, f.Description, f.AccessLevel, f.GUID, f.Path, f.SHA256, f.Size, f.ContentType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// csvObjects turns CSV rows into objects keyed by the header row.
+func csvObjects(rows [][]string) []map[string]string {
+	out := make([]map[string]string, 0)
+	if len(rows) < 2 {
+		return out
+	}
+	header := rows[0]
+	for _, r := range rows[1:] {
+		item := map[string]string{}
+		for k, v := range r {
+			if k < len(header) {
+				item[header[k]] = v
+			}
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+// incidentSummaries indexes the rows of the incident list CSV by their EID
+// column, so that each incident's row can be found by its EID. It returns
+// nil when the list has no EID column.
+func incidentSummaries(rows [][]string) map[string]map[string]string {
+	if len(rows) == 0 {
+		return nil
+	}
+	eid := ""
+	for _, h := range rows[0] {
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")), "EID") {
+			eid = h
+			break
+		}
+	}
+	if eid == "" {
+		return nil
+	}
+
+	out := map[string]map[string]string{}
+	for _, r := range csvObjects(rows) {
+		if k := strings.TrimSpace(r[eid]); k != "" {
+			out[k] = r
+		}
+	}
+	return out
+}
+
+func sqliteHydrants(a *agent.Agent, db *sql.DB, users map[int]bool) error {
+	rows, err := a.GetHydrants()
+	if err != nil {
+		log.Printf("ERR: Hydrants: %s", err.Error())
+		return nil
+	}
+	for _, h := range csvObjects(rows) {
+		_, err = db.Exec(`INSERT INTO hydrants (data) VALUES (?)`, jsonString(h))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteIncidents loads the incident list, attaching each incident's row
+// of the NFIRS CSV export by its EID column.
+func sqliteIncidents(a *agent.Agent, db *sql.DB, users map[int]bool) error {
+	eids, err := a.GetIncidentIDs()
+	if err != nil {
+		log.Printf("ERR: Incidents: %s", err.Error())
+		return nil
+	}
+
+	rows, err := a.GetIncidentsCSV()
+	if err != nil {
+		log.Printf("ERR: Incident CSV: %s", err.Error())
+	}
+	byEid := incidentSummaries(rows)
+	if byEid == nil && len(rows) > 0 {
+		log.Printf("WARN: Incident CSV has no EID column; incidents are saved without their row")
+	}
+
+	for _, eid := range eids {
+		var data any
+		if r, ok := byEid[eid]; ok {
+			data = jsonString(r)
+		}
+		_, err = db.Exec(`INSERT OR IGNORE INTO incidents (eid, data) VALUES (?, ?)`, eid, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqliteCalendar(a *agent.Agent, db *sql.DB, users map[int]bool) error {
+	from, to, chunk := calendarRange()
+	cal, _, err := exportCalendar(a, from, to, chunk)
+	if err != nil {
+		log.Printf("ERR: Calendar: %s", err.Error())
+		return nil
+	}
+	evs, err := agent.ParseCalendar(cal)
+	if err != nil {
+		log.Printf("ERR: Calendar: %s", err.Error())
+		return nil
+	}
+	for _, e := range evs {
+		_, err = db.Exec(`INSERT INTO calendar_events (uid, summary, description, location, categories,
+			start_time, end_time, time_zone, all_day, rrule, entry_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.UID, e.Summary, e.Description, e.Location, strings.Join(e.Categories, ","),
+			sqliteTime(e.Start), sqliteTime(e.End), e.TimeZone, e.AllDay, e.RRule, e.EntryType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteTrainingReference loads the training reference tables given with
+// --trainingref-sources, leaving the table empty without the flag.
+func sqliteTrainingReference(a *agent.Agent, db *sql.DB, users map[int]bool) error {
+	sources := trainingReferenceSources()
+	if sources == nil {
+		log.Printf("INFO: No --trainingref-sources given, skipping the training reference tables")
+		return nil
+	}
+	for _, table := range agent.TrainingReferenceTables {
+		src, ok := sources[table]
+		if !ok {
+			continue
+		}
+		refs, err := a.GetTrainingReference(table, src)
+		if err != nil {
+			log.Printf("ERR: Training %s: %s", table, err.Error())
+			continue
+		}
+		for _, r := range refs {
+			var detail any
+			if len(r.Detail) > 0 {
+				detail = string(r.Detail)
+			}
+			_, err = db.Exec(`INSERT OR REPLACE INTO training_reference (ref_table, id, data, detail) VALUES (?, ?, ?, ?)`,
+				table, r.ID, jsonString(r.Cells), detail)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sqliteTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
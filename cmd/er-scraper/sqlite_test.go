@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dayvillefire/er-scraper/agent"
+)
+
+const erHost = "https://secure.emergencyreporting.com"
+
+func Test_populateSQLite(t *testing.T) {
+	*attendanceCols = "user=1"
+	defer func() { *attendanceCols = "" }()
+
+	dir := t.TempDir()
+	*trainingRefFile = filepath.Join(dir, "sources.json")
+	defer func() { *trainingRefFile = "" }()
+	err := os.WriteFile(*trainingRefFile, []byte(`{"categories": {"list": "`+erHost+`/training/ws/categories.php?_function=list_json"}}`), 0600)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	f := agent.NewMemoryFetcher()
+	f.Responses[erHost+"/webservices/admin/users.php?_function=list_json&_search=false&rows=500&page=1&sidx=name&sord=asc"] = []byte(
+		`{"rows":[{"id":"11","cell":["Smith, Jo","FF"]},{"id":"12","cell":["Doe, Al","LT"]}]}`)
+	f.Responses["https://api.emergencyreporting.com/V1/users/11/certifications?limit=1000"] = []byte(
+		`{"certifications":[{"certificationID":5,"name":"Firefighter I"}]}`)
+	f.Responses["https://api.emergencyreporting.com/V1/users/12/certifications?limit=1000"] = []byte(`{"certifications":[]}`)
+	f.Responses[erHost+"/training/ws/classes.php?_function=list_csv&_csvtype=info"] = []byte(
+		"Class ID,Name,Class Date\n42,Hose Lays,1/5/2024 19:00\n")
+	f.Responses[erHost+"/training/ws/class_people.php?classid=42&_function=list_json"] = []byte(
+		`{"rows":[{"id":"501","cell":["Smith, Jo","11"]},{"id":"502","cell":["Visitor",""]}]}`)
+	f.Responses[erHost+"/training/ws/class_files.php?classid=42&_function=list_json"] = []byte(
+		`{"rows":[{"id":"7","cell":["Hose Lays.pptx","Slides","Members"]}]}`)
+	f.Responses[erHost+"/training/ws/class_files.php?classid=42&id=7&_function=detail"] = []byte(
+		`{"accesslevel":"1","description":"Slides","fileguid":"AAA","name":"Hose Lays.pptx","url":""}`)
+	f.Responses[erHost+"/filedownload.php?fileguid=AAA&contentdisposition=attachment"] = []byte("pptx data")
+	f.Responses[erHost+"/training/ws/categories.php?_function=list_json"] = []byte(
+		`{"rows":[{"id":"3","cell":["Company"]},{"id":"4","cell":["Officer"]}]}`)
+	f.Responses[erHost+"/webservices/hydrants/hydrants.php?_type=hydrants&_function=list_csv"] = []byte(
+		"Hydrant,Street\nH-1,Main St\nH-2,Elm St\n")
+	f.Responses[erHost+"/nfirs/main_results.asp?pagenumber=1"] = []byte(`<html><body><table>
+<tr><td class="listout" onclick="viewIncident('1001')">1001</td></tr>
+</table><button id="button4" disabled>Next</button></body></html>`)
+	f.Responses[erHost+"/nfirs/main_results.asp?downloadCSV=1"] = []byte("EID,Incident Type\n1001,111\n")
+	// The same event is returned by every yearly chunk, and merged
+	for y := agent.DefaultCalendarFrom.Year(); y <= time.Now().Year()+1; y++ {
+		from := time.Date(y, 1, 1, 0, 0, 0, 0, time.Local)
+		f.Responses[agent.CalendarExportURL(from, from.AddDate(1, 0, 0), "")] = []byte(
+			"BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Drill\r\nDTSTART:20240105T190000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+	}
+
+	a := &agent.Agent{Fetcher: f, Output: agent.NewDirSink(dir)}
+	db, err := openSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	defer db.Close()
+
+	err = populateSQLite(a, db)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+
+	for table, expected := range map[string]int{
+		"users": 2, "certifications": 1, "training_classes": 1, "training_attendance": 2,
+		"training_files": 1, "training_reference": 2, "hydrants": 2, "incidents": 1, "calendar_events": 1,
+	} {
+		var n int
+		err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+		if err != nil {
+			t.Fatalf("ERR: %s", err.Error())
+		}
+		if n != expected {
+			t.Fatalf("ERR: %s: expected %d rows, got %d", table, expected, n)
+		}
+	}
+
+	var name string
+	err = db.QueryRow(`SELECT c.name FROM training_attendance ta
+		JOIN training_classes c ON c.id = ta.class_id
+		JOIN users u ON u.id = ta.user_id`).Scan(&name)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if name != "Hose Lays" {
+		t.Fatalf("ERR: unexpected class %q", name)
+	}
+
+	var path, sum, data string
+	err = db.QueryRow(`SELECT path, sha256 FROM training_files WHERE file_guid = 'AAA'`).Scan(&path, &sum)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if path != "training/42/Hose Lays.pptx" || len(sum) != 64 {
+		t.Fatalf("ERR: unexpected file reference %q %q", path, sum)
+	}
+
+	err = db.QueryRow(`SELECT data FROM incidents WHERE eid = '1001'`).Scan(&data)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if data != `{"EID":"1001","Incident Type":"111"}` {
+		t.Fatalf("ERR: unexpected incident data %s", data)
+	}
+
+	image, err := serializeSQLite(db)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if !bytes.HasPrefix(image, []byte("SQLite format 3\x00")) {
+		t.Fatalf("ERR: serialized database is not a SQLite file")
+	}
+}
+
+func Test_incidentSummaries(t *testing.T) {
+	// The second incident's type is the first one's EID
+	rows := [][]string{
+		{"Incident Type", "EID"},
+		{"111", "1001"},
+		{"1001", "1002"},
+	}
+	summaries := incidentSummaries(rows)
+	if len(summaries) != 2 || summaries["1001"]["Incident Type"] != "111" || summaries["1002"]["Incident Type"] != "1001" {
+		t.Fatalf("ERR: unexpected summaries %#v", summaries)
+	}
+	if summaries["111"] != nil {
+		t.Fatalf("ERR: row indexed by a value other than its EID")
+	}
+
+	if summaries = incidentSummaries([][]string{{"Incident Type"}, {"1001"}}); summaries != nil {
+		t.Fatalf("ERR: expected no summaries without an EID column, got %#v", summaries)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/dayvillefire/er-scraper/agent"
+)
+
+const transcriptsDir = "transcripts"
+
+// exportTranscripts builds each member's training transcript from a
+// training export in dir (default --out), writing them to the output as
+// JSON, CSV and printable HTML, with every member in transcripts.json and
+// transcripts.csv.
+func exportTranscripts(dir string) {
+	classes, ts := readTranscripts(dir)
+
+	openOutput()
+	for _, t := range ts {
+		base := transcriptsDir + "/" + agent.TranscriptFilename(t)
+		writeTranscripts(base, t, t)
+
+		var b bytes.Buffer
+		err := agent.WriteTranscriptHTML(&b, t)
+		if err == nil {
+			err = agent.WriteFile(output, base+".html", b.Bytes())
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	writeTranscripts(transcriptsDir+"/transcripts", ts, ts...)
+	log.Printf("INFO: Exported transcripts of %d members from %d classes", len(ts), len(classes))
+}
+
+// readTranscripts reads a training export in dir (default --out) and
+// builds its members' transcripts, exiting if it cannot be read. The
+// export has to be a directory; one encrypted file by file is decrypted
+// as it is read when --identity or --passphrase is given. Archives and
+// buckets have to be extracted (and decrypted) into a directory first.
+func readTranscripts(dir string) ([]agent.ClassAttendance, []agent.Transcript) {
+	if dir == "" {
+		dir = *outDir
+	}
+	fsys := fs.FS(os.DirFS(dir))
+	if *identityFile != "" || passphrase() != "" {
+		ids, err := agent.ParseIdentities(*identityFile, passphrase())
+		if err != nil {
+			log.Fatalf("ERR: Decryption identity: %s", err.Error())
+		}
+		fsys = agent.NewDecryptingFS(fsys, ids...)
+	}
+	classes, err := agent.ReadTrainingExport(fsys, pathTemplate("training-path", *trainingPath), attendanceColumns())
+	if err != nil {
+		log.Fatalf("ERR: Reading training export in %s: %s", dir, err.Error())
+	}
+	return classes, agent.BuildTranscripts(classes)
+}
+
+// attendanceColumns parses --attendance-columns, exiting on a bad value.
+func attendanceColumns() agent.AttendanceColumns {
+	cols, err := agent.ParseAttendanceColumns(*attendanceCols)
+	if err != nil {
+		log.Fatalf("ERR: --attendance-columns: %s", err.Error())
+	}
+	return cols
+}
+
+// writeTranscripts writes v as base.json and transcripts as base.csv.
+func writeTranscripts(base string, v any, ts ...agent.Transcript) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err == nil {
+		err = agent.WriteFile(output, base+".json", b)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var cb bytes.Buffer
+	err = agent.WriteTranscriptCSV(&cb, ts...)
+	if err == nil {
+		err = agent.WriteFile(output, base+".csv", cb.Bytes())
+	}
+	if err != nil {
+		panic(err)
+	}
+}
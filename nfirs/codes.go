@@ -0,0 +1,129 @@
+package nfirs
+
+import "regexp"
+
+// CodeTable is an NFIRS code table. Codes lists the valid codes and what
+// they mean; tables too long to list are checked against Pattern instead.
+type CodeTable struct {
+	Name    string
+	Codes   map[string]string
+	Pattern *regexp.Regexp
+}
+
+// Valid reports whether code is in the table.
+func (t CodeTable) Valid(code string) bool {
+	if t.Codes != nil {
+		_, ok := t.Codes[code]
+		return ok
+	}
+	return t.Pattern != nil && t.Pattern.MatchString(code)
+}
+
+// Tables are the code tables fields are validated against, by the names
+// used in field tags. Callers may replace or add tables, such as a state's
+// own incident type list, before validating.
+var Tables = map[string]CodeTable{
+	"State": {Name: "state", Codes: map[string]string{
+		"AL": "Alabama", "AK": "Alaska", "AZ": "Arizona", "AR": "Arkansas",
+		"CA": "California", "CO": "Colorado", "CT": "Connecticut", "DE": "Delaware",
+		"DC": "District of Columbia", "FL": "Florida", "GA": "Georgia", "HI": "Hawaii",
+		"ID": "Idaho", "IL": "Illinois", "IN": "Indiana", "IA": "Iowa",
+		"KS": "Kansas", "KY": "Kentucky", "LA": "Louisiana", "ME": "Maine",
+		"MD": "Maryland", "MA": "Massachusetts", "MI": "Michigan", "MN": "Minnesota",
+		"MS": "Mississippi", "MO": "Missouri", "MT": "Montana", "NE": "Nebraska",
+		"NV": "Nevada", "NH": "New Hampshire", "NJ": "New Jersey", "NM": "New Mexico",
+		"NY": "New York", "NC": "North Carolina", "ND": "North Dakota", "OH": "Ohio",
+		"OK": "Oklahoma", "OR": "Oregon", "PA": "Pennsylvania", "RI": "Rhode Island",
+		"SC": "South Carolina", "SD": "South Dakota", "TN": "Tennessee", "TX": "Texas",
+		"UT": "Utah", "VT": "Vermont", "VA": "Virginia", "WA": "Washington",
+		"WV": "West Virginia", "WI": "Wisconsin", "WY": "Wyoming",
+		"AS": "American Samoa", "GU": "Guam", "MP": "Northern Mariana Islands",
+		"PR": "Puerto Rico", "VI": "Virgin Islands",
+	}},
+	"FDID":           {Name: "FDID", Pattern: regexp.MustCompile(`^[0-9A-Z]{5}$`)},
+	"IncidentNumber": {Name: "incident number", Pattern: regexp.MustCompile(`^[0-9]{1,7}$`)},
+	"IncidentType":   {Name: "incident type", Pattern: regexp.MustCompile(`^[1-9][0-9]{2}$`)},
+	"AidGiven": {Name: "aid given or received", Codes: map[string]string{
+		"1": "Mutual aid received", "2": "Automatic aid received",
+		"3": "Mutual aid given", "4": "Automatic aid given",
+		"5": "Other aid given", "N": "None",
+	}},
+	"ActionTaken":        {Name: "action taken", Pattern: regexp.MustCompile(`^[0-9]{2}$`)},
+	"PropertyUse":        {Name: "property use", Pattern: regexp.MustCompile(`^([0-9]{3}|NNN|UUU)$`)},
+	"AreaOfOrigin":       {Name: "area of origin", Pattern: regexp.MustCompile(`^([0-9]{2}|UU)$`)},
+	"HeatSource":         {Name: "heat source", Pattern: regexp.MustCompile(`^([0-9]{2}|UU)$`)},
+	"ItemFirstIgnited":   {Name: "item first ignited", Pattern: regexp.MustCompile(`^([0-9]{2}|UU)$`)},
+	"FactorContributing": {Name: "factor contributing to ignition", Pattern: regexp.MustCompile(`^([0-9]{2}|NN|UU)$`)},
+	"HazMatRelease": {Name: "hazardous materials release", Codes: map[string]string{
+		"1": "Natural gas", "2": "Propane gas", "3": "Gasoline",
+		"4": "Kerosene, fuel oil or diesel", "5": "Household solvents",
+		"6": "Motor oil", "7": "Paint", "0": "Other", "N": "None",
+	}},
+	"Cause": {Name: "cause of ignition", Codes: map[string]string{
+		"1": "Intentional", "2": "Unintentional",
+		"3": "Failure of equipment or heat source", "4": "Act of nature",
+		"5": "Cause under investigation", "U": "Cause undetermined after investigation",
+		"0": "Other",
+	}},
+	"HumanFactor": {Name: "human factor", Codes: map[string]string{
+		"1": "Asleep", "2": "Possibly impaired by alcohol or drugs",
+		"3": "Unattended or unsupervised person", "4": "Possibly mentally disabled",
+		"5": "Physically disabled", "6": "Multiple persons involved",
+		"7": "Age was a factor", "N": "None",
+	}},
+	"StructureType": {Name: "structure type", Codes: map[string]string{
+		"1": "Enclosed building", "2": "Fixed portable or mobile structure",
+		"3": "Open structure", "4": "Air supported structure", "5": "Tent",
+		"6": "Open platform", "7": "Underground structure",
+		"8": "Connective structure", "0": "Other",
+	}},
+	"BuildingStatus": {Name: "building status", Codes: map[string]string{
+		"1": "Under construction", "2": "Occupied and operating",
+		"3": "Idle, not routinely used", "4": "Under major renovation",
+		"5": "Vacant and secured", "6": "Vacant and unsecured",
+		"7": "Being demolished", "0": "Other", "U": "Undetermined",
+	}},
+	"FireSpread": {Name: "fire spread", Codes: map[string]string{
+		"1": "Confined to object of origin", "2": "Confined to room of origin",
+		"3": "Confined to floor of origin", "4": "Confined to building of origin",
+		"5": "Beyond building of origin",
+	}},
+	"DetectorPresence": {Name: "detector presence", Codes: map[string]string{
+		"N": "None present", "1": "Present", "U": "Undetermined",
+	}},
+	"AESPresence": {Name: "automatic extinguishing system presence", Codes: map[string]string{
+		"N": "None present", "1": "Present", "2": "Partial system present", "U": "Undetermined",
+	}},
+	"Gender": {Name: "gender", Codes: map[string]string{
+		"1": "Male", "2": "Female",
+	}},
+	"Race": {Name: "race", Codes: map[string]string{
+		"1": "White", "2": "Black or African American",
+		"3": "American Indian or Alaska Native", "4": "Asian",
+		"5": "Native Hawaiian or other Pacific Islander",
+		"0": "Other, including multiracial", "U": "Undetermined",
+	}},
+	"Ethnicity": {Name: "ethnicity", Codes: map[string]string{
+		"1": "Hispanic or Latino", "0": "Non Hispanic or Latino", "U": "Undetermined",
+	}},
+	"CivilianSeverity": {Name: "civilian casualty severity", Codes: map[string]string{
+		"1": "Minor", "2": "Moderate", "3": "Severe", "4": "Life threatening",
+		"5": "Death", "U": "Undetermined",
+	}},
+	"FireServiceSeverity": {Name: "fire service casualty severity", Codes: map[string]string{
+		"1": "Report only", "2": "First aid only", "3": "Treated by physician",
+		"4": "Moderate", "5": "Severe", "6": "Life threatening", "7": "Death",
+		"U": "Undetermined",
+	}},
+	"ProviderImpression": {Name: "provider impression", Pattern: regexp.MustCompile(`^[0-9]{2}$`)},
+	"UNNumber":           {Name: "UN number", Pattern: regexp.MustCompile(`^[0-9]{4}$`)},
+	"ApparatusType":      {Name: "apparatus type", Pattern: regexp.MustCompile(`^[0-9]{2}$`)},
+	"ApparatusUse": {Name: "apparatus use", Codes: map[string]string{
+		"1": "Suppression", "2": "EMS", "0": "Other",
+	}},
+	"ArsonCaseStatus": {Name: "arson case status", Codes: map[string]string{
+		"1": "Investigation open", "2": "Investigation closed",
+		"3": "Investigation inactive", "4": "Closed with arrest",
+		"5": "Closed with exceptional clearance", "U": "Undetermined",
+	}},
+}
@@ -0,0 +1,5 @@
+module github.com/dayvillefire/er-scraper/nfirs
+
+go 1.23
+
+toolchain go1.23.0
@@ -0,0 +1,238 @@
+package nfirs
+
+import (
+	"fmt"
+	"time"
+)
+
+// The structs below follow the modules of the NFIRS paper forms, named by
+// their form numbers, but model only some of each module's fields, in an
+// order chosen by this package rather than the transaction format's.
+
+// Field tags give the checks Validate makes: req for a required field, num
+// for digits only, date for MMDDYYYY, datetime for MMDDYYYYhhmm, and
+// code=Table for a code from Tables.
+
+const (
+	dateLayout     = "01022006"
+	datetimeLayout = "010220061504"
+)
+
+// Key identifies an incident exposure, and starts every record.
+type Key struct {
+	State    string `nfirs:"req,code=State"`
+	FDID     string `nfirs:"req,code=FDID"`
+	Date     string `nfirs:"req,date"`
+	Station  string
+	Number   string `nfirs:"req,code=IncidentNumber"`
+	Exposure string `nfirs:"req,num"`
+}
+
+func (k Key) IncidentKey() Key {
+	return k
+}
+
+// String returns the key as state, FDID, incident date, number and
+// exposure.
+func (k Key) String() string {
+	return fmt.Sprintf("%s %s %s %s-%s", k.State, k.FDID, k.Date, k.Number, k.Exposure)
+}
+
+// IncidentDate returns the parsed incident date.
+func (k Key) IncidentDate() (time.Time, error) {
+	return time.Parse(dateLayout, k.Date)
+}
+
+// ParseTime parses a datetime field, such as Basic.AlarmTime.
+func ParseTime(s string) (time.Time, error) {
+	return time.Parse(datetimeLayout, s)
+}
+
+// Basic is the Basic Module (NFIRS-1), required for every incident.
+type Basic struct {
+	Key
+	// Action marks the record as new, a change or a delete.
+	Action               string
+	IncidentType         string `nfirs:"req,code=IncidentType"`
+	AidGiven             string `nfirs:"code=AidGiven"`
+	AlarmTime            string `nfirs:"req,datetime"`
+	ArrivalTime          string `nfirs:"datetime"`
+	ControlledTime       string `nfirs:"datetime"`
+	ClearedTime          string `nfirs:"datetime"`
+	Shift                string
+	Alarms               string `nfirs:"num"`
+	District             string
+	ActionTaken1         string `nfirs:"code=ActionTaken"`
+	ActionTaken2         string `nfirs:"code=ActionTaken"`
+	ActionTaken3         string `nfirs:"code=ActionTaken"`
+	SuppressionApparatus string `nfirs:"num"`
+	SuppressionPersonnel string `nfirs:"num"`
+	EMSApparatus         string `nfirs:"num"`
+	EMSPersonnel         string `nfirs:"num"`
+	PropertyLoss         string `nfirs:"num"`
+	ContentsLoss         string `nfirs:"num"`
+	FireServiceDeaths    string `nfirs:"num"`
+	FireServiceInjuries  string `nfirs:"num"`
+	CivilianDeaths       string `nfirs:"num"`
+	CivilianInjuries     string `nfirs:"num"`
+	HazMatRelease        string `nfirs:"code=HazMatRelease"`
+	PropertyUse          string `nfirs:"code=PropertyUse"`
+	Extra                []string
+}
+
+func (*Basic) Type() string { return TypeBasic }
+
+// Fire is the Fire Module (NFIRS-2).
+type Fire struct {
+	Key
+	BuildingsInvolved   string `nfirs:"num"`
+	AcresBurned         string `nfirs:"num"`
+	AreaOfOrigin        string `nfirs:"req,code=AreaOfOrigin"`
+	HeatSource          string `nfirs:"req,code=HeatSource"`
+	ItemFirstIgnited    string `nfirs:"req,code=ItemFirstIgnited"`
+	Cause               string `nfirs:"req,code=Cause"`
+	FactorContributing1 string `nfirs:"code=FactorContributing"`
+	FactorContributing2 string `nfirs:"code=FactorContributing"`
+	HumanFactor         string `nfirs:"code=HumanFactor"`
+	Extra               []string
+}
+
+func (*Fire) Type() string { return TypeFire }
+
+// StructureFire is the Structure Fire Module (NFIRS-3).
+type StructureFire struct {
+	Key
+	StructureType    string `nfirs:"req,code=StructureType"`
+	BuildingStatus   string `nfirs:"code=BuildingStatus"`
+	StoriesAbove     string `nfirs:"num"`
+	StoriesBelow     string `nfirs:"num"`
+	MainFloorSize    string `nfirs:"num"`
+	FireSpread       string `nfirs:"code=FireSpread"`
+	DetectorPresence string `nfirs:"code=DetectorPresence"`
+	AESPresence      string `nfirs:"code=AESPresence"`
+	Extra            []string
+}
+
+func (*StructureFire) Type() string { return TypeStructureFire }
+
+// CivilianCasualty is the Civilian Fire Casualty Module (NFIRS-4), one
+// record per casualty.
+type CivilianCasualty struct {
+	Key
+	Sequence   string `nfirs:"req,num"`
+	Gender     string `nfirs:"code=Gender"`
+	Age        string `nfirs:"num"`
+	Race       string `nfirs:"code=Race"`
+	Ethnicity  string `nfirs:"code=Ethnicity"`
+	InjuryTime string `nfirs:"datetime"`
+	Severity   string `nfirs:"req,code=CivilianSeverity"`
+	Extra      []string
+}
+
+func (*CivilianCasualty) Type() string { return TypeCivilianCasualty }
+
+// FireServiceCasualty is the Fire Service Casualty Module (NFIRS-5), one
+// record per casualty.
+type FireServiceCasualty struct {
+	Key
+	Sequence   string `nfirs:"req,num"`
+	Gender     string `nfirs:"code=Gender"`
+	Age        string `nfirs:"num"`
+	InjuryTime string `nfirs:"datetime"`
+	Severity   string `nfirs:"req,code=FireServiceSeverity"`
+	Extra      []string
+}
+
+func (*FireServiceCasualty) Type() string { return TypeFireServiceCasualty }
+
+// EMS is the EMS Module (NFIRS-6), one record per patient.
+type EMS struct {
+	Key
+	Patient            string `nfirs:"req,num"`
+	ArrivalTime        string `nfirs:"datetime"`
+	ProviderImpression string `nfirs:"code=ProviderImpression"`
+	Age                string `nfirs:"num"`
+	Gender             string `nfirs:"code=Gender"`
+	Race               string `nfirs:"code=Race"`
+	Ethnicity          string `nfirs:"code=Ethnicity"`
+	Extra              []string
+}
+
+func (*EMS) Type() string { return TypeEMS }
+
+// HazMat is the HazMat Module (NFIRS-7), one record per chemical.
+type HazMat struct {
+	Key
+	UNNumber     string `nfirs:"code=UNNumber"`
+	DOTClass     string
+	CASNumber    string
+	ChemicalName string
+	Extra        []string
+}
+
+func (*HazMat) Type() string { return TypeHazMat }
+
+// Wildland is the Wildland Fire Module (NFIRS-8).
+type Wildland struct {
+	Key
+	Latitude    string
+	Longitude   string
+	Cause       string `nfirs:"code=Cause"`
+	HumanFactor string `nfirs:"code=HumanFactor"`
+	AcresBurned string `nfirs:"num"`
+	Extra       []string
+}
+
+func (*Wildland) Type() string { return TypeWildland }
+
+// Apparatus is the Apparatus or Resources Module (NFIRS-9), one record
+// per apparatus.
+type Apparatus struct {
+	Key
+	ApparatusID   string `nfirs:"req"`
+	ApparatusType string `nfirs:"code=ApparatusType"`
+	DispatchTime  string `nfirs:"datetime"`
+	ArrivalTime   string `nfirs:"datetime"`
+	ClearTime     string `nfirs:"datetime"`
+	Personnel     string `nfirs:"num"`
+	Use           string `nfirs:"code=ApparatusUse"`
+	ActionTaken1  string `nfirs:"code=ActionTaken"`
+	ActionTaken2  string `nfirs:"code=ActionTaken"`
+	Extra         []string
+}
+
+func (*Apparatus) Type() string { return TypeApparatus }
+
+// Personnel is the Personnel Module (NFIRS-10), one record per member on
+// an apparatus.
+type Personnel struct {
+	Key
+	ApparatusID  string `nfirs:"req"`
+	PersonnelID  string `nfirs:"req"`
+	Rank         string
+	ActionTaken1 string `nfirs:"code=ActionTaken"`
+	ActionTaken2 string `nfirs:"code=ActionTaken"`
+	Extra        []string
+}
+
+func (*Personnel) Type() string { return TypePersonnel }
+
+// Arson is the Arson Module (NFIRS-11).
+type Arson struct {
+	Key
+	CaseStatus string `nfirs:"code=ArsonCaseStatus"`
+	Motivation string
+	Extra      []string
+}
+
+func (*Arson) Type() string { return TypeArson }
+
+// Unknown is a record of a type this package does not model, kept so that
+// it is written back out unchanged.
+type Unknown struct {
+	Code string `nfirs:"-"`
+	Key
+	Extra []string
+}
+
+func (u *Unknown) Type() string { return u.Code }
@@ -0,0 +1,245 @@
+// Package nfirs reads, validates and writes caret-delimited incident files
+// modeled on the modules of the National Fire Incident Reporting System.
+//
+// The layout is this package's own and is provisional: its record type
+// codes and field orders were not taken from the USFA NFIRS 5.0
+// Transaction File Format, which starts with a fire department header
+// record and uses its own record codes and field order. A real NFIRS 5.0
+// transaction file will not parse correctly, its records coming out as
+// Unknown or with their fields misplaced, until the layouts are rebuilt
+// from the published specification and tested against a conforming file.
+//
+// In this layout each line is one module of one incident exposure. Its
+// fields are separated by carets: the record type, the incident Key, then
+// the module's fields in the order of its struct in this package. Fields
+// past those modeled are kept in Extra, so that records written back out
+// lose nothing.
+package nfirs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	// Delimiter separates the fields of a record.
+	Delimiter = "^"
+	// lineEnding ends each record written, as on the DOS systems the
+	// format was designed for. Either ending is read.
+	lineEnding = "\r\n"
+)
+
+// Record types, the first field of each record. These codes are this
+// package's, not those of the NFIRS 5.0 transaction format.
+const (
+	TypeBasic               = "BASIC"
+	TypeFire                = "FIRE"
+	TypeStructureFire       = "STRUCTURE"
+	TypeCivilianCasualty    = "CIVCAS"
+	TypeFireServiceCasualty = "FFCAS"
+	TypeEMS                 = "EMS"
+	TypeHazMat              = "HAZMAT"
+	TypeWildland            = "WILDLAND"
+	TypeApparatus           = "APPARATUS"
+	TypePersonnel           = "PERSONNEL"
+	TypeArson               = "ARSON"
+)
+
+// recordTypes creates an empty record of each known type.
+var recordTypes = map[string]func() Record{
+	TypeBasic:               func() Record { return &Basic{} },
+	TypeFire:                func() Record { return &Fire{} },
+	TypeStructureFire:       func() Record { return &StructureFire{} },
+	TypeCivilianCasualty:    func() Record { return &CivilianCasualty{} },
+	TypeFireServiceCasualty: func() Record { return &FireServiceCasualty{} },
+	TypeEMS:                 func() Record { return &EMS{} },
+	TypeHazMat:              func() Record { return &HazMat{} },
+	TypeWildland:            func() Record { return &Wildland{} },
+	TypeApparatus:           func() Record { return &Apparatus{} },
+	TypePersonnel:           func() Record { return &Personnel{} },
+	TypeArson:               func() Record { return &Arson{} },
+}
+
+// Record is a parsed record, a pointer to one of the module structs, or to
+// Unknown for record types this package does not model.
+type Record interface {
+	// Type returns the record type.
+	Type() string
+	// IncidentKey returns the incident exposure the record belongs to.
+	IncidentKey() Key
+}
+
+// File is a parsed transaction file.
+type File struct {
+	Records []Record
+}
+
+// ParseError is returned for a line which is not a record.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parse reads a transaction file. Blank lines are skipped.
+func Parse(r io.Reader) (*File, error) {
+	f := &File{Records: []Record{}}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		rec, err := ParseRecord(scanner.Text())
+		if err != nil {
+			return f, &ParseError{Line: line, Err: err}
+		}
+		f.Records = append(f.Records, rec)
+	}
+	return f, scanner.Err()
+}
+
+// ParseRecord parses a single record. Missing trailing fields are left
+// empty.
+func ParseRecord(line string) (Record, error) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), Delimiter)
+	typ := strings.TrimSpace(fields[0])
+	if typ == "" {
+		return nil, fmt.Errorf("record has no type")
+	}
+
+	var rec Record
+	if newRecord, ok := recordTypes[typ]; ok {
+		rec = newRecord()
+	} else {
+		rec = &Unknown{Code: typ}
+	}
+
+	v := reflect.ValueOf(rec).Elem()
+	layout := layoutOf(v.Type())
+	rest := fields[1:]
+	for i, f := range layout {
+		if i >= len(rest) {
+			break
+		}
+		v.FieldByIndex(f.index).SetString(rest[i])
+	}
+	if len(rest) > len(layout) {
+		extra := append([]string{}, rest[len(layout):]...)
+		v.FieldByName("Extra").Set(reflect.ValueOf(extra))
+	}
+	return rec, nil
+}
+
+// FormatRecord returns a record as a line of a transaction file, without
+// the line ending. Every field of the record's layout is written, followed
+// by its Extra fields.
+func FormatRecord(rec Record) string {
+	v := reflect.ValueOf(rec).Elem()
+	fields := []string{rec.Type()}
+	for _, f := range layoutOf(v.Type()) {
+		fields = append(fields, v.FieldByIndex(f.index).String())
+	}
+	fields = append(fields, v.FieldByName("Extra").Interface().([]string)...)
+	return strings.Join(fields, Delimiter)
+}
+
+// WriteTo writes the file's records, one per line.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, rec := range f.Records {
+		n, err := io.WriteString(w, FormatRecord(rec)+lineEnding)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Incidents returns the keys of the incident exposures in the file, in the
+// order they first appear.
+func (f *File) Incidents() []Key {
+	out := make([]Key, 0)
+	seen := map[Key]bool{}
+	for _, rec := range f.Records {
+		k := rec.IncidentKey()
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// fieldSpec is a string field of a record struct, in layout order, with
+// the checks from its nfirs tag.
+type fieldSpec struct {
+	index    []int
+	name     string
+	required bool
+	numeric  bool
+	date     bool
+	datetime bool
+	table    string
+}
+
+var layouts sync.Map // reflect.Type -> []fieldSpec
+
+// layoutOf returns the fields of a record struct in the order they are
+// written, with those of an embedded Key first. Extra, and fields tagged
+// nfirs:"-", are not part of the layout.
+func layoutOf(t reflect.Type) []fieldSpec {
+	if l, ok := layouts.Load(t); ok {
+		return l.([]fieldSpec)
+	}
+
+	out := make([]fieldSpec, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous {
+			for _, f := range layoutOf(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				out = append(out, f)
+			}
+			continue
+		}
+		if sf.Name == "Extra" || sf.Type.Kind() != reflect.String || sf.Tag.Get("nfirs") == "-" {
+			continue
+		}
+
+		f := fieldSpec{index: []int{i}, name: sf.Name}
+		for _, opt := range strings.Split(sf.Tag.Get("nfirs"), ",") {
+			switch {
+			case opt == "req":
+				f.required = true
+			case opt == "num":
+				f.numeric = true
+			case opt == "date":
+				f.date = true
+			case opt == "datetime":
+				f.datetime = true
+			case strings.HasPrefix(opt, "code="):
+				f.table = strings.TrimPrefix(opt, "code=")
+			}
+		}
+		out = append(out, f)
+	}
+
+	layouts.Store(t, out)
+	return out
+}
@@ -0,0 +1,105 @@
+package nfirs
+
+import (
+	"strings"
+	"testing"
+)
+
+// testFile follows this package's provisional layout, not the NFIRS 5.0
+// transaction format.
+const testFile = "BASIC^CT^12345^01052024^1^0000042^000^N^111^N^010520241903^010520241910^010520242015^010520242200^B^1^1^11^12^^3^14^0^0^50000^10000^0^0^0^1^N^419\r\n" +
+	"FIRE^CT^12345^01052024^1^0000042^000^1^^24^12^76^2^10^^N\r\n" +
+	"STRUCTURE^CT^12345^01052024^1^0000042^000^1^2^2^0^1200^2^1^N\r\n" +
+	"CIVCAS^CT^12345^01052024^1^0000042^000^1^2^47^1^0^010520241905^3\r\n" +
+	"APPARATUS^CT^12345^01052024^1^0000042^000^E1^11^010520241903^010520241910^010520242200^4^1^11^12^FUTURE\r\n" +
+	"\r\n" +
+	"MUTAID^CT^12345^01052024^1^0000042^000^X\r\n"
+
+func Test_Parse(t *testing.T) {
+	f, err := Parse(strings.NewReader(testFile))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if len(f.Records) != 6 || len(f.Incidents()) != 1 {
+		t.Fatalf("ERR: unexpected records %#v", f.Records)
+	}
+
+	b, ok := f.Records[0].(*Basic)
+	if !ok || b.IncidentType != "111" || b.Number != "0000042" || b.PropertyUse != "419" || len(b.Extra) != 0 {
+		t.Fatalf("ERR: unexpected basic record %#v", f.Records[0])
+	}
+	alarm, err := ParseTime(b.AlarmTime)
+	if err != nil || alarm.Hour() != 19 || alarm.Minute() != 3 {
+		t.Fatalf("ERR: unexpected alarm time %s", b.AlarmTime)
+	}
+	if c := f.Records[3].(*CivilianCasualty); c.Age != "47" || c.Severity != "3" {
+		t.Fatalf("ERR: unexpected casualty %#v", c)
+	}
+	if a := f.Records[4].(*Apparatus); a.ApparatusID != "E1" || len(a.Extra) != 1 || a.Extra[0] != "FUTURE" {
+		t.Fatalf("ERR: unexpected apparatus %#v", a)
+	}
+	if u, ok := f.Records[5].(*Unknown); !ok || u.Type() != "MUTAID" || u.FDID != "12345" {
+		t.Fatalf("ERR: unexpected record %#v", f.Records[5])
+	}
+
+	// Full length records are written back unchanged
+	var out strings.Builder
+	_, err = f.WriteTo(&out)
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	if out.String() != strings.Replace(testFile, "\r\n\r\n", "\r\n", 1) {
+		t.Fatalf("ERR: unexpected output %q", out.String())
+	}
+
+	if _, err = Parse(strings.NewReader("BASIC^CT\r\n^CT\r\n")); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("ERR: expected an error on line 2, got %v", err)
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	f, err := Parse(strings.NewReader(testFile))
+	if err != nil {
+		t.Fatalf("ERR: %s", err.Error())
+	}
+	errs := f.Validate()
+	if len(errs) != 1 || errs[0].Record != 5 || errs[0].Message != "unknown record type" {
+		t.Fatalf("ERR: unexpected errors %v", errs)
+	}
+
+	rec, _ := ParseRecord("CIVCAS^XX^1234^13012024^1^42^000^^3^old^^^0105202419^9")
+	fields := map[string]string{}
+	for _, e := range Validate(rec) {
+		fields[e.Field] = e.Message
+	}
+	for field, msg := range map[string]string{
+		"State":      "is not a valid state code",
+		"FDID":       "is not a valid FDID code",
+		"Date":       "is not a date (MMDDYYYY)",
+		"Sequence":   "is required",
+		"Gender":     "is not a valid gender code",
+		"Age":        "is not a number",
+		"InjuryTime": "is not a date and time (MMDDYYYYhhmm)",
+		"Severity":   "is not a valid civilian casualty severity code",
+	} {
+		if fields[field] != msg {
+			t.Fatalf("ERR: expected %s %q, got %v", field, msg, fields)
+		}
+	}
+	if len(fields) != 8 {
+		t.Fatalf("ERR: unexpected errors %v", fields)
+	}
+
+	// Modules of an incident without a basic record
+	f, _ = Parse(strings.NewReader("FIRE^CT^12345^01052024^1^0000043^000^1^^24^12^76^2\r\n"))
+	errs = f.Validate()
+	if len(errs) != 1 || errs[0].Message != "incident has no BASIC record" {
+		t.Fatalf("ERR: unexpected errors %v", errs)
+	}
+
+	b := f.Records[0].(*Fire)
+	b.Cause = "2^3"
+	if errs = Validate(b); len(errs) != 1 || errs[0].Field != "Cause" {
+		t.Fatalf("ERR: unexpected errors %v", errs)
+	}
+}
@@ -0,0 +1,97 @@
+package nfirs
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// FieldError is a field which does not pass validation.
+type FieldError struct {
+	// Record is the index of the record in File.Records.
+	Record  int
+	Type    string
+	Key     Key
+	Field   string
+	Value   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("record %d (%s %s): %s %q: %s", e.Record+1, e.Type, e.Key, e.Field, e.Value, e.Message)
+}
+
+// Validate checks every record of the file, and that each incident
+// exposure with other modules has a Basic record.
+func (f *File) Validate() []FieldError {
+	out := make([]FieldError, 0)
+	basic := map[Key]bool{}
+	for _, rec := range f.Records {
+		if rec.Type() == TypeBasic {
+			basic[rec.IncidentKey()] = true
+		}
+	}
+
+	for i, rec := range f.Records {
+		for _, e := range Validate(rec) {
+			e.Record = i
+			out = append(out, e)
+		}
+		if !basic[rec.IncidentKey()] {
+			out = append(out, FieldError{
+				Record: i, Type: rec.Type(), Key: rec.IncidentKey(),
+				Message: "incident has no " + TypeBasic + " record",
+			})
+		}
+	}
+	return out
+}
+
+// Validate checks the fields of a single record against its layout and
+// Tables. Records of unknown types fail, but their key is still checked.
+func Validate(rec Record) []FieldError {
+	out := make([]FieldError, 0)
+	fail := func(field, value, msg string) {
+		out = append(out, FieldError{Type: rec.Type(), Key: rec.IncidentKey(), Field: field, Value: value, Message: msg})
+	}
+
+	if _, ok := rec.(*Unknown); ok {
+		fail("", "", "unknown record type")
+	}
+
+	v := reflect.ValueOf(rec).Elem()
+	for _, f := range layoutOf(v.Type()) {
+		value := v.FieldByIndex(f.index).String()
+		s := strings.TrimSpace(value)
+		switch {
+		case strings.ContainsAny(value, Delimiter+"\r\n"):
+			fail(f.name, value, "contains the delimiter or a line break")
+		case s == "":
+			if f.required {
+				fail(f.name, value, "is required")
+			}
+		case f.numeric && strings.Trim(s, "0123456789") != "":
+			fail(f.name, value, "is not a number")
+		case f.date && !validTime(dateLayout, s):
+			fail(f.name, value, "is not a date (MMDDYYYY)")
+		case f.datetime && !validTime(datetimeLayout, s):
+			fail(f.name, value, "is not a date and time (MMDDYYYYhhmm)")
+		case f.table != "" && !Tables[f.table].Valid(s):
+			fail(f.name, value, "is not a valid "+tableName(f.table)+" code")
+		}
+	}
+	return out
+}
+
+func validTime(layout, s string) bool {
+	_, err := time.Parse(layout, s)
+	return err == nil
+}
+
+func tableName(table string) string {
+	if t, ok := Tables[table]; ok && t.Name != "" {
+		return t.Name
+	}
+	return table
+}